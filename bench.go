@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"encode/proto"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"time"
+
+	protobuf "github.com/golang/protobuf/proto"
+)
+
+// benchCodec はbenchコマンドとベンチマークで比べるエンコード方式
+type benchCodec struct {
+	name string
+	// encoder はssをエンコードする関数を返す
+	// protobufの型への変換などの準備は計測に含めない
+	encoder func(ss TestStructs) (func() ([]byte, error), error)
+	decode  func(bs []byte) error
+}
+
+var benchCodecs = []benchCodec{
+	{name: "json", encoder: plainEncoder(encodeJson), decode: discardDecoded(decodeJson)},
+	{name: "gob", encoder: gobEncoder, decode: decodeGob},
+	{name: "self", encoder: plainEncoder(encodeSelf), decode: discardDecoded(decodeSelf)},
+	{name: "selftime", encoder: plainEncoder(encodeSelfTime), decode: discardDecoded(decodeSelfTime)},
+	{name: "selfinto", encoder: plainEncoder(encodeSelf), decode: decodeSelfInto()},
+	{name: "selfarena", encoder: plainEncoder(encodeSelf), decode: decodeSelfArena},
+	{name: "fixed", encoder: plainEncoder(encodeFixed), decode: discardDecoded(decodeFixed)},
+	{name: "bitmap", encoder: plainEncoder(encodeBitmap), decode: discardDecoded(decodeBitmap)},
+	{name: "omitzero", encoder: plainEncoder(encodeOmitZero), decode: discardDecoded(decodeOmitZero)},
+	{name: "protobuf", encoder: protoEncoder, decode: decodeProtobuf},
+	{name: "pbwire", encoder: plainEncoder(encodeProtoWire), decode: decodeProtobuf},
+}
+
+func lookupBenchCodec(name string) (benchCodec, bool) {
+	for _, c := range benchCodecs {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return benchCodec{}, false
+}
+
+func plainEncoder(encodeFn func(TestStructs) ([]byte, error)) func(TestStructs) (func() ([]byte, error), error) {
+	return func(ss TestStructs) (func() ([]byte, error), error) {
+		return func() ([]byte, error) { return encodeFn(ss) }, nil
+	}
+}
+
+func discardDecoded(decodeFn func([]byte) (TestStructs, error)) func([]byte) error {
+	return func(bs []byte) error {
+		_, err := decodeFn(bs)
+		return err
+	}
+}
+
+func protoEncoder(ss TestStructs) (func() ([]byte, error), error) {
+	p, err := ss.ToProto()
+	if err != nil {
+		return nil, err
+	}
+	return func() ([]byte, error) { return protobuf.Marshal(p) }, nil
+}
+
+func encodeJson(ss TestStructs) ([]byte, error) {
+	return json.Marshal(ss)
+}
+
+// gobTestSubStruct はTestSubStructと同じフィールドでMarshalBinaryを持たない型
+// TestStructsなどはMarshalBinaryを持つので、gobはそれを呼んでこのパッケージの形式になる
+// gob自体を計測するために、メソッドを持たない型に変換してからエンコードする
+type gobTestSubStruct TestSubStruct
+
+type gobTestStruct struct {
+	Str        string
+	Bool       bool
+	Int        int
+	Int16      int16
+	Int64      int64
+	Uint       uint
+	Uint8      uint8
+	Uint32     uint32
+	Time       time.Time
+	SubPointer *gobTestSubStruct
+	Subs       []gobTestSubStruct
+}
+
+type gobTestStructs []gobTestStruct
+
+func toGobTestStructs(ss TestStructs) gobTestStructs {
+	if ss == nil {
+		return nil
+	}
+	gs := make(gobTestStructs, len(ss))
+	for i, s := range ss {
+		gs[i] = gobTestStruct{
+			Str:    s.Str,
+			Bool:   s.Bool,
+			Int:    s.Int,
+			Int16:  s.Int16,
+			Int64:  s.Int64,
+			Uint:   s.Uint,
+			Uint8:  s.Uint8,
+			Uint32: s.Uint32,
+			Time:   s.Time,
+		}
+		if s.SubPointer != nil {
+			sub := gobTestSubStruct(*s.SubPointer)
+			gs[i].SubPointer = &sub
+		}
+		if s.Subs != nil {
+			gs[i].Subs = make([]gobTestSubStruct, len(s.Subs))
+			for j, sub := range s.Subs {
+				gs[i].Subs[j] = gobTestSubStruct(sub)
+			}
+		}
+	}
+	return gs
+}
+
+func fromGobTestStructs(gs gobTestStructs) TestStructs {
+	if gs == nil {
+		return nil
+	}
+	ss := make(TestStructs, len(gs))
+	for i, g := range gs {
+		ss[i] = TestStruct{
+			Str:    g.Str,
+			Bool:   g.Bool,
+			Int:    g.Int,
+			Int16:  g.Int16,
+			Int64:  g.Int64,
+			Uint:   g.Uint,
+			Uint8:  g.Uint8,
+			Uint32: g.Uint32,
+			Time:   g.Time,
+		}
+		if g.SubPointer != nil {
+			sub := TestSubStruct(*g.SubPointer)
+			ss[i].SubPointer = &sub
+		}
+		if g.Subs != nil {
+			ss[i].Subs = make(TestSubStructs, len(g.Subs))
+			for j, sub := range g.Subs {
+				ss[i].Subs[j] = TestSubStruct(sub)
+			}
+		}
+	}
+	return ss
+}
+
+// gobEncoder はMarshalBinaryを持たない型への変換を計測に含めない
+func gobEncoder(ss TestStructs) (func() ([]byte, error), error) {
+	gs := toGobTestStructs(ss)
+	return func() ([]byte, error) { return encodeGob(gs) }, nil
+}
+
+func encodeGob(gs gobTestStructs) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	err := gob.NewEncoder(buf).Encode(&gs)
+	bytes := buf.Bytes()
+	return bytes, err
+}
+
+func encodeSelf(ss TestStructs) ([]byte, error) {
+	return ss.Encode()
+}
+
+func encodeSelfTime(ss TestStructs) ([]byte, error) {
+	return ss.EncodeTime()
+}
+
+func encodeFixed(ss TestStructs) ([]byte, error) {
+	return ss.EncodeFixed()
+}
+
+func encodeBitmap(ss TestStructs) ([]byte, error) {
+	return ss.EncodeBitmap()
+}
+
+func encodeOmitZero(ss TestStructs) ([]byte, error) {
+	return ss.EncodeOmitZero()
+}
+
+func encodeProtoWire(ss TestStructs) ([]byte, error) {
+	return ss.MarshalProto()
+}
+
+func decodeJson(bs []byte) (TestStructs, error) {
+	decoded := TestStructs{}
+	err := json.Unmarshal(bs, &decoded)
+	return decoded, err
+}
+
+func decodeGob(bs []byte) error {
+	decoded := gobTestStructs{}
+	buf := bytes.NewBuffer(bs)
+	return gob.NewDecoder(buf).Decode(&decoded)
+}
+
+func decodeSelf(bs []byte) (TestStructs, error) {
+	decoded := TestStructs{}
+	_, err := decoded.Decode(bs)
+	return decoded, err
+}
+
+func decodeSelfTime(bs []byte) (TestStructs, error) {
+	decoded := TestStructs{}
+	_, err := decoded.Decode(bs)
+	return decoded, err
+}
+
+// decodeSelfInto は同じTestStructsにDecodeIntoでデコードし続ける関数を返す
+func decodeSelfInto() func([]byte) error {
+	decoded := TestStructs{}
+	return func(bs []byte) error {
+		_, err := decoded.DecodeInto(bs)
+		return err
+	}
+}
+
+func decodeSelfArena(bs []byte) error {
+	decoded := TestStructs{}
+	_, err := DecodeWithOptions(bs, &decoded, DecodeOptions{StringArena: true})
+	return err
+}
+
+func decodeFixed(bs []byte) (TestStructs, error) {
+	decoded := TestStructs{}
+	_, err := decoded.DecodeFixed(bs)
+	return decoded, err
+}
+
+func decodeBitmap(bs []byte) (TestStructs, error) {
+	decoded := TestStructs{}
+	_, err := decoded.DecodeBitmap(bs)
+	return decoded, err
+}
+
+func decodeOmitZero(bs []byte) (TestStructs, error) {
+	decoded := TestStructs{}
+	_, err := decoded.DecodeOmitZero(bs)
+	return decoded, err
+}
+
+func decodeProtobuf(bs []byte) error {
+	decoded := &proto.TestStructs{}
+	return protobuf.Unmarshal(bs, decoded)
+}
+
+// benchResult は1つのエンコード方式と要素数の計測結果
+type benchResult struct {
+	codec  string
+	size   int
+	bytes  int
+	encode benchStats
+	decode benchStats
+}
+
+// benchStats は1つの処理をN回繰り返した計測結果
+// testing.BenchmarkResultと同じ項目を持つが、benchコマンドからtestingを使わないように分ける
+type benchStats struct {
+	N         int
+	T         time.Duration
+	Bytes     int64
+	MemAllocs uint64
+}
+
+func (s benchStats) NsPerOp() int64 {
+	if s.N <= 0 {
+		return 0
+	}
+	return s.T.Nanoseconds() / int64(s.N)
+}
+
+func (s benchStats) AllocsPerOp() int64 {
+	if s.N <= 0 {
+		return 0
+	}
+	return int64(s.MemAllocs) / int64(s.N)
+}
+
+// runCodecBenchmark はssのエンコードとデコードをそれぞれbenchtime以上繰り返して計測する
+func runCodecBenchmark(c benchCodec, ss TestStructs, benchtime time.Duration) (benchResult, error) {
+	encodeFn, err := c.encoder(ss)
+	if err != nil {
+		return benchResult{}, err
+	}
+	bs, err := encodeFn()
+	if err != nil {
+		return benchResult{}, err
+	}
+	if err := c.decode(bs); err != nil {
+		return benchResult{}, err
+	}
+
+	result := benchResult{codec: c.name, size: len(ss), bytes: len(bs)}
+	result.encode, err = measure(func() error {
+		_, err := encodeFn()
+		return err
+	}, benchtime)
+	if err != nil {
+		return benchResult{}, err
+	}
+	result.decode, err = measure(func() error {
+		return c.decode(bs)
+	}, benchtime)
+	if err != nil {
+		return benchResult{}, err
+	}
+	result.encode.Bytes = int64(len(bs))
+	result.decode.Bytes = int64(len(bs))
+	return result, nil
+}
+
+// measure はtesting.Benchmarkと同じく、繰り返す回数を増やしながら合計がbenchtime以上になるまでfnを計測する
+func measure(fn func() error, benchtime time.Duration) (benchStats, error) {
+	n := 1
+	for {
+		s, err := measureN(fn, n)
+		if err != nil {
+			return benchStats{}, err
+		}
+		if s.T >= benchtime || n >= 1e9 {
+			return s, nil
+		}
+		// 前回の時間から目標に届く回数を多めに見積もり、1回で100倍までにする
+		next := n * 100
+		if s.T > 0 {
+			if predicted := int(int64(n) * int64(benchtime) / int64(s.T) * 6 / 5); predicted < next {
+				next = predicted
+			}
+		}
+		if next <= n {
+			next = n + 1
+		}
+		n = next
+	}
+}
+
+func measureN(fn func() error, n int) (benchStats, error) {
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := fn(); err != nil {
+			return benchStats{}, err
+		}
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	return benchStats{N: n, T: elapsed, MemAllocs: after.Mallocs - before.Mallocs}, nil
+}
+
+var benchReportHeader = []string{
+	"codec", "size", "bytes",
+	"encode ns/op", "encode allocs/op", "encode MB/s",
+	"decode ns/op", "decode allocs/op", "decode MB/s",
+}
+
+func (r benchResult) row() []string {
+	return []string{
+		r.codec,
+		strconv.Itoa(r.size),
+		strconv.Itoa(r.bytes),
+		strconv.FormatInt(r.encode.NsPerOp(), 10),
+		strconv.FormatInt(r.encode.AllocsPerOp(), 10),
+		strconv.FormatFloat(mbPerSec(r.encode), 'f', 2, 64),
+		strconv.FormatInt(r.decode.NsPerOp(), 10),
+		strconv.FormatInt(r.decode.AllocsPerOp(), 10),
+		strconv.FormatFloat(mbPerSec(r.decode), 'f', 2, 64),
+	}
+}
+
+// mbPerSec はtesting.BenchmarkResultと同じく10^6バイトを1MBとする
+func mbPerSec(r benchStats) float64 {
+	if r.T <= 0 || r.N <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) * float64(r.N) / 1e6 / r.T.Seconds()
+}
+
+// writeBenchReport は計測結果をMarkdownかCSVの表で出力する
+func writeBenchReport(w io.Writer, results []benchResult, format string) error {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(benchReportHeader)
+		for _, r := range results {
+			cw.Write(r.row())
+		}
+		cw.Flush()
+		return cw.Error()
+	case "md", "markdown":
+		rows := [][]string{benchReportHeader}
+		for _, r := range results {
+			rows = append(rows, r.row())
+		}
+		widths := make([]int, len(benchReportHeader))
+		for _, row := range rows {
+			for i, cell := range row {
+				if len(cell) > widths[i] {
+					widths[i] = len(cell)
+				}
+			}
+		}
+		for i, row := range rows {
+			writeMarkdownRow(w, row, widths, false)
+			if i == 0 {
+				writeMarkdownRow(w, nil, widths, true)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+// writeMarkdownRow は1行を書き出す
+// 名前の列は左寄せ、数値の列は右寄せにする
+func writeMarkdownRow(w io.Writer, row []string, widths []int, separator bool) {
+	fmt.Fprint(w, "|")
+	for i, width := range widths {
+		switch {
+		case separator && i == 0:
+			fmt.Fprintf(w, " %s |", bytes.Repeat([]byte("-"), width))
+		case separator:
+			fmt.Fprintf(w, " %s: |", bytes.Repeat([]byte("-"), width-1))
+		case i == 0:
+			fmt.Fprintf(w, " %-*s |", width, row[i])
+		default:
+			fmt.Fprintf(w, " %*s |", width, row[i])
+		}
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchCodecsRoundTrip(t *testing.T) {
+	ss := createTestStructs(2)
+	for _, c := range benchCodecs {
+		t.Run(c.name, func(t *testing.T) {
+			encodeFn, err := c.encoder(ss)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bs, err := encodeFn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.decode(bs); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWriteBenchReport(t *testing.T) {
+	results := []benchResult{{
+		codec:  "self",
+		size:   10,
+		bytes:  1000,
+		encode: benchStats{N: 100, T: time.Millisecond, Bytes: 1000, MemAllocs: 100},
+		decode: benchStats{N: 10, T: time.Millisecond, Bytes: 1000, MemAllocs: 50},
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	if err := writeBenchReport(buf, results, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	want := "codec,size,bytes,encode ns/op,encode allocs/op,encode MB/s,decode ns/op,decode allocs/op,decode MB/s\n" +
+		"self,10,1000,10000,1,100.00,100000,5,10.00\n"
+	if buf.String() != want {
+		t.Errorf("csv report = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := writeBenchReport(buf, results, "md"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "| ----- | ---: |") {
+		t.Errorf("markdown report =\n%s", buf.String())
+	}
+
+	if err := writeBenchReport(buf, results, "xml"); err == nil {
+		t.Error("writeBenchReport accepted an unknown format")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = TestStruct{}
+	_ encoding.BinaryUnmarshaler = &TestStruct{}
+	_ encoding.BinaryMarshaler   = TestSubStruct{}
+	_ encoding.BinaryUnmarshaler = &TestSubStruct{}
+	_ encoding.BinaryMarshaler   = TestStructs{}
+	_ encoding.BinaryUnmarshaler = &TestStructs{}
+)
+
+func TestMarshalBinaryRoundTrip(t *testing.T) {
+	data := createTestStructs(10)
+	tests := []struct {
+		name    string
+		value   encoding.BinaryMarshaler
+		decoded encoding.BinaryUnmarshaler
+	}{
+		{name: "TestStructs", value: data, decoded: &TestStructs{}},
+		{name: "TestStruct", value: data[0], decoded: &TestStruct{}},
+		{name: "TestSubStruct", value: *data[0].SubPointer, decoded: &TestSubStruct{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := tt.value.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.decoded.UnmarshalBinary(bs); err != nil {
+				t.Fatal(err)
+			}
+			// デコード先はポインタなので値を取り出して比べる
+			if diff := cmp.Diff(tt.value, reflectIndirect(tt.decoded)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func reflectIndirect(v interface{}) interface{} {
+	switch p := v.(type) {
+	case *TestStructs:
+		return *p
+	case *TestStruct:
+		return *p
+	case *TestSubStruct:
+		return *p
+	}
+	return v
+}
+
+func TestGobUsesMarshalBinary(t *testing.T) {
+	data := createTestStructs(10)
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(&data); err != nil {
+		t.Fatal(err)
+	}
+	self, err := data.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), self) {
+		t.Error("gob output does not contain the MarshalBinary output")
+	}
+
+	decoded := TestStructs{}
+	if err := gob.NewDecoder(buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(data, decoded); diff != "" {
+		t.Error(diff)
+	}
+}
+
+// testBinaryID は自身のMarshalBinaryを持つフィールドの型
+type testBinaryID [4]byte
+
+func (id testBinaryID) MarshalBinary() ([]byte, error) {
+	return id[:], nil
+}
+
+func (id *testBinaryID) UnmarshalBinary(data []byte) error {
+	if len(data) != len(id) {
+		return errors.New("testBinaryID: invalid length")
+	}
+	copy(id[:], data)
+	return nil
+}
+
+func TestFieldMarshalBinary(t *testing.T) {
+	type record struct {
+		ID  testBinaryID
+		Ss  TestStructs
+		Str string
+	}
+	data := record{ID: testBinaryID{1, 2, 3, 4}, Ss: createTestStructs(2), Str: "test_string"}
+	bs, err := EncodeStruct(data, LayoutFlatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ID: 長さ + MarshalBinaryの出力
+	if want := []byte{4, 1, 2, 3, 4}; !bytes.HasPrefix(bs, want) {
+		t.Errorf("EncodeStruct = %v, want prefix %v", bs[:len(want)], want)
+	}
+
+	decoded := record{}
+	n, err := DecodeStruct(bs, &decoded, LayoutFlatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(bs) {
+		t.Errorf("decoded %d bytes, want %d", n, len(bs))
+	}
+	if diff := cmp.Diff(data, decoded); diff != "" {
+		t.Error(diff)
+	}
+}
+
+// TestGobBenchTypes はベンチマークのgobがMarshalBinaryではなく構造体自体をエンコードすることを確認する
+func TestGobBenchTypes(t *testing.T) {
+	ss := createTestStructs(2)
+	ss[1].SubPointer = nil
+	ss[1].Subs = nil
+	bs, err := encodeGob(toGobTestStructs(ss))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gobは構造体のフィールド名を型の情報として送る
+	if !bytes.Contains(bs, []byte("SubPointer")) {
+		t.Error("gob output has no field names; MarshalBinary was used")
+	}
+
+	decoded := gobTestStructs{}
+	if err := gob.NewDecoder(bytes.NewReader(bs)).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ss, fromGobTestStructs(decoded)); diff != "" {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "errors"
+
+// ErrInvalidBitmap はビットマップモードで使っていないビットが立っている場合のエラー
+var ErrInvalidBitmap = errors.New("decode: unused bits set in bitmap")
+
+// ビットマップモードでは構造体ごとに真偽値とnil判定を宣言順に下位ビットから詰め、
+// 構造体の先頭に置く。フラグが8個以下なら1バイトになる
+
+// bitmapLen はflags個のフラグを詰めたビットマップのバイト数
+func bitmapLen(flags int) int {
+	return (flags + 7) / 8
+}
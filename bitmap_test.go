@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// bitmapTestStructs は真偽値とnil判定の組み合わせを全て含むTestStructs
+func bitmapTestStructs() TestStructs {
+	ss := createTestStructs(8)
+	for i := range ss {
+		ss[i].Bool = i&1 != 0
+		if i&2 != 0 {
+			ss[i].SubPointer = nil
+		}
+		if i&4 != 0 {
+			ss[i].Subs = nil
+		}
+	}
+	ss[0].Subs = TestSubStructs{}
+	return ss
+}
+
+func TestBitmapRoundTrip(t *testing.T) {
+	checkTestStructsMode(t, map[string]TestStructs{"flags": bitmapTestStructs()}, TestStructs.EncodeBitmap, (*TestStructs).DecodeBitmap)
+}
+
+// TestBitmapCompatibility はビットマップモードと1フラグ1バイトのモードで同じ値にデコードされ、
+// TestStructごとにBoolとnil判定2つの3バイトが1バイトのビットマップになることを確認する
+func TestBitmapCompatibility(t *testing.T) {
+	ss := bitmapTestStructs()
+	plain, err := ss.EncodeTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmap, err := ss.EncodeBitmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := len(plain) - 2*len(ss); len(bitmap) != want {
+		t.Errorf("len(EncodeBitmap()) = %d, want %d", len(bitmap), want)
+	}
+
+	fromPlain := TestStructs{}
+	if _, err := fromPlain.Decode(plain); err != nil {
+		t.Fatal(err)
+	}
+	fromBitmap := TestStructs{}
+	if _, err := fromBitmap.DecodeBitmap(bitmap); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(fromPlain, fromBitmap); diff != "" {
+		t.Error(diff)
+	}
+
+	// TestSubStructはフラグがBoolだけなので大きさは変わらない
+	sub := createTestSubStruct()
+	subPlain, err := sub.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subBitmap, err := sub.EncodeBitmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subBitmap) != len(subPlain) {
+		t.Errorf("TestSubStruct: len(EncodeBitmap()) = %d, len(Encode()) = %d", len(subBitmap), len(subPlain))
+	}
+}
+
+func TestBitmapInvalid(t *testing.T) {
+	bs, err := bitmapTestStructs().EncodeBitmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 先頭の要素のビットマップはnil判定と長さの2バイトの後にある
+	bs[2] |= 1 << testStructBitmapFlags
+	decoded := TestStructs{}
+	if _, err := decoded.DecodeBitmap(bs); !errors.Is(err, ErrInvalidBitmap) {
+		t.Errorf("DecodeBitmap(unused bit) error = %v, want %v", err, ErrInvalidBitmap)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBytesEncode(t *testing.T) {
+	for _, b := range [][]byte{{0, 1, 255, 128}, {}, nil} {
+		bs, nEn := BytesEncode(b)
+		// nil判定 + 1バイトの長さ + バイト列
+		want := VarintLenPointer
+		if b != nil {
+			want += 1 + len(b)
+		}
+		if nEn != want {
+			t.Errorf("BytesEncode(%v) wrote %d bytes, want %d", b, nEn, want)
+		}
+		decoded, nDe := BytesDecode(bs)
+		if nDe != nEn {
+			t.Errorf("BytesDecode read %d bytes, want %d", nDe, nEn)
+		}
+		if diff := cmp.Diff(b, decoded); diff != "" {
+			t.Error(diff)
+		}
+		if (b == nil) != (decoded == nil) {
+			t.Errorf("BytesDecode(%v) nil = %v", bs, decoded == nil)
+		}
+
+		generic, err := EncodeSlice(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(generic, bs) {
+			t.Errorf("EncodeSlice(%v) = %v, want %v", b, generic, bs)
+		}
+	}
+}
+
+func TestTestEnvelopeCopyAndAlias(t *testing.T) {
+	data := TestEnvelope{
+		Kind:    "test_kind",
+		Payload: []byte{0, 1, 2, 200},
+		Raw:     json.RawMessage(`{"a":1}`),
+	}
+	bs, err := data.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := TestEnvelope{}
+	if _, err := copied.Decode(bs); err != nil {
+		t.Fatal(err)
+	}
+	aliased := TestEnvelope{}
+	n, err := aliased.DecodeAlias(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(bs) {
+		t.Errorf("decoded %d bytes, want %d", n, len(bs))
+	}
+	if diff := cmp.Diff(data, aliased); diff != "" {
+		t.Error(diff)
+	}
+
+	// 入力を書き換えるとエイリアスだけが変わる
+	for i := range bs {
+		bs[i] = 0xff
+	}
+	if diff := cmp.Diff(data, copied); diff != "" {
+		t.Error(diff)
+	}
+	if aliased.Payload[0] != 0xff {
+		t.Error("DecodeAlias copied the payload")
+	}
+}
+
+func TestGenericNamedByteSlice(t *testing.T) {
+	raw := json.RawMessage(`[1,2,3]`)
+	bs, err := EncodePointer(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := DecodePointer[json.RawMessage](bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(raw, *decoded); diff != "" {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commands はstructencのサブコマンド
+// 引数なしで実行した場合はmainで各エンコード方式を比較する
+var commands = map[string]func(args []string) error{
+	"proto":     runProto,
+	"dump":      runDump,
+	"transcode": runTranscode,
+	"bench":     runBench,
+}
+
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q (commands: %s)", name, strings.Join(names, ", "))
+	}
+	return cmd(args)
+}
+
+// runProto はGoの構造体の定義から.protoファイルを出力する
+// -goを指定した場合はprotocで生成した型との変換を出力する
+func runProto(args []string) error {
+	fs := flag.NewFlagSet("proto", flag.ExitOnError)
+	pkg := fs.String("package", "proto", "protobuf package name")
+	goOut := fs.Bool("go", false, "generate ToProto/FromProto converters instead of a .proto file")
+	goPkg := fs.String("gopackage", "main", "Go package name of the converters")
+	protoImport := fs.String("import", "encode/proto", "import path of the protoc generated package")
+	out := fs.String("o", "", "output file (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: structenc proto [-package name] [-go] [-o file] file.go...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	schema, err := parseProtoSchema(fs.Args())
+	if err != nil {
+		return err
+	}
+	if *goOut {
+		b, err := generateProtoConverters(schema, *goPkg, *protoImport)
+		if err != nil {
+			return err
+		}
+		return writeOutput(*out, b)
+	}
+	return writeOutput(*out, generateProto(schema, *pkg))
+}
+
+// runDump はエンコードしたバイト列をSchemaに従ってJSONで出力する
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	typeName := fs.String("type", "", "registered type name ("+strings.Join(RegisteredTypeNames(), ", ")+")")
+	schemaFile := fs.String("schema", "", "schema description file (JSON)")
+	hex := fs.Bool("hex", false, "print an annotated hexdump instead of JSON")
+	showSchema := fs.Bool("show-schema", false, "print the schema as JSON and exit")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: structenc dump (-type name | -schema file) [-hex] [file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	schema, err := loadSchema(*typeName, *schemaFile)
+	if err != nil {
+		return err
+	}
+	if *showSchema {
+		b, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeOutput("", append(b, '\n'))
+	}
+
+	in, err := readInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *hex {
+		annotations, err := schema.Annotate(in)
+		writeAnnotations(os.Stdout, in, annotations)
+		return err
+	}
+	v, n, err := schema.Decode(in)
+	if err != nil {
+		return err
+	}
+	if n != len(in) {
+		return fmt.Errorf("dump: %d trailing bytes after offset %d", len(in)-n, n)
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeOutput("", append(b, '\n'))
+}
+
+// runTranscode はJSONとバイト列を相互に変換する
+func runTranscode(args []string) error {
+	fs := flag.NewFlagSet("transcode", flag.ExitOnError)
+	typeName := fs.String("type", "", "registered type name ("+strings.Join(RegisteredTypeNames(), ", ")+")")
+	schemaFile := fs.String("schema", "", "schema description file (JSON)")
+	to := fs.String("to", "binary", "output format (binary or json)")
+	out := fs.String("o", "", "output file (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: structenc transcode (-type name | -schema file) [-to binary|json] [-o file] [file]")
+		fmt.Fprintln(fs.Output(), "JSON from a pipe is buffered in memory before writing; pass a file to stream large arrays")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	schema, err := loadSchema(*typeName, *schemaFile)
+	if err != nil {
+		return err
+	}
+	transcode := TranscodeJSONToBinary
+	switch *to {
+	case "binary":
+	case "json":
+		transcode = TranscodeBinaryToJSON
+	default:
+		return fmt.Errorf("unknown output format %q", *to)
+	}
+
+	in := os.Stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		if in, err = os.Open(name); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	return transcode(w, in, schema)
+}
+
+// runBench はエンコード方式ごとにエンコードとデコードを計測して表で出力する
+func runBench(args []string) error {
+	names := make([]string, len(benchCodecs))
+	for i, c := range benchCodecs {
+		names[i] = c.name
+	}
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	sizes := fs.String("n", "1,10,100,1000", "comma separated numbers of TestStruct elements")
+	codecNames := fs.String("codecs", strings.Join(names, ","), "comma separated codecs")
+	format := fs.String("format", "md", "report format (md or csv)")
+	benchtime := fs.Duration("benchtime", time.Second, "run time of each benchmark")
+	out := fs.String("o", "", "output file (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: structenc bench [-n sizes] [-codecs names] [-format md|csv] [-benchtime d] [-o file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var codecs []benchCodec
+	for _, name := range strings.Split(*codecNames, ",") {
+		c, ok := lookupBenchCodec(strings.TrimSpace(name))
+		if !ok {
+			return fmt.Errorf("unknown codec %q (codecs: %s)", name, strings.Join(names, ", "))
+		}
+		codecs = append(codecs, c)
+	}
+	var counts []int
+	for _, size := range strings.Split(*sizes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid size %q", size)
+		}
+		counts = append(counts, n)
+	}
+
+	var results []benchResult
+	for _, n := range counts {
+		ss := createTestStructs(n)
+		for _, c := range codecs {
+			result, err := runCodecBenchmark(c, ss, *benchtime)
+			if err != nil {
+				return fmt.Errorf("%s: %w", c.name, err)
+			}
+			results = append(results, result)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := writeBenchReport(buf, results, *format); err != nil {
+		return err
+	}
+	return writeOutput(*out, buf.Bytes())
+}
+
+// loadSchema は登録されている型の名前か、Schemaのファイルから読み取る
+func loadSchema(typeName, schemaFile string) (*Schema, error) {
+	switch {
+	case typeName != "" && schemaFile != "":
+		return nil, errors.New("-type and -schema are mutually exclusive")
+	case typeName != "":
+		return LookupSchema(typeName)
+	case schemaFile != "":
+		f, err := os.Open(schemaFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ReadSchema(f)
+	}
+	return nil, errors.New("-type or -schema is required")
+}
+
+// writeAnnotations は値ごとにオフセット、バイト列、位置とデコードした値を出力する
+// 1行に収まらないバイト列は、オフセットを付けた続きの行に折り返してすべて出力する
+func writeAnnotations(w io.Writer, in []byte, annotations []SchemaAnnotation) {
+	const bytesPerLine = 8
+	for _, a := range annotations {
+		raw := in[a.Start:a.End]
+		first := raw
+		if len(first) > bytesPerLine {
+			first = first[:bytesPerLine]
+		}
+		fmt.Fprintf(w, "%08x  %-23s  %s = %s\n", a.Start, fmt.Sprintf("% x", first), a.Path, formatAnnotationValue(a.Value))
+		for i := bytesPerLine; i < len(raw); i += bytesPerLine {
+			end := i + bytesPerLine
+			if end > len(raw) {
+				end = len(raw)
+			}
+			fmt.Fprintf(w, "%08x  % x\n", a.Start+i, raw[i:end])
+		}
+	}
+}
+
+func formatAnnotationValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []byte:
+		return fmt.Sprintf("%x", v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// readInput はファイル名が空か"-"の場合は標準入力から読み取る
+func readInput(filename string) ([]byte, error) {
+	if filename == "" || filename == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(filename)
+}
+
+func writeOutput(filename string, b []byte) error {
+	if filename == "" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(filename, b, 0644)
+}
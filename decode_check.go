@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrVarintOverflow はvarintが64ビットに収まらない場合のエラー
+	ErrVarintOverflow = errors.New("decode: varint overflows a 64-bit integer")
+	// ErrInvalidLength はスライスの長さが負の場合のエラー
+	ErrInvalidLength = errors.New("decode: invalid length")
+)
+
+// varintErr はbinary.Uvarintなどが0以下のバイト数を返した場合のエラーを返す
+// 0なら入力が途中で終わっていて、負なら64ビットを超えている
+func varintErr(n int) error {
+	if n == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return ErrVarintOverflow
+}
+
+// checkLen はin[n:]に長さlのバイト列が残っているか確認する
+func checkLen(in []byte, n int, l uint64) error {
+	if l > uint64(len(in)-n) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// checkSliceLen はスライスの長さを確認する
+// 1要素は少なくとも1バイトなので、残りのバイト数より多い要素数は入力が足りない
+// これで不正な長さから大きなスライスを確保しないようにする
+// 0バイトにエンコードされる要素のスライスはcheckElemSliceLenで確認する
+func checkSliceLen(in []byte, n int, l int64) error {
+	if l < 0 {
+		return ErrInvalidLength
+	}
+	return checkLen(in, n, uint64(l))
+}
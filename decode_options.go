@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+	"unsafe"
+)
+
+// DecodeOptions は信頼できない入力をデコードするときの上限
+// 0の項目は制限しない
+// 上限がなくても、入力の残りより長い長さはデコード前にエラーにする
+type DecodeOptions struct {
+	// MaxSliceLen はスライスとmapの要素数の上限
+	MaxSliceLen int
+	// MaxStringLen は文字列とバイト列の長さの上限
+	MaxStringLen int
+	// MaxDepth は構造体、スライス、mapの入れ子の深さの上限
+	MaxDepth int
+	// MaxTotalBytes はデコードで確保するメモリの合計の上限
+	// 文字列とバイト列の長さ、ポインタの先の大きさ、スライスとmapの要素の大きさ×要素数で数える
+	MaxTotalBytes int
+	// StringArena はデコードした文字列を1つの領域にまとめて確保する
+	// 文字列ごとの割り当てがなくなる代わりに入力と同じ大きさの領域を確保し、
+	// どれか1つの文字列が残っている間は領域全体が解放されない
+	StringArena bool
+	// Strict は正規形でない入力をエラーにする
+	// 最短でないvarint、0と1以外の真偽値とnil判定、型の範囲を超える整数、
+	// 昇順でないmapのキー、入力の後ろに残ったバイト列が対象
+	Strict bool
+}
+
+var (
+	ErrDecodeLimit   = errors.New("decode: limit exceeded")
+	ErrNonCanonical  = errors.New("decode: non-canonical encoding")
+	ErrTrailingBytes = errors.New("decode: trailing bytes")
+)
+
+// DecodeWithOptions はoptsの上限を超えないようにvにデコードする
+// vは生成されたデコードメソッドを持つ型か、EncodeStructなどでエンコードした値へのポインタ
+func DecodeWithOptions(in []byte, v interface{}, opts DecodeOptions) (int, error) {
+	d := &decodeState{opts: opts, arenaSize: len(in)}
+	var n int
+	var err error
+	if sd, ok := v.(stateDecoder); ok {
+		n, err = sd.decodeWith(in, d)
+	} else {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Pointer || rv.IsNil() {
+			return 0, ErrUnsupportedType
+		}
+		rv = rv.Elem()
+		rv.Set(reflect.Zero(rv.Type()))
+		n, err = decodeReflect(in, rv, LayoutFlatten, d)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, d.checkTrailing(in, n)
+}
+
+// DecodeStructWithOptions はDecodeStructと同じくlayoutで構造体にデコードする
+func DecodeStructWithOptions(in []byte, v interface{}, layout Layout, opts DecodeOptions) (int, error) {
+	d := &decodeState{opts: opts, arenaSize: len(in)}
+	n, err := decodeStructPointer(in, v, layout, d)
+	if err != nil {
+		return 0, err
+	}
+	return n, d.checkTrailing(in, n)
+}
+
+// CheckCanonical はinがvの型の正規形のエンコードか確認する
+// 厳密モードでvにデコードしてから再エンコードし、入力と同じバイト列になるか比べる
+// mapはキーのエンコード結果の昇順を正規形とする
+func CheckCanonical(in []byte, v interface{}) error {
+	if _, err := DecodeWithOptions(in, v, DecodeOptions{Strict: true}); err != nil {
+		return err
+	}
+	out, err := encodeCodec(v)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(in, out) {
+		return ErrNonCanonical
+	}
+	return nil
+}
+
+// encodeCodec はvを生成されたエンコードメソッドか、EncodeStructのLayoutFlattenでエンコードする
+// 構造体でない値はリフレクションでエンコードする
+// DecodeWithOptionsでデコードできる形式になる
+func encodeCodec(v interface{}) ([]byte, error) {
+	switch e := v.(type) {
+	case interface{ Encode() ([]byte, error) }:
+		return e.Encode()
+	case Encoder:
+		out := make([]byte, e.Size())
+		n, err := e.EncodeWithBytes(out)
+		if err != nil {
+			return nil, err
+		}
+		return out[:n], nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil, ErrUnsupportedType
+	}
+	if rv.Kind() == reflect.Struct {
+		return EncodeStruct(v, LayoutFlatten)
+	}
+	// intやstringなど構造体でない値はDecodeWithOptionsと同じくリフレクションでエンコードする
+	rv = addressable(rv)
+	e := &encodeState{}
+	out := make([]byte, sizeReflect(rv, LayoutFlatten, e))
+	n, err := encodeReflect(out, rv, LayoutFlatten, e)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// stateDecoder はデコードの上限を引き継げる生成された型
+type stateDecoder interface {
+	decodeWith(in []byte, d *decodeState) (int, error)
+}
+
+// decodeState はデコード中の入れ子の深さと確保したバイト数を数える
+// nilなら制限しない
+type decodeState struct {
+	opts  DecodeOptions
+	depth int
+	total int
+	// reuse はDecodeIntoのようにデコード先のスライスの容量とポインタの先を使い回すか
+	reuse bool
+	// arena はStringArenaの場合に文字列をまとめてコピーする領域で、最初の文字列でarenaSizeだけ確保する
+	arena     []byte
+	arenaSize int
+}
+
+// newReuseState はDecodeIntoで使う、値を使い回して文字列をアリーナに確保する状態を返す
+func newReuseState(in []byte) decodeState {
+	return decodeState{reuse: true, opts: DecodeOptions{StringArena: true}, arenaSize: len(in)}
+}
+
+func (d *decodeState) reusing() bool {
+	return d != nil && d.reuse
+}
+
+// decodeString はデコードした文字列を返す
+// 使い回す場合に前の値と同じ内容なら前の文字列をそのまま返す
+// StringArenaの場合はアリーナにコピーして切り出す
+func (d *decodeState) decodeString(old string, b []byte) string {
+	if d.reusing() && old == string(b) {
+		return old
+	}
+	if d == nil || !d.opts.StringArena || len(b) == 0 {
+		return string(b)
+	}
+	if d.arena == nil {
+		// 文字列は全て入力の一部なので、入力の長さがあれば足りる
+		d.arena = make([]byte, 0, d.arenaSize)
+	}
+	if len(b) > cap(d.arena)-len(d.arena) {
+		return string(b)
+	}
+	start := len(d.arena)
+	d.arena = append(d.arena, b...)
+	str := d.arena[start:len(d.arena):len(d.arena)]
+	// アリーナは追記だけで書き換えないので、コピーせずに文字列にする
+	return *(*string)(unsafe.Pointer(&str))
+}
+
+// strict は正規形でない入力をエラーにするか
+func (d *decodeState) strict() bool {
+	return d != nil && d.opts.Strict
+}
+
+// checkTrailing は厳密モードで入力の後ろにバイト列が残っていないか確認する
+func (d *decodeState) checkTrailing(in []byte, n int) error {
+	if d.strict() && n != len(in) {
+		return fmt.Errorf("%w: %d bytes after offset %d", ErrTrailingBytes, len(in)-n, n)
+	}
+	return nil
+}
+
+// checkUvarint は厳密モードでnバイトのvarintのvが最短でmax以下か確認する
+func (d *decodeState) checkUvarint(v uint64, n int, max uint64) error {
+	if !d.strict() {
+		return nil
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if n != binary.PutUvarint(buf[:], v) {
+		return fmt.Errorf("%w: varint %d is not minimally encoded", ErrNonCanonical, v)
+	}
+	if v > max {
+		return fmt.Errorf("%w: %d overflows %d", ErrNonCanonical, v, max)
+	}
+	return nil
+}
+
+// checkVarint は厳密モードでnバイトのvarintのvが最短でminからmaxの範囲か確認する
+func (d *decodeState) checkVarint(v int64, n int, min, max int64) error {
+	if !d.strict() {
+		return nil
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if n != binary.PutVarint(buf[:], v) {
+		return fmt.Errorf("%w: varint %d is not minimally encoded", ErrNonCanonical, v)
+	}
+	if v < min || v > max {
+		return fmt.Errorf("%w: %d overflows [%d, %d]", ErrNonCanonical, v, min, max)
+	}
+	return nil
+}
+
+// checkSliceLen は厳密モードでsliceLenValueで読んだスライスの長さが最短のvarintか確認する
+func (d *decodeState) checkSliceLen(l int, n int, signed bool) error {
+	if signed {
+		return d.checkVarint(int64(l), n, math.MinInt64, math.MaxInt64)
+	}
+	return d.checkUvarint(uint64(l), n, math.MaxUint64)
+}
+
+// checkTime は厳密モードでデコードしたtを再エンコードすると入力inと同じになるか確認する
+func (d *decodeState) checkTime(t time.Time, in []byte) error {
+	if !d.strict() {
+		return nil
+	}
+	var buf [VarintLenTime]byte
+	n, err := TimeMarshalBinary(t, buf[:])
+	if err != nil || !bytes.Equal(buf[:n], in) {
+		return fmt.Errorf("%w: time %v", ErrNonCanonical, t)
+	}
+	return nil
+}
+
+// enter は1段深い値をデコードする前に呼び、戻るときにleaveを呼ぶ
+func (d *decodeState) enter() error {
+	if d == nil {
+		return nil
+	}
+	d.depth++
+	if d.opts.MaxDepth > 0 && d.depth > d.opts.MaxDepth {
+		return fmt.Errorf("%w: depth exceeds %d", ErrDecodeLimit, d.opts.MaxDepth)
+	}
+	return nil
+}
+
+func (d *decodeState) leave() {
+	if d != nil {
+		d.depth--
+	}
+}
+
+// sliceLen はelemSizeバイトの要素をl個確保する前に呼ぶ
+func (d *decodeState) sliceLen(l int, elemSize uintptr) error {
+	if d == nil {
+		return nil
+	}
+	if d.opts.MaxSliceLen > 0 && l > d.opts.MaxSliceLen {
+		return fmt.Errorf("%w: slice length %d exceeds %d", ErrDecodeLimit, l, d.opts.MaxSliceLen)
+	}
+	return d.alloc(l * int(elemSize))
+}
+
+// stringLen は長さlの文字列かバイト列を確保する前に呼ぶ
+func (d *decodeState) stringLen(l int) error {
+	if d == nil {
+		return nil
+	}
+	if d.opts.MaxStringLen > 0 && l > d.opts.MaxStringLen {
+		return fmt.Errorf("%w: string length %d exceeds %d", ErrDecodeLimit, l, d.opts.MaxStringLen)
+	}
+	return d.alloc(l)
+}
+
+// alloc はsizeバイトを確保する前に呼ぶ
+func (d *decodeState) alloc(size int) error {
+	if d == nil {
+		return nil
+	}
+	d.total += size
+	if d.opts.MaxTotalBytes > 0 && d.total > d.opts.MaxTotalBytes {
+		return fmt.Errorf("%w: total allocation exceeds %d bytes", ErrDecodeLimit, d.opts.MaxTotalBytes)
+	}
+	return nil
+}
+
+// decodeLenBytes は長さ + バイト列を読み取り、入力の一部をそのまま返す
+func decodeLenBytes(in []byte, d *decodeState) ([]byte, int, error) {
+	bLen, bLenLen := binary.Uvarint(in)
+	if bLenLen <= 0 {
+		return nil, 0, varintErr(bLenLen)
+	}
+	if err := d.checkUvarint(bLen, bLenLen, math.MaxUint64); err != nil {
+		return nil, 0, err
+	}
+	if err := checkLen(in, bLenLen, bLen); err != nil {
+		return nil, 0, err
+	}
+	if err := d.stringLen(int(bLen)); err != nil {
+		return nil, 0, err
+	}
+	n := bLenLen + int(bLen)
+	return in[bLenLen:n:n], n, nil
+}
+
+// decodeBytesWith はBytesDecodeAliasと同じくnil判定 + 長さ + バイト列を読み取る
+func decodeBytesWith(in []byte, d *decodeState) ([]byte, int, error) {
+	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return nil, 0, varintErr(isNotNilLen)
+	}
+	if err := d.checkUvarint(isNotNil, isNotNilLen, 1); err != nil {
+		return nil, 0, err
+	}
+	if isNotNil == 0 {
+		return nil, isNotNilLen, nil
+	}
+	b, bLen, err := decodeLenBytes(in[isNotNilLen:], d)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, isNotNilLen + bLen, nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecodeWithOptions(t *testing.T) {
+	data := createTestStructs(3)
+	bs, err := data.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    DecodeOptions
+		wantErr error
+	}{
+		{name: "no limits", opts: DecodeOptions{}},
+		{name: "within limits", opts: DecodeOptions{MaxSliceLen: 10, MaxStringLen: 10, MaxDepth: 4, MaxTotalBytes: 1 << 20}},
+		{name: "slice", opts: DecodeOptions{MaxSliceLen: 9}, wantErr: ErrDecodeLimit},
+		{name: "string", opts: DecodeOptions{MaxStringLen: 9}, wantErr: ErrDecodeLimit},
+		// TestStructs > TestStruct > Subs > TestSubStruct
+		{name: "depth", opts: DecodeOptions{MaxDepth: 3}, wantErr: ErrDecodeLimit},
+		{name: "total", opts: DecodeOptions{MaxTotalBytes: 1024}, wantErr: ErrDecodeLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded := TestStructs{}
+			n, err := DecodeWithOptions(bs, &decoded, tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DecodeWithOptions error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if n != len(bs) {
+				t.Errorf("decoded %d bytes, want %d", n, len(bs))
+			}
+			if diff := cmp.Diff(data, decoded); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDecodeWithOptionsReflect(t *testing.T) {
+	type record struct {
+		Name   string
+		Counts map[string]int
+		Ints   []int
+		Ss     TestStructs
+	}
+	data := record{
+		Name:   "test_string",
+		Counts: map[string]int{"a": 1, "b": 2},
+		Ints:   []int{1, 2, 3},
+		Ss:     createTestStructs(1),
+	}
+	bs, err := EncodeStruct(data, LayoutFlatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := record{}
+	if _, err := DecodeWithOptions(bs, &decoded, DecodeOptions{MaxSliceLen: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(data, decoded); diff != "" {
+		t.Error(diff)
+	}
+
+	// 生成された型のフィールドにも上限を引き継ぐ
+	for _, opts := range []DecodeOptions{{MaxSliceLen: 2}, {MaxStringLen: 9}, {MaxDepth: 2}} {
+		_, err := DecodeStructWithOptions(bs, &decoded, LayoutFlatten, opts)
+		if !errors.Is(err, ErrDecodeLimit) {
+			t.Errorf("DecodeStructWithOptions(%+v) error = %v, want %v", opts, err, ErrDecodeLimit)
+		}
+	}
+}
+
+func TestDecodeWithOptionsDepth(t *testing.T) {
+	// TestNodeのようにポインタで再帰する型は入れ子の深さで止める
+	root := &TestNode{Str: "0"}
+	node := root
+	for i := 0; i < 100; i++ {
+		node.Next = &TestNode{Int: i}
+		node = node.Next
+	}
+	bs, err := root.EncodeRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &TestNode{}
+	if _, err := DecodeWithOptions(bs, decoded, DecodeOptions{MaxDepth: 50}); !errors.Is(err, ErrDecodeLimit) {
+		t.Errorf("DecodeWithOptions error = %v, want %v", err, ErrDecodeLimit)
+	}
+	if _, err := DecodeWithOptions(bs, decoded, DecodeOptions{MaxDepth: 101}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeRefWithOptions(t *testing.T) {
+	data := createTestStructs(3)
+	data[2].SubPointer = data[0].SubPointer
+	bs, err := data.EncodeRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := TestStructs{}
+	if _, err := decoded.DecodeRefWithOptions(bs, DecodeOptions{MaxSliceLen: 10, MaxDepth: 4, Strict: true}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(data, decoded); diff != "" {
+		t.Error(diff)
+	}
+	for _, opts := range []DecodeOptions{{MaxSliceLen: 9}, {MaxStringLen: 9}, {MaxDepth: 3}, {MaxTotalBytes: 1024}} {
+		if _, err := decoded.DecodeRefWithOptions(bs, opts); !errors.Is(err, ErrDecodeLimit) {
+			t.Errorf("DecodeRefWithOptions(%+v) error = %v, want %v", opts, err, ErrDecodeLimit)
+		}
+	}
+}
+
+func TestDecodeZeroSizeElements(t *testing.T) {
+	// struct{}の要素は0バイトなので、要素数が残りのバイト数より多くても正しい入力
+	type record struct {
+		Empty []struct{}
+	}
+	data := record{Empty: make([]struct{}, 100)}
+	bs, err := EncodeStruct(data, LayoutFlatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := record{}
+	if _, err := DecodeWithOptions(bs, &decoded, DecodeOptions{Strict: true}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(data, decoded); diff != "" {
+		t.Error(diff)
+	}
+	if _, err := DecodeWithOptions(bs, &decoded, DecodeOptions{MaxSliceLen: 99}); !errors.Is(err, ErrDecodeLimit) {
+		t.Errorf("DecodeWithOptions error = %v, want %v", err, ErrDecodeLimit)
+	}
+
+	gs, err := EncodeSlice(data.Empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, n, err := DecodeSlice[struct{}](gs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != len(data.Empty) || n != len(gs) {
+		t.Errorf("DecodeSlice = %d elements, %d bytes, want %d elements, %d bytes", len(s), n, len(data.Empty), len(gs))
+	}
+}
+
+func TestDecodeHugeLength(t *testing.T) {
+	// 10バイトの入力で2^60個の要素があると主張する
+	huge := appendUvarint([]byte{1}, 1<<60)
+	signed := appendVarint([]byte{1}, 1<<60)
+
+	if _, n := SliceDecode(huge); n > 0 {
+		t.Errorf("SliceDecode accepted %d bytes", n)
+	}
+	if _, _, err := DecodeSlice[int](huge); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DecodeSlice error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, _, err := DecodeMap[int, int](huge); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DecodeMap error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	ss := TestStructs{}
+	if _, err := ss.Decode(signed); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("TestStructs.Decode error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	type record struct {
+		Ints []int
+		Strs map[string]string
+	}
+	if _, err := DecodeStruct(huge, &record{}, LayoutFlatten); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DecodeStruct error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := DecodeStruct(append([]byte{0}, huge...), &record{}, LayoutFlatten); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DecodeStruct error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	sub := TestSubStruct{Time: time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)}
+	bs, err := sub.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCanonical(bs, &TestSubStruct{}); err != nil {
+		t.Fatalf("CheckCanonical(Encode()) = %v", err)
+	}
+
+	// Str, Bool, Int, Int16, Int64, Uint がそれぞれ1バイトなのでUint8は6バイト目
+	splice := func(at int, b ...byte) []byte {
+		out := append([]byte{}, bs[:at]...)
+		out = append(out, b...)
+		return append(out, bs[at+1:]...)
+	}
+	tests := []struct {
+		name    string
+		in      []byte
+		wantErr error
+	}{
+		{name: "trailing bytes", in: append(append([]byte{}, bs...), 0), wantErr: ErrTrailingBytes},
+		{name: "bool 2", in: splice(1, 2), wantErr: ErrNonCanonical},
+		{name: "uint8 above 255", in: splice(6, appendUvarint(nil, 300)...), wantErr: ErrNonCanonical},
+		{name: "non-minimal varint", in: splice(2, 0x80, 0x00), wantErr: ErrNonCanonical},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 通常のデコードは受け付ける
+			if _, err := (&TestSubStruct{}).Decode(tt.in); err != nil {
+				t.Fatal(err)
+			}
+			_, err := DecodeWithOptions(tt.in, &TestSubStruct{}, DecodeOptions{Strict: true})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("strict decode error = %v, want %v", err, tt.wantErr)
+			}
+			if err := CheckCanonical(tt.in, &TestSubStruct{}); err == nil {
+				t.Error("CheckCanonical accepted a non-canonical encoding")
+			}
+		})
+	}
+
+	// nil判定が5の場合
+	bs, err = createTestStructs(1).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs[0] = 5
+	if _, err := (&TestStructs{}).Decode(bs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeWithOptions(bs, &TestStructs{}, DecodeOptions{Strict: true}); !errors.Is(err, ErrNonCanonical) {
+		t.Errorf("strict decode error = %v, want %v", err, ErrNonCanonical)
+	}
+}
+
+func TestDecodeStrictReflect(t *testing.T) {
+	type record struct {
+		Flag  bool
+		Small uint8
+		Ptr   *int
+		Ints  []int
+	}
+	valid, err := EncodeStruct(record{Flag: true, Small: 255, Ints: []int{1}}, LayoutFlatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCanonical(valid, &record{}); err != nil {
+		t.Fatalf("CheckCanonical(EncodeStruct()) = %v", err)
+	}
+
+	for _, in := range [][]byte{
+		{2, 0, 0, 0},
+		append(append([]byte{1}, appendUvarint(nil, 256)...), 0, 0),
+		{1, 0, 5, 0, 0},
+		{1, 0, 0, 1, 0x81, 0x00, 2},
+	} {
+		if _, err := DecodeStruct(in, &record{}, LayoutFlatten); err != nil {
+			t.Fatalf("DecodeStruct(%v) = %v", in, err)
+		}
+		_, err := DecodeStructWithOptions(in, &record{}, LayoutFlatten, DecodeOptions{Strict: true})
+		if !errors.Is(err, ErrNonCanonical) {
+			t.Errorf("DecodeStructWithOptions(%v) error = %v, want %v", in, err, ErrNonCanonical)
+		}
+	}
+}
+
+func TestCheckCanonicalMap(t *testing.T) {
+	type withMap struct {
+		M map[string]int
+	}
+	v := withMap{M: map[string]int{"a": 1, "b": 2, "c": 3, "d": 4}}
+	bs, err := EncodeStruct(v, LayoutFlatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 走査順によらず同じバイト列になり、正規形と判定される
+	for i := 0; i < 50; i++ {
+		again, err := EncodeStruct(v, LayoutFlatten)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(bs, again) {
+			t.Fatalf("EncodeStruct is not deterministic:\n%x\n%x", bs, again)
+		}
+		if err := CheckCanonical(bs, &withMap{}); err != nil {
+			t.Fatalf("CheckCanonical = %v", err)
+		}
+	}
+	genericBs, err := EncodeMap(v.M)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(bs, genericBs) {
+		t.Errorf("EncodeMap = %x, want %x", genericBs, bs)
+	}
+
+	// キーの順序が逆のものと重複したものは厳密モードでだけエラーになる
+	for name, in := range map[string][]byte{
+		"unordered": {1, 2, 1, 'b', 4, 1, 'a', 2},
+		"duplicate": {1, 2, 1, 'a', 2, 1, 'a', 4},
+	} {
+		if _, err := DecodeWithOptions(in, &withMap{}, DecodeOptions{}); err != nil {
+			t.Errorf("%s: DecodeWithOptions = %v", name, err)
+		}
+		if _, err := DecodeWithOptions(in, &withMap{}, DecodeOptions{Strict: true}); !errors.Is(err, ErrNonCanonical) {
+			t.Errorf("%s: strict error = %v, want %v", name, err, ErrNonCanonical)
+		}
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	first := createTestStructs(3)
+	bs, err := first.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := createTestStructs(2)
+	second[1].SubPointer = nil
+	second[0].Subs = second[0].Subs[:5]
+	smaller, err := second.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := TestStructs{}
+	if _, err := decoded.DecodeInto(bs); err != nil {
+		t.Fatal(err)
+	}
+	elems, subs, sub := &decoded[0], &decoded[0].Subs[0], decoded[0].SubPointer
+
+	// 要素が減ってもスライスとポインタの先を使い回す
+	n, err := decoded.DecodeInto(smaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(smaller) {
+		t.Errorf("decoded %d bytes, want %d", n, len(smaller))
+	}
+	if diff := cmp.Diff(second, decoded); diff != "" {
+		t.Error(diff)
+	}
+	if &decoded[0] != elems || &decoded[0].Subs[0] != subs || decoded[0].SubPointer != sub {
+		t.Error("DecodeInto reallocated the slices or SubPointer")
+	}
+
+	// Resetしても容量の範囲にある要素の領域は残る
+	decoded.Reset()
+	if _, err := decoded.DecodeInto(bs); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(first, decoded); diff != "" {
+		t.Error(diff)
+	}
+	if &decoded[0] != elems || decoded[0].SubPointer != sub {
+		t.Error("DecodeInto after Reset reallocated the slice or SubPointer")
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		decoded.Reset()
+		if _, err := decoded.DecodeInto(bs); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("DecodeInto allocated %v times per run, want 0", allocs)
+	}
+
+	// 入力が毎回変わっても、変わった文字列はアリーナにまとめて確保する
+	inputs := make([][]byte, 2)
+	for i := range inputs {
+		if inputs[i], err = createTestStructs(100).Encode(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	i := 0
+	allocs = testing.AllocsPerRun(10, func() {
+		decoded.Reset()
+		if _, err := decoded.DecodeInto(inputs[i%len(inputs)]); err != nil {
+			t.Fatal(err)
+		}
+		i++
+	})
+	if allocs > 1 {
+		t.Errorf("DecodeInto with alternating inputs allocated %v times per run, want at most 1", allocs)
+	}
+}
+
+func TestDecodeStringArena(t *testing.T) {
+	data := createTestStructs(100)
+	bs, err := data.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := append([]byte{}, bs...)
+	decoded := TestStructs{}
+	if _, err := DecodeWithOptions(in, &decoded, DecodeOptions{StringArena: true}); err != nil {
+		t.Fatal(err)
+	}
+	// アリーナは入力とは別の領域なので入力を書き換えても変わらない
+	for i := range in {
+		in[i] = 0
+	}
+	if diff := cmp.Diff(data, decoded); diff != "" {
+		t.Error(diff)
+	}
+
+	decode := func(opts DecodeOptions) func() {
+		return func() {
+			decoded := TestStructs{}
+			if _, err := DecodeWithOptions(bs, &decoded, opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	plain := testing.AllocsPerRun(10, decode(DecodeOptions{}))
+	arena := testing.AllocsPerRun(10, decode(DecodeOptions{StringArena: true}))
+	// TestStructごとにStrとSubPointerとSubsで11個の文字列がある
+	if strs := float64(11 * len(data)); arena > plain-strs+1 {
+		t.Errorf("StringArena allocated %v times, want at most %v", arena, plain-strs+1)
+	}
+
+	type record struct {
+		Name  string
+		Names []string
+		Empty string
+	}
+	r := record{Name: "test_string", Names: []string{"a", "", "b"}}
+	bs, err = EncodeStruct(r, LayoutFlatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedRecord := record{}
+	if _, err := DecodeWithOptions(bs, &decodedRecord, DecodeOptions{StringArena: true}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(r, decodedRecord); diff != "" {
+		t.Error(diff)
+	}
+}
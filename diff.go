@@ -0,0 +1,56 @@
+package main
+
+import "errors"
+
+// 差分モードでは、構造体ごとに変わったフィールドのビットを立てたマスクを先頭に置き、
+// 変わったフィールドだけを更新後の値でエンコードする
+// マスクのビットはOmitZeroモードと同じ
+
+// ErrInvalidDiff は差分が更新前の値に当てはまらない場合のエラー
+var ErrInvalidDiff = errors.New("decode: diff does not apply to base")
+
+// 差分モードのポインタのフィールドの種類
+const (
+	// diffNil は更新後がnil
+	diffNil = iota
+	// diffFull は更新前がnilなので更新後の値を全てエンコードする
+	diffFull
+	// diffPatch は更新前の値からの差分
+	diffPatch
+)
+
+// Differ は差分をエンコードできる生成された型へのポインタ
+type Differ[T any] interface {
+	*T
+	// SizeDiff は更新前の値からupdatedへの差分の最大サイズを返す
+	SizeDiff(updated *T) int
+	EncodeWithBytesDiff(out []byte, updated *T) (int, error)
+	// ApplyDiff は差分を読み取り、更新前の値を書き換える
+	// ポインタの先とスライスはコピーしてから書き換えるので、更新前の値と共有していても変わらない
+	ApplyDiff(in []byte) (int, error)
+}
+
+// EncodeDiff はbaseからupdatedで変わったフィールドだけをエンコードする
+func EncodeDiff[T any, P Differ[T]](base, updated T) ([]byte, error) {
+	out := make([]byte, P(&base).SizeDiff(&updated))
+	n, err := P(&base).EncodeWithBytesDiff(out, &updated)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// ApplyDiff はEncodeDiffの出力patchをbaseに適用した値を返す
+// baseはEncodeDiffに渡したものと同じ値でなければならない
+func ApplyDiff[T any, P Differ[T]](base T, patch []byte) (T, error) {
+	n, err := P(&base).ApplyDiff(patch)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	if n != len(patch) {
+		var zero T
+		return zero, ErrTrailingBytes
+	}
+	return base, nil
+}
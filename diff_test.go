@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// mutateTestSubStruct はsのフィールドをそれぞれ確率1/3で変える
+func mutateTestSubStruct(r *rand.Rand, s TestSubStruct) TestSubStruct {
+	if r.Intn(3) == 0 {
+		s.Str = randString(r.Intn(5))
+	}
+	if r.Intn(3) == 0 {
+		s.Bool = !s.Bool
+	}
+	if r.Intn(3) == 0 {
+		s.Int = r.Int() - r.Int()
+	}
+	if r.Intn(3) == 0 {
+		s.Int16 = int16(r.Int())
+	}
+	if r.Intn(3) == 0 {
+		s.Int64 = r.Int63()
+	}
+	if r.Intn(3) == 0 {
+		s.Uint = uint(r.Uint64())
+	}
+	if r.Intn(3) == 0 {
+		s.Uint8 = uint8(r.Int())
+	}
+	if r.Intn(3) == 0 {
+		s.Uint32 = r.Uint32()
+	}
+	if r.Intn(3) == 0 {
+		s.Time = time.Unix(r.Int63n(1<<32), r.Int63n(1e9)).In(time.FixedZone("", 3600*(r.Intn(24)-12)))
+	}
+	return s
+}
+
+// mutateTestStruct はSubPointerとSubsのnilへの変更や要素数の増減も含めてsを変える
+// sのポインタの先とスライスは書き換えない
+func mutateTestStruct(r *rand.Rand, s TestStruct) TestStruct {
+	sub := mutateTestSubStruct(r, TestSubStruct{})
+	// TestSubStructと同じフィールドはmutateTestSubStructで変える
+	m := mutateTestSubStruct(r, TestSubStruct{Str: s.Str, Bool: s.Bool, Int: s.Int, Int16: s.Int16, Int64: s.Int64, Uint: s.Uint, Uint8: s.Uint8, Uint32: s.Uint32, Time: s.Time})
+	s.Str, s.Bool, s.Int, s.Int16, s.Int64, s.Uint, s.Uint8, s.Uint32, s.Time = m.Str, m.Bool, m.Int, m.Int16, m.Int64, m.Uint, m.Uint8, m.Uint32, m.Time
+	switch r.Intn(4) {
+	case 0:
+		s.SubPointer = nil
+	case 1:
+		if s.SubPointer != nil {
+			sub = mutateTestSubStruct(r, *s.SubPointer)
+		}
+		s.SubPointer = &sub
+	}
+	switch r.Intn(4) {
+	case 0:
+		s.Subs = nil
+	case 1:
+		subs := make(TestSubStructs, r.Intn(len(s.Subs)+3))
+		for i := range subs {
+			if i < len(s.Subs) {
+				subs[i] = mutateTestSubStruct(r, s.Subs[i])
+			} else {
+				subs[i] = mutateTestSubStruct(r, createTestSubStruct())
+			}
+		}
+		s.Subs = subs
+	}
+	return s
+}
+
+func TestApplyDiffReproducesUpdated(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		base := createTestStructs(1)[0]
+		if i%5 == 0 {
+			base.SubPointer = nil
+		}
+		if i%7 == 0 {
+			base.Subs = nil
+		}
+		updated := mutateTestStruct(r, base)
+		before, err := base.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		patch, err := EncodeDiff(base, updated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied, err := ApplyDiff(base, patch)
+		if err != nil {
+			t.Fatalf("ApplyDiff: %v\npatch: %x", err, patch)
+		}
+		if diff := cmp.Diff(updated, applied); diff != "" {
+			t.Fatal(diff)
+		}
+		want, err := updated.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := applied.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("applied encodes to\n%x\nwant\n%x", got, want)
+		}
+
+		// 適用しても更新前の値は変わらない
+		after, err := base.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before, after) {
+			t.Fatal("ApplyDiff modified base")
+		}
+	}
+}
+
+func TestEncodeDiffOnlyChangedFields(t *testing.T) {
+	base := createTestStructs(1)[0]
+	patch, err := EncodeDiff(base, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patch, []byte{0}) {
+		t.Errorf("EncodeDiff(base, base) = %x, want 00", patch)
+	}
+
+	updated := base
+	updated.Uint8 = base.Uint8 + 1
+	patch, err = EncodeDiff(base, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := appendUvarint(nil, testStructMaskUint8)
+	want = appendUvarint(want, uint64(updated.Uint8))
+	if !bytes.Equal(patch, want) {
+		t.Errorf("EncodeDiff(Uint8 changed) = %x, want %x", patch, want)
+	}
+
+	// Subsは変わった要素だけ差分になる
+	updated = base
+	updated.Subs = append(TestSubStructs{}, base.Subs...)
+	updated.Subs[3].Bool = !updated.Subs[3].Bool
+	patch, err = EncodeDiff(base, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// マスク2バイト、nil判定、長さ、変わらない要素のマスク1バイトずつ、変わった要素のマスクと値
+	if want := 2 + 1 + 1 + (len(base.Subs) - 1) + 2; len(patch) != want {
+		t.Errorf("len(EncodeDiff(one Sub changed)) = %d, want %d", len(patch), want)
+	}
+}
+
+func TestApplyDiffInvalid(t *testing.T) {
+	base := createTestStructs(1)[0]
+	updated := base
+	sub := *base.SubPointer
+	sub.Int++
+	updated.SubPointer = &sub
+	patch, err := EncodeDiff(base, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 更新前のSubPointerがnilの値には差分を適用できない
+	other := base
+	other.SubPointer = nil
+	if _, err := ApplyDiff(other, patch); !errors.Is(err, ErrInvalidDiff) {
+		t.Errorf("ApplyDiff(nil SubPointer) error = %v, want %v", err, ErrInvalidDiff)
+	}
+	if _, err := ApplyDiff(base, append(patch, 0)); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("ApplyDiff(trailing) error = %v, want %v", err, ErrTrailingBytes)
+	}
+}
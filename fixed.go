@@ -0,0 +1,30 @@
+package main
+
+// 固定長モードで整数をリトルエンディアンでエンコードしたときのバイト数
+// intとuintは環境によらず8バイトにする
+const (
+	FixedLen8  = 1
+	FixedLen16 = 2
+	FixedLen32 = 4
+	FixedLen64 = 8
+)
+
+// uvarintLen はvをbinary.PutUvarintでエンコードしたバイト数を返す
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// varintLen はvをbinary.PutVarintでエンコードしたバイト数を返す
+func varintLen(v int64) int {
+	// PutVarintと同じくジグザグ符号化する
+	uv := uint64(v) << 1
+	if v < 0 {
+		uv = ^uv
+	}
+	return uvarintLen(uv)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestFixedRoundTrip(t *testing.T) {
+	withNil := createTestStructs(2)
+	withNil[1].SubPointer = nil
+	withNil[1].Subs = nil
+	cases := map[string]TestStructs{
+		"random":  createTestStructs(3),
+		"small":   smallTestStructs(3),
+		"withNil": withNil,
+	}
+	checkTestStructsMode(t, cases, TestStructs.EncodeFixed, (*TestStructs).DecodeFixed)
+
+	// 整数が固定長なので、SizeFixedは最大ではなく正確なサイズになる
+	for name, ss := range cases {
+		bs, err := ss.EncodeFixed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bs) != ss.SizeFixed() {
+			t.Errorf("%s: len(EncodeFixed()) = %d, SizeFixed() = %d", name, len(bs), ss.SizeFixed())
+		}
+	}
+}
+
+func TestFixedLittleEndian(t *testing.T) {
+	s := TestSubStruct{Int: -2, Int16: 0x0102, Int64: math.MinInt64, Uint: math.MaxUint64, Uint8: 0xff, Uint32: 0x01020304}
+	bs, err := s.EncodeFixed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0,                                              // Str
+		0,                                              // Bool
+		0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Int
+		0x02, 0x01, // Int16
+		0, 0, 0, 0, 0, 0, 0, 0x80, // Int64
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Uint
+		0xff,                   // Uint8
+		0x04, 0x03, 0x02, 0x01, // Uint32
+	}
+	if !bytes.Equal(bs[:len(want)], want) {
+		t.Errorf("EncodeFixed() = %x, want prefix %x", bs, want)
+	}
+	if len(bs) != len(want)+VarintLenTime {
+		t.Errorf("len(EncodeFixed()) = %d, want %d", len(bs), len(want)+VarintLenTime)
+	}
+}
+
+func TestFixedSmallerForRandomInts(t *testing.T) {
+	// 一様乱数の整数は固定長の方が小さく、小さい値はvarintの方が小さい
+	for _, c := range []struct {
+		name       string
+		ss         TestStructs
+		fixedSmall bool
+	}{
+		{name: "random", ss: createTestStructs(10), fixedSmall: true},
+		{name: "small", ss: smallTestStructs(10), fixedSmall: false},
+	} {
+		fixed, err := c.ss.EncodeFixed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		varint, err := c.ss.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(fixed) < len(varint)) != c.fixedSmall {
+			t.Errorf("%s: fixed %d bytes, varint %d bytes", c.name, len(fixed), len(varint))
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+// checkCanonical は不正な入力でもデコードがpanicせず、読んだバイト数が入力に収まることを確認する
+// デコードできた場合は再エンコードしたバイト列が正規形で、
+// もう一度デコードとエンコードをしても同じバイト列になることを確認する
+func checkCanonical[T any](t *testing.T, in []byte, decode func([]byte) (T, int, error), encode func(T) ([]byte, error)) {
+	t.Helper()
+	v, n, err := decode(in)
+	if err != nil {
+		return
+	}
+	if n <= 0 || n > len(in) {
+		t.Fatalf("decoded %d bytes from %d byte input", n, len(in))
+	}
+	first, err := encode(v)
+	if err != nil {
+		// Timeのゾーンなどエンコードできない値はデコードできても対象外
+		return
+	}
+	v, n, err = decode(first)
+	if err != nil {
+		t.Fatalf("decode re-encoded %x: %v", first, err)
+	}
+	if n != len(first) {
+		t.Fatalf("decoded %d bytes from re-encoded %d bytes", n, len(first))
+	}
+	second, err := encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("re-encode is not canonical:\n%x\n%x", first, second)
+	}
+}
+
+// checkStrict は厳密モードでデコードできた入力が再エンコードと同じバイト列になることを確認する
+func checkStrict[T any, P interface {
+	*T
+	stateDecoder
+}](t *testing.T, in []byte, encode func(P) ([]byte, error)) {
+	t.Helper()
+	p := P(new(T))
+	if _, err := DecodeWithOptions(in, p, DecodeOptions{Strict: true}); err != nil {
+		return
+	}
+	out, err := encode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(in, out) {
+		t.Fatalf("strict decode accepted a non-canonical encoding:\n%x\n%x", in, out)
+	}
+}
+
+// primitiveDecode はnに0以下を返すデコード関数をエラーを返す形にする
+func primitiveDecode[T any](decode func([]byte) (T, int)) func([]byte) (T, int, error) {
+	return func(in []byte) (T, int, error) {
+		v, n := decode(in)
+		if n <= 0 {
+			return v, n, varintErr(n)
+		}
+		return v, n, nil
+	}
+}
+
+func primitiveEncode[T any](encode func(T) ([]byte, int)) func(T) ([]byte, error) {
+	return func(v T) ([]byte, error) {
+		b, _ := encode(v)
+		return b, nil
+	}
+}
+
+// codecDecode はDecodeメソッドを持つ型のデコード関数を返す
+// 長さは入力のバイト数を超えない分しか確保しないことも確認する
+func codecDecode[T any, P interface {
+	*T
+	Decoder
+}](t *testing.T, elems func(P) int) func([]byte) (P, int, error) {
+	return func(in []byte) (P, int, error) {
+		p := P(new(T))
+		n, err := p.Decode(in)
+		if err == nil && elems(p) > len(in) {
+			t.Fatalf("decoded %d elements from %d bytes", elems(p), len(in))
+		}
+		return p, n, err
+	}
+}
+
+func noElems[P any](P) int { return 0 }
+
+func FuzzIntDecode(f *testing.F) {
+	for _, i := range []int{0, 1, -1, math.MaxInt64, math.MinInt64} {
+		b, _ := IntEncode(i)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, primitiveDecode(IntDecode), primitiveEncode(IntEncode))
+	})
+}
+
+func FuzzUintDecode(f *testing.F) {
+	for _, u := range []uint{0, 1, math.MaxUint64} {
+		b, _ := UintEncode(u)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, primitiveDecode(UintDecode), primitiveEncode(UintEncode))
+	})
+}
+
+func FuzzFloatDecode(f *testing.F) {
+	for _, v := range []float64{0, -1.5, math.Inf(1), math.NaN()} {
+		b, _ := FloatEncode(v)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, primitiveDecode(FloatDecode), primitiveEncode(FloatEncode))
+	})
+}
+
+func FuzzBoolDecode(f *testing.F) {
+	f.Add([]byte{0})
+	f.Add([]byte{1})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, primitiveDecode(BoolDecode), primitiveEncode(BoolEncode))
+	})
+}
+
+func FuzzStringDecode(f *testing.F) {
+	for _, str := range []string{"", "test_string", randString(300)} {
+		b, _ := StringEncode(str)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, primitiveDecode(StringDecode), primitiveEncode(StringEncode))
+	})
+}
+
+func FuzzBytesDecode(f *testing.F) {
+	for _, b := range [][]byte{nil, {}, []byte("test_string")} {
+		bs, _ := BytesEncode(b)
+		f.Add(bs)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, primitiveDecode(BytesDecode), primitiveEncode(BytesEncode))
+		checkCanonical(t, in, primitiveDecode(BytesDecodeAlias), primitiveEncode(BytesEncode))
+	})
+}
+
+func FuzzPointerDecode(f *testing.F) {
+	i := -1
+	for _, p := range []*int{nil, &i} {
+		b, _ := PointerEncode(p)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, primitiveDecode(PointerDecode), primitiveEncode(PointerEncode))
+	})
+}
+
+func FuzzSliceDecode(f *testing.F) {
+	for _, ints := range [][]int{nil, {}, {1, -1, math.MaxInt64}} {
+		b, _ := SliceEncode(ints)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		decode := func(in []byte) ([]int, int, error) {
+			slice, n, err := primitiveDecode(SliceDecode)(in)
+			if err == nil && len(slice) > len(in) {
+				t.Fatalf("decoded %d elements from %d bytes", len(slice), len(in))
+			}
+			return slice, n, err
+		}
+		checkCanonical(t, in, decode, primitiveEncode(SliceEncode))
+	})
+}
+
+func FuzzTestSubStructDecode(f *testing.F) {
+	for i := 0; i < 3; i++ {
+		b, err := createTestSubStruct().Encode()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, codecDecode[TestSubStruct](t, noElems[*TestSubStruct]), (*TestSubStruct).Encode)
+		checkStrict[TestSubStruct](t, in, (*TestSubStruct).Encode)
+	})
+}
+
+func FuzzTestStructsDecode(f *testing.F) {
+	for _, ss := range []TestStructs{nil, {}, createTestStructs(1), createTestStructs(3)} {
+		if len(ss) > 1 {
+			ss[1].SubPointer = nil
+			ss[1].Subs = nil
+		}
+		b, err := ss.Encode()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	elems := func(ss *TestStructs) int {
+		n := len(*ss)
+		for _, s := range *ss {
+			n += len(s.Subs)
+		}
+		return n
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, codecDecode[TestStructs](t, elems), (*TestStructs).Encode)
+		checkStrict[TestStructs](t, in, (*TestStructs).Encode)
+	})
+}
+
+func FuzzTestStructsDecodeRef(f *testing.F) {
+	ss := createTestStructs(3)
+	ss[2].SubPointer = ss[0].SubPointer
+	ss[1].SubPointer = nil
+	b, err := ss.EncodeRef()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(b)
+	f.Fuzz(func(t *testing.T, in []byte) {
+		decode := func(in []byte) (*TestStructs, int, error) {
+			ss := &TestStructs{}
+			n, err := ss.DecodeRef(in)
+			if err == nil && len(*ss) > len(in) {
+				t.Fatalf("decoded %d elements from %d bytes", len(*ss), len(in))
+			}
+			return ss, n, err
+		}
+		checkCanonical(t, in, decode, (*TestStructs).EncodeRef)
+	})
+}
+
+func FuzzTestEnvelopeDecode(f *testing.F) {
+	for _, s := range []TestEnvelope{{}, {Kind: "test", Payload: []byte("payload"), Raw: []byte{}}} {
+		b, err := s.Encode()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, codecDecode[TestEnvelope](t, noElems[*TestEnvelope]), (*TestEnvelope).Encode)
+		checkStrict[TestEnvelope](t, in, (*TestEnvelope).Encode)
+	})
+}
+
+func FuzzTestOrderDecode(f *testing.F) {
+	for _, withOwner := range []bool{false, true} {
+		b, err := createTestOrder(withOwner).Encode()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkCanonical(t, in, codecDecode[TestOrder](t, noElems[*TestOrder]), (*TestOrder).Encode)
+		checkStrict[TestOrder](t, in, (*TestOrder).Encode)
+	})
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	bs, err := createTestStructs(2).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(bs); i++ {
+		decoded := TestStructs{}
+		if _, err := decoded.Decode(bs[:i]); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("Decode(bs[:%d]) error = %v, want %v", i, err, io.ErrUnexpectedEOF)
+		}
+	}
+
+	// 入力より長いスライスは確保せずにエラーにする
+	huge := []byte{1}
+	huge = appendVarint(huge, math.MaxInt64)
+	decoded := TestStructs{}
+	if _, err := decoded.Decode(huge); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Decode(huge) error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	huge = appendVarint([]byte{1}, -1)
+	if _, err := decoded.Decode(huge); !errors.Is(err, ErrInvalidLength) {
+		t.Errorf("Decode(negative) error = %v, want %v", err, ErrInvalidLength)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+type Signed interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64
+}
+
+type Unsigned interface {
+	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+type Float interface {
+	~float32 | ~float64
+}
+
+// Encoder は生成されたエンコードメソッドを持つ型
+type Encoder interface {
+	Size() int
+	EncodeWithBytes(out []byte) (int, error)
+}
+
+// Decoder は生成されたデコードメソッドを持つ型
+type Decoder interface {
+	Decode(in []byte) (int, error)
+}
+
+// Codec は生成されたエンコードとデコードのメソッドを両方持つ型
+type Codec interface {
+	Encoder
+	Decoder
+}
+
+var ErrUnsupportedType = errors.New("encode: unsupported type")
+
+func EncodeInt[T Signed](v T, out []byte) int {
+	return binary.PutVarint(out, int64(v))
+}
+
+func DecodeInt[T Signed](in []byte) (T, int) {
+	intRaw, intLen := binary.Varint(in)
+	return T(intRaw), intLen
+}
+
+func EncodeUint[T Unsigned](v T, out []byte) int {
+	return binary.PutUvarint(out, uint64(v))
+}
+
+func DecodeUint[T Unsigned](in []byte) (T, int) {
+	uintRaw, uintLen := binary.Uvarint(in)
+	return T(uintRaw), uintLen
+}
+
+func EncodeFloat[T Float](v T, out []byte) int {
+	return binary.PutUvarint(out, math.Float64bits(float64(v)))
+}
+
+func DecodeFloat[T Float](in []byte) (T, int) {
+	floatRaw, floatLen := binary.Uvarint(in)
+	return T(math.Float64frombits(floatRaw)), floatLen
+}
+
+// EncodePointer はPointerEncodeと同じく、nil判定の1バイト + 値でエンコードする
+// Tは型制約で絞らず、実行時に型で分岐する。整数、浮動小数点数、文字列、time.TimeとCodecはそのまま、
+// それ以外はEncodeStructと同じくリフレクションでエンコードし、chanやfuncなどはErrUnsupportedTypeを返す
+func EncodePointer[T any](p *T) ([]byte, error) {
+	if p == nil {
+		// nilの場合は1バイト目に0をセット
+		return []byte{0}, nil
+	}
+	// nil判定 + 値の最大
+	out := make([]byte, VarintLenPointer+sizeValue(p))
+	// nilでない場合は1バイト目に1をセット
+	out[0] = 1
+	n, err := encodeValue(out[VarintLenPointer:], p)
+	if err != nil {
+		return nil, err
+	}
+	return out[:VarintLenPointer+n], nil
+}
+
+// DecodePointer はEncodePointerの出力をデコードする
+// EncodePointerと同じく実行時に型で分岐するので、デコードできない型はErrUnsupportedTypeを返す
+func DecodePointer[T any](in []byte) (*T, int, error) {
+	n := 0
+	// 1バイト目が0ならnilを返す
+	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return nil, 0, varintErr(isNotNilLen)
+	}
+	n += isNotNilLen
+	if isNotNil == 0 {
+		return nil, n, nil
+	}
+	p := new(T)
+	vLen, err := decodeValue(in[n:], p)
+	if err != nil {
+		return nil, 0, err
+	}
+	n += vLen
+	return p, n, nil
+}
+
+// EncodeSlice はSliceEncodeと同じく、nil判定 + 長さ + 要素でエンコードする
+// 構造体の要素は、TestSubStructsなど生成されたスライスと同じく長さを符号付きでエンコードする
+// []byteは要素ごとではなくBytesEncodeでまとめてコピーする
+// 要素はEncodePointerと同じく実行時に型で分岐するので、エンコードできない型の要素があればErrUnsupportedTypeを返す
+func EncodeSlice[T any](s []T) ([]byte, error) {
+	if b, ok := interface{}(s).([]byte); ok {
+		out, _ := BytesEncode(b)
+		return out, nil
+	}
+	n := VarintLenPointer
+	if s == nil {
+		// nilの場合は1バイト目に0をセット
+		return []byte{0}, nil
+	}
+	// nil判定 + スライスの長さの最大 + 要素の最大
+	size := n + binary.MaxVarintLen64
+	for i := range s {
+		size += sizeValue(&s[i])
+	}
+	out := make([]byte, size)
+	// nilでない場合は1バイト目に1をセット
+	out[0] = 1
+	// スライスの長さをセット
+	n += putSliceLen(out[n:], len(s), isStructElem[T]())
+	// スライスを1要素ずつセット
+	for i := range s {
+		vLen, err := encodeValue(out[n:], &s[i])
+		if err != nil {
+			return nil, err
+		}
+		n += vLen
+	}
+	return out[:n], nil
+}
+
+// DecodeSlice はEncodeSliceの出力をデコードする
+// 要素はDecodePointerと同じく実行時に型で分岐するので、デコードできない型の要素があればErrUnsupportedTypeを返す
+func DecodeSlice[T any](in []byte) ([]T, int, error) {
+	if _, ok := interface{}([]T(nil)).([]byte); ok {
+		b, n := BytesDecode(in)
+		return interface{}(b).([]T), n, nil
+	}
+	n := 0
+	// 1バイト目が0ならnilを返す
+	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return nil, 0, varintErr(isNotNilLen)
+	}
+	n += isNotNilLen
+	if isNotNil == 0 {
+		return nil, n, nil
+	}
+	// スライスの長さを読み取る
+	sliceLen, sliceLenLen := sliceLenValue(in[n:], isStructElem[T]())
+	if sliceLenLen <= 0 {
+		return nil, 0, varintErr(sliceLenLen)
+	}
+	n += sliceLenLen
+	// 1要素は少なくとも1バイトなので残りより長いスライスは確保しない
+	// struct{}のように0バイトの要素は確保しても領域を使わない
+	zeroSize := zeroSizeEncoding(reflect.TypeOf((*T)(nil)).Elem(), LayoutFlatten)
+	if err := checkElemSliceLen(in, n, int64(sliceLen), zeroSize); err != nil {
+		return nil, 0, err
+	}
+	s := make([]T, sliceLen)
+	if zeroSize {
+		return s, n, nil
+	}
+	// 長さの回数だけ読み取る
+	for i := range s {
+		vLen, err := decodeValue(in[n:], &s[i])
+		if err != nil {
+			return nil, 0, err
+		}
+		n += vLen
+	}
+	return s, n, nil
+}
+
+// EncodeMap はnil判定 + 要素数 + キーと値の組でエンコードする
+// 組はキーのエンコード結果のバイト列の昇順に並べるので、同じmapは常に同じバイト列になる
+// キーと値はEncodePointerと同じく実行時に型で分岐するので、エンコードできない型はErrUnsupportedTypeを返す
+func EncodeMap[K comparable, V any](m map[K]V) ([]byte, error) {
+	n := VarintLenPointer
+	if m == nil {
+		// nilの場合は1バイト目に0をセット
+		return []byte{0}, nil
+	}
+	// nil判定 + 要素数の最大 + キーと値の最大
+	size := n + binary.MaxVarintLen64
+	for k, v := range m {
+		size += sizeValue(&k) + sizeValue(&v)
+	}
+	out := make([]byte, size)
+	// nilでない場合は1バイト目に1をセット
+	out[0] = 1
+	// 要素数をセット
+	n += binary.PutUvarint(out[n:], uint64(len(m)))
+	keys := make([][]byte, 0, len(m))
+	values := make([]V, 0, len(m))
+	for k, v := range m {
+		key := make([]byte, sizeValue(&k))
+		kLen, err := encodeValue(key, &k)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key[:kLen])
+		values = append(values, v)
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+	for _, i := range order {
+		n += copy(out[n:], keys[i])
+		vLen, err := encodeValue(out[n:], &values[i])
+		if err != nil {
+			return nil, err
+		}
+		n += vLen
+	}
+	return out[:n], nil
+}
+
+// DecodeMap はEncodeMapの出力をデコードする
+// キーと値はDecodePointerと同じく実行時に型で分岐するので、デコードできない型はErrUnsupportedTypeを返す
+func DecodeMap[K comparable, V any](in []byte) (map[K]V, int, error) {
+	n := 0
+	// 1バイト目が0ならnilを返す
+	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return nil, 0, varintErr(isNotNilLen)
+	}
+	n += isNotNilLen
+	if isNotNil == 0 {
+		return nil, n, nil
+	}
+	// 要素数を読み取る
+	mapLen, mapLenLen := binary.Uvarint(in[n:])
+	if mapLenLen <= 0 {
+		return nil, 0, varintErr(mapLenLen)
+	}
+	n += mapLenLen
+	if err := checkLen(in, n, mapLen); err != nil {
+		return nil, 0, err
+	}
+	m := make(map[K]V, mapLen)
+	for i := uint64(0); i < mapLen; i++ {
+		var k K
+		kLen, err := decodeValue(in[n:], &k)
+		if err != nil {
+			return nil, 0, err
+		}
+		n += kLen
+		var v V
+		vLen, err := decodeValue(in[n:], &v)
+		if err != nil {
+			return nil, 0, err
+		}
+		n += vLen
+		m[k] = v
+	}
+	return m, n, nil
+}
+
+func isStructElem[T any]() bool {
+	return signedSliceLen(reflect.TypeOf((*T)(nil)).Elem())
+}
+
+func putSliceLen(out []byte, l int, signed bool) int {
+	if signed {
+		return binary.PutVarint(out, int64(l))
+	}
+	return binary.PutUvarint(out, uint64(l))
+}
+
+func sliceLenValue(in []byte, signed bool) (int, int) {
+	if signed {
+		l, lLen := binary.Varint(in)
+		return int(l), lLen
+	}
+	l, lLen := binary.Uvarint(in)
+	return int(l), lLen
+}
+
+// sizeValue はpが指す値のエンコードに必要な最大サイズを返す
+func sizeValue(p interface{}) int {
+	switch v := p.(type) {
+	case *bool:
+		return VarintLenBool
+	case *string:
+		return binary.MaxVarintLen64 + len(*v)
+	case *[]byte:
+		return VarintLenPointer + binary.MaxVarintLen64 + len(*v)
+	case *time.Time:
+		return VarintLenTime
+	case Codec:
+		return v.Size()
+	}
+	return sizeReflect(reflect.ValueOf(p).Elem(), LayoutFlatten, &encodeState{})
+}
+
+// encodeValue はpが指す値をエンコードする
+func encodeValue(out []byte, p interface{}) (int, error) {
+	switch v := p.(type) {
+	case *int:
+		return EncodeInt(*v, out), nil
+	case *int8:
+		return EncodeInt(*v, out), nil
+	case *int16:
+		return EncodeInt(*v, out), nil
+	case *int32:
+		return EncodeInt(*v, out), nil
+	case *int64:
+		return EncodeInt(*v, out), nil
+	case *uint:
+		return EncodeUint(*v, out), nil
+	case *uint8:
+		return EncodeUint(*v, out), nil
+	case *uint16:
+		return EncodeUint(*v, out), nil
+	case *uint32:
+		return EncodeUint(*v, out), nil
+	case *uint64:
+		return EncodeUint(*v, out), nil
+	case *float32:
+		return EncodeFloat(*v, out), nil
+	case *float64:
+		return EncodeFloat(*v, out), nil
+	case *bool:
+		if *v {
+			out[0] = 1
+		} else {
+			out[0] = 0
+		}
+		return VarintLenBool, nil
+	case *string:
+		strSize := len(*v)
+		n := binary.PutUvarint(out, uint64(strSize))
+		copy(out[n:n+strSize], *v)
+		return n + strSize, nil
+	case *[]byte:
+		if *v == nil {
+			out[0] = 0
+			return VarintLenPointer, nil
+		}
+		out[0] = 1
+		n := VarintLenPointer
+		bSize := len(*v)
+		n += binary.PutUvarint(out[n:], uint64(bSize))
+		copy(out[n:n+bSize], *v)
+		return n + bSize, nil
+	case *time.Time:
+		return TimeMarshalBinary(*v, out)
+	case Codec:
+		return v.EncodeWithBytes(out)
+	}
+
+	// intなどを基にした名前付きの型や構造体
+	return encodeReflect(out, reflect.ValueOf(p).Elem(), LayoutFlatten, &encodeState{})
+}
+
+// decodeValue はpが指す値にデコードする
+func decodeValue(in []byte, p interface{}) (int, error) {
+	var n int
+	switch v := p.(type) {
+	case *int:
+		*v, n = DecodeInt[int](in)
+	case *int8:
+		*v, n = DecodeInt[int8](in)
+	case *int16:
+		*v, n = DecodeInt[int16](in)
+	case *int32:
+		*v, n = DecodeInt[int32](in)
+	case *int64:
+		*v, n = DecodeInt[int64](in)
+	case *uint:
+		*v, n = DecodeUint[uint](in)
+	case *uint8:
+		*v, n = DecodeUint[uint8](in)
+	case *uint16:
+		*v, n = DecodeUint[uint16](in)
+	case *uint32:
+		*v, n = DecodeUint[uint32](in)
+	case *uint64:
+		*v, n = DecodeUint[uint64](in)
+	case *float32:
+		*v, n = DecodeFloat[float32](in)
+	case *float64:
+		*v, n = DecodeFloat[float64](in)
+	case *bool:
+		*v, n = BoolDecode(in)
+	case *string:
+		*v, n = StringDecode(in)
+	case *[]byte:
+		*v, n = BytesDecode(in)
+	case *time.Time:
+		if err := checkLen(in, 0, VarintLenTime); err != nil {
+			return 0, err
+		}
+		if err := v.UnmarshalBinary(in[:VarintLenTime]); err != nil {
+			return 0, err
+		}
+		n = VarintLenTime
+	case Codec:
+		return v.Decode(in)
+	default:
+		return decodeReflect(in, reflect.ValueOf(p).Elem(), LayoutFlatten, nil)
+	}
+	// プリミティブのデコード関数は不正な入力でnに0以下を返す
+	if n <= 0 {
+		return 0, varintErr(n)
+	}
+	return n, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGenericIntLayout(t *testing.T) {
+	i := -12345678
+	want, _ := IntEncode(i)
+	out := make([]byte, 10)
+	if got := out[:EncodeInt(i, out)]; !bytes.Equal(got, want) {
+		t.Errorf("EncodeInt = %v, want %v", got, want)
+	}
+
+	p := &[]int{100}[0]
+	want, _ = PointerEncode(p)
+	got, err := EncodePointer(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("EncodePointer = %v, want %v", got, want)
+	}
+	want, _ = PointerEncode(nil)
+	got, err = EncodePointer[int](nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("EncodePointer(nil) = %v, want %v", got, want)
+	}
+
+	for _, slice := range [][]int{{1, 1000000000000000000, -1000000000000000000}, {}, nil} {
+		want, _ := SliceEncode(slice)
+		got, err := EncodeSlice(slice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("EncodeSlice(%v) = %v, want %v", slice, got, want)
+		}
+	}
+}
+
+func TestGenericRoundTrip(t *testing.T) {
+	type myUint uint16
+
+	str := "test_string"
+	now := time.Now()
+	subs := map[int]TestSubStruct{1: createTestSubStruct()}
+	tests := []struct {
+		name   string
+		value  interface{}
+		encode func() ([]byte, error)
+		decode func([]byte) (interface{}, int, error)
+	}{
+		{
+			name:   "*string",
+			value:  &str,
+			encode: func() ([]byte, error) { return EncodePointer(&str) },
+			decode: func(in []byte) (interface{}, int, error) { return DecodePointer[string](in) },
+		},
+		{
+			name:   "*time.Time",
+			value:  &now,
+			encode: func() ([]byte, error) { return EncodePointer(&now) },
+			decode: func(in []byte) (interface{}, int, error) { return DecodePointer[time.Time](in) },
+		},
+		{
+			name:   "[]uint32",
+			value:  []uint32{0, 1, 4294967295},
+			encode: func() ([]byte, error) { return EncodeSlice([]uint32{0, 1, 4294967295}) },
+			decode: func(in []byte) (interface{}, int, error) { return DecodeSlice[uint32](in) },
+		},
+		{
+			name:   "[]myUint",
+			value:  []myUint{1, 65535},
+			encode: func() ([]byte, error) { return EncodeSlice([]myUint{1, 65535}) },
+			decode: func(in []byte) (interface{}, int, error) { return DecodeSlice[myUint](in) },
+		},
+		{
+			name:   "[]float32",
+			value:  []float32{1.5, -0.25},
+			encode: func() ([]byte, error) { return EncodeSlice([]float32{1.5, -0.25}) },
+			decode: func(in []byte) (interface{}, int, error) { return DecodeSlice[float32](in) },
+		},
+		{
+			name:   "map[string]int",
+			value:  map[string]int{"a": 1, "b": -2},
+			encode: func() ([]byte, error) { return EncodeMap(map[string]int{"a": 1, "b": -2}) },
+			decode: func(in []byte) (interface{}, int, error) { return DecodeMap[string, int](in) },
+		},
+		{
+			name:   "map[int]TestSubStruct",
+			value:  subs,
+			encode: func() ([]byte, error) { return EncodeMap(subs) },
+			decode: func(in []byte) (interface{}, int, error) { return DecodeMap[int, TestSubStruct](in) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := tt.encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, n, err := tt.decode(bs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(bs) {
+				t.Errorf("decoded %d bytes, want %d", n, len(bs))
+			}
+			if diff := cmp.Diff(tt.value, decoded); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestEncodeSliceMatchesTestSubStructs(t *testing.T) {
+	subs := make(TestSubStructs, 3)
+	for i := range subs {
+		subs[i] = createTestSubStruct()
+	}
+	bs, err := EncodeSlice(subs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := TestSubStructs{}
+	if _, err := decoded.Decode(bs); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(subs, decoded); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestGenericUnsupportedType(t *testing.T) {
+	// 型引数は制約で絞らないので、chanやfuncはコンパイルでき、実行時にエラーになる
+	ch := make(chan int)
+	if _, err := EncodePointer(&ch); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("EncodePointer(chan) error = %v, want %v", err, ErrUnsupportedType)
+	}
+	if _, err := EncodeSlice([]chan int{ch}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("EncodeSlice([]chan) error = %v, want %v", err, ErrUnsupportedType)
+	}
+	if _, err := EncodeMap(map[string]func(){"f": func() {}}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("EncodeMap(map[string]func()) error = %v, want %v", err, ErrUnsupportedType)
+	}
+	if _, _, err := DecodePointer[chan int]([]byte{1, 0}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("DecodePointer[chan int] error = %v, want %v", err, ErrUnsupportedType)
+	}
+	if _, _, err := DecodeSlice[chan int]([]byte{1, 1, 0}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("DecodeSlice[chan int] error = %v, want %v", err, ErrUnsupportedType)
+	}
+	if _, _, err := DecodeMap[string, func()]([]byte{1, 1, 1, 'f', 0}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("DecodeMap[string, func()] error = %v, want %v", err, ErrUnsupportedType)
+	}
+}
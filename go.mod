@@ -1,16 +1,16 @@
 module encode
 
-go 1.17
+go 1.18
 
 require (
 	github.com/gogo/protobuf v1.3.2
 	github.com/golang/protobuf v1.5.2
 	github.com/google/go-cmp v0.5.6
 	github.com/kr/pretty v0.3.0
+	google.golang.org/protobuf v1.26.0
 )
 
 require (
 	github.com/kr/text v0.2.0 // indirect
 	github.com/rogpeppe/go-internal v1.6.1 // indirect
-	google.golang.org/protobuf v1.26.0 // indirect
 )
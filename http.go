@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ContentTypeBinary はこのパッケージの形式のメディアタイプ
+const ContentTypeBinary = "application/x-structenc"
+
+// MaxRequestBytes はReadRequestで読み取るリクエストの本体の上限
+const MaxRequestBytes = 10 << 20
+
+var ErrRequestTooLarge = errors.New("http: request body too large")
+
+// WriteResponse はAcceptがContentTypeBinaryを受け付ける場合はこのパッケージの形式で、
+// それ以外はJSONでvを書き込む
+// vは生成されたエンコードメソッドを持つ型か、EncodeStructでエンコードできる構造体
+func WriteResponse(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	var body []byte
+	var err error
+	contentType := "application/json"
+	if acceptsBinary(r.Header.Get("Accept")) {
+		contentType = ContentTypeBinary
+		body, err = encodeCodec(v)
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
+	_, err = w.Write(body)
+	return err
+}
+
+// ReadRequest はContent-TypeがContentTypeBinaryならこのパッケージの形式で、
+// それ以外はJSONとしてリクエストの本体をvにデコードする
+// MaxRequestBytesより大きい本体はErrRequestTooLargeになる
+func ReadRequest(r *http.Request, v interface{}) error {
+	return ReadRequestWithOptions(r, v, MaxRequestBytes, DecodeOptions{})
+}
+
+// ReadRequestWithOptions はmaxBytesを本体の上限として、このパッケージの形式はoptsでデコードする
+func ReadRequestWithOptions(r *http.Request, v interface{}, maxBytes int64, opts DecodeOptions) error {
+	// 上限を1バイト超えて読めたら大きすぎる
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > maxBytes {
+		return fmt.Errorf("%w: exceeds %d bytes", ErrRequestTooLarge, maxBytes)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != ContentTypeBinary {
+		return json.Unmarshal(body, v)
+	}
+	n, err := DecodeWithOptions(body, v, opts)
+	if err != nil {
+		return err
+	}
+	if n != len(body) {
+		return fmt.Errorf("%w: %d bytes after offset %d", ErrTrailingBytes, len(body)-n, n)
+	}
+	return nil
+}
+
+// acceptsBinary はAcceptヘッダーがq=0以外でContentTypeBinaryを含むか
+func acceptsBinary(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil || mediaType != ContentTypeBinary {
+			continue
+		}
+		if q, ok := params["q"]; ok && strings.Trim(q, "0.") == "" {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// newEchoServer はリクエストの本体をTestStructsとして読み、そのまま返すサーバー
+func newEchoServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ss := TestStructs{}
+		if err := ReadRequest(r, &ss); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrRequestTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if err := WriteResponse(w, r, ss); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func postEcho(t *testing.T, url, contentType, accept string, body []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func TestHTTPContentNegotiation(t *testing.T) {
+	srv := newEchoServer(t)
+	ss := createTestStructs(2)
+	binary, err := ss.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonBody, err := json.Marshal(ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name        string
+		contentType string
+		body        []byte
+		accept      string
+		wantType    string
+	}{
+		{name: "binary", contentType: ContentTypeBinary, body: binary, accept: ContentTypeBinary, wantType: ContentTypeBinary},
+		{name: "binary with params", contentType: ContentTypeBinary + "; charset=binary", body: binary, accept: "application/json;q=0.5, " + ContentTypeBinary, wantType: ContentTypeBinary},
+		{name: "json fallback", contentType: ContentTypeBinary, body: binary, accept: "*/*", wantType: "application/json"},
+		{name: "refused binary", contentType: ContentTypeBinary, body: binary, accept: ContentTypeBinary + ";q=0", wantType: "application/json"},
+		{name: "json request", contentType: "application/json", body: jsonBody, accept: ContentTypeBinary, wantType: ContentTypeBinary},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			res := postEcho(t, srv.URL, c.contentType, c.accept, c.body)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", res.StatusCode)
+			}
+			if got := res.Header.Get("Content-Type"); got != c.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, c.wantType)
+			}
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := TestStructs{}
+			if c.wantType == ContentTypeBinary {
+				_, err = decoded.Decode(body)
+			} else {
+				err = json.Unmarshal(body, &decoded)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(ss, decoded); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestReadRequestLimits(t *testing.T) {
+	srv := newEchoServer(t)
+
+	huge := make([]byte, MaxRequestBytes+1)
+	if res := postEcho(t, srv.URL, ContentTypeBinary, "", huge); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("huge body: status = %d, want %d", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	bs, err := createTestStructs(1).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string][]byte{
+		"trailing":  append(bs, 0),
+		"truncated": bs[:len(bs)-1],
+	} {
+		if res := postEcho(t, srv.URL, ContentTypeBinary, "", body); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", name, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(bs))
+	req.Header.Set("Content-Type", ContentTypeBinary)
+	ss := TestStructs{}
+	if err := ReadRequestWithOptions(req, &ss, int64(len(bs)), DecodeOptions{MaxSliceLen: 5}); !errors.Is(err, ErrDecodeLimit) {
+		t.Errorf("ReadRequestWithOptions error = %v, want %v", err, ErrDecodeLimit)
+	}
+}
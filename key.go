@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+// キーのエンコードは、エンコードしたバイト列をbytes.Compareで比べた順序が値の順序と一致する
+// LSMツリーやBツリーのキーに使う
+// 整数は8バイトのビッグエンディアンで、符号付きは符号ビットを反転する
+// 文字列は0x00を0x00 0xffにエスケープし、0x00 0x01で終える
+// どの値も終わりが分かるので、連結したタプルは先頭の要素から順に比べた順序になる
+
+var ErrInvalidKey = errors.New("decode: invalid key")
+
+const (
+	// KeyLenInt は整数のキーのバイト数
+	KeyLenInt = 8
+	// KeyLenTime はTimeのキーのバイト数。Unix時刻の秒と、ナノ秒の4バイト
+	KeyLenTime = KeyLenInt + 4
+
+	keyEscape     = 0x00
+	keyEscapedNul = 0xff
+	keyTerminator = 0x01
+)
+
+func AppendKeyInt[T Signed](out []byte, v T) []byte {
+	// 符号ビットを反転すると負の数が正の数より前になる
+	return appendKeyUint64(out, uint64(v)^(1<<63))
+}
+
+// DecodeKeyInt はAppendKeyIntのキーを読み取る。Tに収まらない値はErrInvalidKeyになる
+func DecodeKeyInt[T Signed](in []byte) (T, int, error) {
+	if err := checkLen(in, 0, KeyLenInt); err != nil {
+		return 0, 0, err
+	}
+	v := int64(binary.BigEndian.Uint64(in) ^ (1 << 63))
+	if int64(T(v)) != v {
+		return 0, 0, fmt.Errorf("%w: %d overflows %T", ErrInvalidKey, v, T(0))
+	}
+	return T(v), KeyLenInt, nil
+}
+
+func AppendKeyUint[T Unsigned](out []byte, v T) []byte {
+	return appendKeyUint64(out, uint64(v))
+}
+
+func appendKeyUint64(out []byte, v uint64) []byte {
+	var buf [KeyLenInt]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(out, buf[:]...)
+}
+
+// DecodeKeyUint はAppendKeyUintのキーを読み取る。Tに収まらない値はErrInvalidKeyになる
+func DecodeKeyUint[T Unsigned](in []byte) (T, int, error) {
+	if err := checkLen(in, 0, KeyLenInt); err != nil {
+		return 0, 0, err
+	}
+	v := binary.BigEndian.Uint64(in)
+	if uint64(T(v)) != v {
+		return 0, 0, fmt.Errorf("%w: %d overflows %T", ErrInvalidKey, v, T(0))
+	}
+	return T(v), KeyLenInt, nil
+}
+
+func AppendKeyString(out []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == keyEscape {
+			out = append(out, keyEscape, keyEscapedNul)
+		} else {
+			out = append(out, s[i])
+		}
+	}
+	// 終端は0x00 0xffより小さいので、短い文字列が前になる
+	return append(out, keyEscape, keyTerminator)
+}
+
+// DecodeKeyString はAppendKeyStringのキーを読み取る
+func DecodeKeyString(in []byte) (string, int, error) {
+	var b []byte
+	for i := 0; i < len(in); i++ {
+		if in[i] != keyEscape {
+			b = append(b, in[i])
+			continue
+		}
+		if i+1 == len(in) {
+			break
+		}
+		switch in[i+1] {
+		case keyEscapedNul:
+			b = append(b, keyEscape)
+			i++
+		case keyTerminator:
+			return string(b), i + 2, nil
+		default:
+			return "", 0, fmt.Errorf("%w: invalid escape 0x%02x at offset %d", ErrInvalidKey, in[i+1], i+1)
+		}
+	}
+	return "", 0, io.ErrUnexpectedEOF
+}
+
+// AppendKeyTime はtをUnix時刻の秒とナノ秒でエンコードする
+// ゾーンは残らず、デコードするとUTCになる
+func AppendKeyTime(out []byte, t time.Time) []byte {
+	out = AppendKeyInt(out, t.Unix())
+	var buf [KeyLenTime - KeyLenInt]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(t.Nanosecond()))
+	return append(out, buf[:]...)
+}
+
+// DecodeKeyTime はAppendKeyTimeのキーを読み取る
+func DecodeKeyTime(in []byte) (time.Time, int, error) {
+	if err := checkLen(in, 0, KeyLenTime); err != nil {
+		return time.Time{}, 0, err
+	}
+	sec, _, err := DecodeKeyInt[int64](in)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	nsec := binary.BigEndian.Uint32(in[KeyLenInt:])
+	if nsec >= 1e9 {
+		return time.Time{}, 0, fmt.Errorf("%w: nanoseconds %d out of range", ErrInvalidKey, nsec)
+	}
+	return time.Unix(sec, int64(nsec)).UTC(), KeyLenTime, nil
+}
+
+// AppendKey はvalsを順にキーとしてエンコードし、タプルのキーにする
+// valsの要素は整数、文字列、time.Timeか、それらを基にした型
+func AppendKey(out []byte, vals ...interface{}) ([]byte, error) {
+	for _, v := range vals {
+		if t, ok := v.(time.Time); ok {
+			out = AppendKeyTime(out, t)
+			continue
+		}
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			out = AppendKeyInt(out, rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			out = AppendKeyUint(out, rv.Uint())
+		case reflect.String:
+			out = AppendKeyString(out, rv.String())
+		default:
+			return nil, fmt.Errorf("%w: %T in key", ErrUnsupportedType, v)
+		}
+	}
+	return out, nil
+}
+
+// DecodeKey はAppendKeyのキーをptrsの指す先に順に読み取る
+func DecodeKey(in []byte, ptrs ...interface{}) (int, error) {
+	n := 0
+	for _, p := range ptrs {
+		if t, ok := p.(*time.Time); ok {
+			v, l, err := DecodeKeyTime(in[n:])
+			if err != nil {
+				return 0, err
+			}
+			*t = v
+			n += l
+			continue
+		}
+		rv := reflect.ValueOf(p)
+		if rv.Kind() != reflect.Pointer || rv.IsNil() {
+			return 0, ErrUnsupportedType
+		}
+		rv = rv.Elem()
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v, l, err := DecodeKeyInt[int64](in[n:])
+			if err != nil {
+				return 0, err
+			}
+			if rv.OverflowInt(v) {
+				return 0, fmt.Errorf("%w: %d overflows %s", ErrInvalidKey, v, rv.Type())
+			}
+			rv.SetInt(v)
+			n += l
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v, l, err := DecodeKeyUint[uint64](in[n:])
+			if err != nil {
+				return 0, err
+			}
+			if rv.OverflowUint(v) {
+				return 0, fmt.Errorf("%w: %d overflows %s", ErrInvalidKey, v, rv.Type())
+			}
+			rv.SetUint(v)
+			n += l
+		case reflect.String:
+			v, l, err := DecodeKeyString(in[n:])
+			if err != nil {
+				return 0, err
+			}
+			rv.SetString(v)
+			n += l
+		default:
+			return 0, fmt.Errorf("%w: %s in key", ErrUnsupportedType, rv.Type())
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign はcmpの結果を-1, 0, 1にする
+func sign(c int) int {
+	switch {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	}
+	return 0
+}
+
+func compareOrdered[T int64 | uint64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// checkKeyOrder はキーのbytes.Compareが値の比較と一致することを確認する
+func checkKeyOrder[T any](t *testing.T, vals []T, appendKey func([]byte, T) []byte, compare func(a, b T) int) {
+	t.Helper()
+	for _, a := range vals {
+		for _, b := range vals {
+			ka, kb := appendKey(nil, a), appendKey(nil, b)
+			if got, want := sign(bytes.Compare(ka, kb)), compare(a, b); got != want {
+				t.Fatalf("compare(%v, %v): keys %d, values %d\n%x\n%x", a, b, got, want, ka, kb)
+			}
+		}
+	}
+}
+
+func TestKeyIntOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	vals := []int64{math.MinInt64, math.MinInt64 + 1, -256, -1, 0, 1, 255, 256, math.MaxInt64 - 1, math.MaxInt64}
+	for i := 0; i < 50; i++ {
+		vals = append(vals, r.Int63()-r.Int63(), int64(r.Intn(512)-256))
+	}
+	checkKeyOrder(t, vals, AppendKeyInt[int64], compareOrdered[int64])
+
+	for _, v := range vals {
+		got, n, err := DecodeKeyInt[int64](AppendKeyInt(nil, v))
+		if err != nil || n != KeyLenInt || got != v {
+			t.Fatalf("DecodeKeyInt(%d) = %d, %d, %v", v, got, n, err)
+		}
+	}
+}
+
+func TestKeyUintOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	vals := []uint64{0, 1, 255, 256, math.MaxUint32, math.MaxUint64 - 1, math.MaxUint64}
+	for i := 0; i < 50; i++ {
+		vals = append(vals, r.Uint64(), uint64(r.Intn(512)))
+	}
+	checkKeyOrder(t, vals, AppendKeyUint[uint64], compareOrdered[uint64])
+
+	for _, v := range vals {
+		got, n, err := DecodeKeyUint[uint64](AppendKeyUint(nil, v))
+		if err != nil || n != KeyLenInt || got != v {
+			t.Fatalf("DecodeKeyUint(%d) = %d, %d, %v", v, got, n, err)
+		}
+	}
+}
+
+func TestKeyStringOrder(t *testing.T) {
+	// 接頭辞、0x00と0xffを含む文字列
+	vals := []string{"", "\x00", "\x00\x00", "\x00\x01", "\x00\xff", "\x01", "a", "a\x00", "a\x00b", "a\x01", "ab", "b", "\xff", "\xff\x00", strings.Repeat("z", 300)}
+	for i := 0; i < 30; i++ {
+		vals = append(vals, randString(rand.Intn(4)))
+	}
+	checkKeyOrder(t, vals, AppendKeyString, compareOrdered[string])
+
+	for _, v := range vals {
+		key := AppendKeyString(nil, v)
+		got, n, err := DecodeKeyString(key)
+		if err != nil || n != len(key) || got != v {
+			t.Fatalf("DecodeKeyString(%q) = %q, %d, %v", v, got, n, err)
+		}
+	}
+}
+
+func TestKeyTimeOrder(t *testing.T) {
+	base := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	tokyo := time.FixedZone("JST", 9*3600)
+	vals := []time.Time{
+		time.Unix(0, 0), time.Unix(-1, 999999999), time.Unix(-1, 0), {},
+		base, base.Add(1), base.Add(-1), base.Add(time.Hour).In(tokyo), base.In(tokyo),
+		time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC),
+	}
+	checkKeyOrder(t, vals, AppendKeyTime, compareTime)
+
+	for _, v := range vals {
+		got, n, err := DecodeKeyTime(AppendKeyTime(nil, v))
+		if err != nil || n != KeyLenTime || !got.Equal(v) {
+			t.Fatalf("DecodeKeyTime(%v) = %v, %d, %v", v, got, n, err)
+		}
+	}
+}
+
+// keyTuple はタプルのキーのテストに使う(文字列, 整数, Time)の組
+type keyTuple struct {
+	s string
+	i int16
+	t time.Time
+}
+
+func compareKeyTuple(a, b keyTuple) int {
+	if c := compareOrdered(a.s, b.s); c != 0 {
+		return c
+	}
+	if c := compareOrdered(int64(a.i), int64(b.i)); c != 0 {
+		return c
+	}
+	return compareTime(a.t, b.t)
+}
+
+func TestKeyTupleOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	strs := []string{"", "a", "a\x00", "ab"}
+	var vals []keyTuple
+	for i := 0; i < 60; i++ {
+		vals = append(vals, keyTuple{
+			s: strs[r.Intn(len(strs))],
+			i: int16(r.Intn(5) - 2),
+			t: time.Unix(int64(r.Intn(3)), int64(r.Intn(2))),
+		})
+	}
+	appendKey := func(out []byte, v keyTuple) []byte {
+		out, err := AppendKey(out, v.s, v.i, v.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	checkKeyOrder(t, vals, appendKey, compareKeyTuple)
+
+	for _, v := range vals {
+		key := appendKey(nil, v)
+		var got keyTuple
+		n, err := DecodeKey(key, &got.s, &got.i, &got.t)
+		if err != nil || n != len(key) || got.s != v.s || got.i != v.i || !got.t.Equal(v.t) {
+			t.Fatalf("DecodeKey(%+v) = %+v, %d, %v", v, got, n, err)
+		}
+	}
+}
+
+func TestKeyInvalid(t *testing.T) {
+	if _, err := AppendKey(nil, 1.5); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("AppendKey(float) error = %v, want %v", err, ErrUnsupportedType)
+	}
+	if _, _, err := DecodeKeyString([]byte("ab\x00\x02")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("DecodeKeyString(bad escape) error = %v, want %v", err, ErrInvalidKey)
+	}
+	for _, in := range [][]byte{{}, []byte("ab"), []byte("ab\x00")} {
+		if _, _, err := DecodeKeyString(in); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("DecodeKeyString(%q) error = %v, want %v", in, err, io.ErrUnexpectedEOF)
+		}
+	}
+	if _, _, err := DecodeKeyInt[int8](AppendKeyInt(nil, 128)); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("DecodeKeyInt[int8](128) error = %v, want %v", err, ErrInvalidKey)
+	}
+	var u8 uint8
+	if _, err := DecodeKey(AppendKeyUint(nil, uint(256)), &u8); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("DecodeKey(256 into uint8) error = %v, want %v", err, ErrInvalidKey)
+	}
+	if _, _, err := DecodeKeyTime(AppendKeyInt(nil, 0)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DecodeKeyTime(truncated) error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func FuzzKeyStringOrder(f *testing.F) {
+	f.Add("a", "a\x00")
+	f.Add("", "\x00")
+	f.Fuzz(func(t *testing.T, a, b string) {
+		ka, kb := AppendKeyString(nil, a), AppendKeyString(nil, b)
+		if got, want := sign(bytes.Compare(ka, kb)), compareOrdered(a, b); got != want {
+			t.Fatalf("compare(%q, %q): keys %d, values %d", a, b, got, want)
+		}
+		// タプルの後ろの要素は前の要素の順序を変えない
+		ka = AppendKeyInt(ka, int64(len(b)))
+		kb = AppendKeyInt(kb, int64(len(a)))
+		if a != b && sign(bytes.Compare(ka, kb)) != compareOrdered(a, b) {
+			t.Fatalf("tuple (%q, %d) and (%q, %d) are out of order", a, len(b), b, len(a))
+		}
+		got, n, err := DecodeKeyString(AppendKeyString(nil, a))
+		if err != nil || got != a || n != len(AppendKeyString(nil, a)) {
+			t.Fatalf("DecodeKeyString(%q) = %q, %d, %v", a, got, n, err)
+		}
+	})
+}
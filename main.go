@@ -11,9 +11,9 @@ import (
 	"log"
 	"math"
 	"math/rand"
+	"os"
 	"time"
 
-	"github.com/gogo/protobuf/types"
 	protobuf "github.com/golang/protobuf/proto"
 	"github.com/google/go-cmp/cmp"
 )
@@ -26,6 +26,11 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		// structenc <command> [args]
+		fataiIf(runCommand(os.Args[1], os.Args[2:]))
+		return
+	}
 	{
 		i := 12345678
 		bytes, nEn := IntEncode(i)
@@ -143,17 +148,19 @@ func main() {
 		}
 	}
 	{
+		// MarshalBinaryを持たない型にしないとgobがこのパッケージの形式でエンコードする
+		gobData := toGobTestStructs(data)
 		buf := bytes.NewBuffer(nil)
-		err := gob.NewEncoder(buf).Encode(&data)
+		err := gob.NewEncoder(buf).Encode(&gobData)
 		fataiIf(err)
 		byt := buf.Bytes()
 		fmt.Println(len(byt))
 
-		decoded := TestStructs{}
+		decoded := gobTestStructs{}
 		buf = bytes.NewBuffer(byt)
 		err = gob.NewDecoder(buf).Decode(&decoded)
 		fataiIf(err)
-		if diff := cmp.Diff(data, decoded); diff != "" {
+		if diff := cmp.Diff(data, fromGobTestStructs(decoded)); diff != "" {
 			fmt.Println(diff)
 		}
 	}
@@ -200,6 +207,20 @@ func main() {
 			fmt.Println(diff)
 		}
 	}
+	{
+		bytes, err := data.MarshalProto()
+		fataiIf(err)
+
+		fmt.Println(len(bytes))
+
+		decoded := &proto.TestStructs{}
+		err = protobuf.Unmarshal(bytes, decoded)
+		fataiIf(err)
+
+		if diff := cmp.Diff(makeProtoTestStructs(data), decoded); diff != "" {
+			fmt.Println(diff)
+		}
+	}
 }
 
 func fataiIf(err error) {
@@ -345,17 +366,81 @@ func StringEncode(str string) ([]byte, int) {
 	return out[:n], n
 }
 
+// StringDecode は入力が不正な場合はnに0以下を返す
+// 他のDecode関数も同じ
 func StringDecode(in []byte) (string, int) {
 	n := 0
 	// 文字列の長さを読み取る
 	strLen, strLenLen := binary.Uvarint(in)
+	if strLenLen <= 0 {
+		return "", strLenLen
+	}
 	n += strLenLen
+	if checkLen(in, n, strLen) != nil {
+		return "", 0
+	}
 	// 長さの分だけ文字列として読み取る
 	str := string(in[n : n+int(strLen)])
 	n += int(strLen)
 	return str, n
 }
 
+func BytesEncode(b []byte) ([]byte, int) {
+	n := 1
+	if b == nil {
+		// nilの場合は1バイト目に0をセット
+		return []byte{0}, n
+	}
+	bSize := len(b)
+	// nil判定 + バイト列の長さの最大 + バイト列の長さ
+	out := make([]byte, n+binary.MaxVarintLen64+bSize)
+	// nilでない場合は1バイト目に1をセット
+	out[0] = 1
+	// バイト列の長さをセット
+	n += binary.PutUvarint(out[n:], uint64(bSize))
+	// バイト列をコピー
+	copy(out[n:n+bSize], b)
+	n += bSize
+	return out[:n], n
+}
+
+// BytesDecode はデコードしたバイト列を新しく確保した領域にコピーする
+func BytesDecode(in []byte) ([]byte, int) {
+	b, n := BytesDecodeAlias(in)
+	if b == nil {
+		return nil, n
+	}
+	return append([]byte{}, b...), n
+}
+
+// BytesDecodeAlias はコピーせずに入力の一部をそのまま返す
+// 返したバイト列は入力を書き換えると変わる
+func BytesDecodeAlias(in []byte) ([]byte, int) {
+	n := 0
+	// 1バイト目が0ならnilを返す
+	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return nil, isNotNilLen
+	}
+	n += isNotNilLen
+	if isNotNil == 0 {
+		return nil, n
+	}
+	// バイト列の長さを読み取る
+	bLen, bLenLen := binary.Uvarint(in[n:])
+	if bLenLen <= 0 {
+		return nil, bLenLen
+	}
+	n += bLenLen
+	if checkLen(in, n, bLen) != nil {
+		return nil, 0
+	}
+	// appendで入力の続きを上書きしないように容量を長さに合わせる
+	b := in[n : n+int(bLen) : n+int(bLen)]
+	n += int(bLen)
+	return b, n
+}
+
 func BoolEncode(b bool) ([]byte, int) {
 	if b {
 		return []byte{1}, 1
@@ -364,6 +449,9 @@ func BoolEncode(b bool) ([]byte, int) {
 }
 
 func BoolDecode(in []byte) (bool, int) {
+	if len(in) == 0 {
+		return false, 0
+	}
 	return in[0] == 1, 1
 }
 
@@ -396,11 +484,17 @@ func PointerDecode(in []byte) (*int, int) {
 	n := 0
 	// 1バイト目が0ならnilを返す
 	isNotNil, isNotNilLen := binary.Uvarint(in[n:])
+	if isNotNilLen <= 0 {
+		return nil, isNotNilLen
+	}
 	n += isNotNilLen
 	if isNotNil == 0 {
 		return nil, n
 	}
 	intRaw, intLen := binary.Varint(in[n:])
+	if intLen <= 0 {
+		return nil, intLen
+	}
 	n += intLen
 	t := int(intRaw)
 	return &t, n
@@ -430,17 +524,30 @@ func SliceDecode(in []byte) ([]int, int) {
 	n := 0
 	// 1バイト目が0ならnilを返す
 	sliceIsNotNil, sliceIsNotNilLen := binary.Uvarint(in[n:])
+	if sliceIsNotNilLen <= 0 {
+		return nil, sliceIsNotNilLen
+	}
 	n += sliceIsNotNilLen
 	if sliceIsNotNil == 0 {
 		return nil, n
 	}
 	// スライスの長さを読み取る
 	sliceLen, sliceLenLen := binary.Uvarint(in[n:])
+	if sliceLenLen <= 0 {
+		return nil, sliceLenLen
+	}
 	n += sliceLenLen
+	// 1要素は少なくとも1バイトなので残りより長いスライスは確保しない
+	if checkLen(in, n, sliceLen) != nil {
+		return nil, 0
+	}
 	slice := make([]int, sliceLen)
 	// 長さの回数だけ読み取る
 	for i := 0; i < int(sliceLen); i++ {
 		intRaw, intLen := binary.Varint(in[n:])
+		if intLen <= 0 {
+			return nil, intLen
+		}
 		slice[i] = int(intRaw)
 		n += intLen
 	}
@@ -448,45 +555,7 @@ func SliceDecode(in []byte) ([]int, int) {
 }
 
 func makeProtoTestStructs(ss TestStructs) *proto.TestStructs {
-	ssProto := make([]*proto.TestStruct, len(ss))
-	for i, s := range ss {
-		subs := make([]*proto.TestSubStruct, len(s.Subs))
-		for j, sub := range s.Subs {
-			subs[j] = makeProtoTestSubStruct(&sub)
-		}
-		ts, err := types.TimestampProto(s.Time)
-		fataiIf(err)
-		ssProto[i] = &proto.TestStruct{
-			Str:        s.Str,
-			Bool:       s.Bool,
-			Int:        int64(s.Int),
-			Int16:      int32(s.Int16),
-			Int64:      s.Int64,
-			Uint:       uint64(s.Uint),
-			Uint8:      uint32(s.Uint8),
-			Uint32:     s.Uint32,
-			Time:       ts,
-			SubPointer: makeProtoTestSubStruct(s.SubPointer),
-			Subs:       subs,
-		}
-	}
-	return &proto.TestStructs{
-		Ss: ssProto,
-	}
-}
-
-func makeProtoTestSubStruct(sub *TestSubStruct) *proto.TestSubStruct {
-	ts, err := types.TimestampProto(sub.Time)
+	p, err := ss.ToProto()
 	fataiIf(err)
-	return &proto.TestSubStruct{
-		Str:    sub.Str,
-		Bool:   sub.Bool,
-		Int:    int64(sub.Int),
-		Int16:  int32(sub.Int16),
-		Int64:  sub.Int64,
-		Uint:   uint64(sub.Uint),
-		Uint8:  uint32(sub.Uint8),
-		Uint32: sub.Uint32,
-		Time:   ts,
-	}
+	return p
 }
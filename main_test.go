@@ -1,13 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"encode/proto"
-	"encoding/gob"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"testing"
 
 	protobuf "github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
 )
 
 var testStructsMap = map[int]TestStructs{
@@ -38,25 +40,6 @@ func encodeBase(b *testing.B, sliceSize int, encodeFn func(TestStructs) ([]byte,
 	}
 }
 
-func encodeJson(ss TestStructs) ([]byte, error) {
-	return json.Marshal(ss)
-}
-
-func encodeGob(ss TestStructs) ([]byte, error) {
-	buf := bytes.NewBuffer(nil)
-	err := gob.NewEncoder(buf).Encode(&ss)
-	bytes := buf.Bytes()
-	return bytes, err
-}
-
-func encodeSelf(ss TestStructs) ([]byte, error) {
-	return ss.Encode()
-}
-
-func encodeSelfTime(ss TestStructs) ([]byte, error) {
-	return ss.EncodeTime()
-}
-
 func encodeProto(b *testing.B, sliceSize int) {
 	ss := testStructsProtoMap[sliceSize]
 
@@ -69,6 +52,20 @@ func encodeProto(b *testing.B, sliceSize int) {
 	}
 }
 
+// encodeGobBase はMarshalBinaryを持たない型に変換してからgobでエンコードする
+// 変換は計測に含めない
+func encodeGobBase(b *testing.B, sliceSize int) {
+	gs := toGobTestStructs(testStructsMap[sliceSize])
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := encodeGob(gs)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
 func decodeBase(b *testing.B, sliceSize int, encodeFn func(TestStructs) ([]byte, error), decodeFn func([]byte) (TestStructs, error)) {
 	ss := testStructsMap[sliceSize]
 	bs, err := encodeFn(ss)
@@ -85,29 +82,19 @@ func decodeBase(b *testing.B, sliceSize int, encodeFn func(TestStructs) ([]byte,
 	}
 }
 
-func decodeJson(bs []byte) (TestStructs, error) {
-	decoded := TestStructs{}
-	err := json.Unmarshal(bs, &decoded)
-	return decoded, err
-}
-
-func decodeGob(bs []byte) (TestStructs, error) {
-	decoded := TestStructs{}
-	buf := bytes.NewBuffer(bs)
-	err := gob.NewDecoder(buf).Decode(&decoded)
-	return decoded, err
-}
-
-func decodeSelf(bs []byte) (TestStructs, error) {
-	decoded := TestStructs{}
-	_, err := decoded.Decode(bs)
-	return decoded, err
-}
+func decodeGobBase(b *testing.B, sliceSize int) {
+	bs, err := encodeGob(toGobTestStructs(testStructsMap[sliceSize]))
+	if err != nil {
+		panic(err)
+	}
 
-func decodeSelfTime(bs []byte) (TestStructs, error) {
-	decoded := TestStructs{}
-	_, err := decoded.Decode(bs)
-	return decoded, err
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := decodeGob(bs)
+		if err != nil {
+			panic(err)
+		}
+	}
 }
 
 func decodeProto(b *testing.B, sliceSize int) {
@@ -127,12 +114,158 @@ func decodeProto(b *testing.B, sliceSize int) {
 	}
 }
 
+// BenchmarkDecodeInto はDecodeとDecodeIntoで内容の異なる2つの入力を交互にデコードしたときの割り当てを比べる
+// 同じ入力を繰り返すと、DecodeIntoは前の文字列を使い回すので実際より少なく見える
+func BenchmarkDecodeInto(b *testing.B) {
+	for _, size := range []int{1, 100, 10000} {
+		inputs := make([][]byte, 2)
+		for i := range inputs {
+			var err error
+			if inputs[i], err = createTestStructs(size).Encode(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(fmt.Sprintf("Decode/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(inputs[0])))
+			for i := 0; i < b.N; i++ {
+				decoded := TestStructs{}
+				if _, err := decoded.Decode(inputs[i%len(inputs)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("DecodeInto/%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(inputs[0])))
+			// 最初のデコードで確保する要素の領域は計測に含めない
+			decoded := TestStructs{}
+			if _, err := decoded.DecodeInto(inputs[1]); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				decoded.Reset()
+				if _, err := decoded.DecodeInto(inputs[i%len(inputs)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// smallTestStructs は整数を全て1バイトのvarintに収まる小さな値にしたcreateTestStructs
+func smallTestStructs(size int) TestStructs {
+	small := func(s *TestSubStruct) {
+		s.Int = rand.Intn(64)
+		s.Int16 = int16(rand.Intn(64))
+		s.Int64 = int64(rand.Intn(64))
+		s.Uint = uint(rand.Intn(128))
+		s.Uint8 = uint8(rand.Intn(128))
+		s.Uint32 = uint32(rand.Intn(128))
+	}
+	ss := createTestStructs(size)
+	for i := range ss {
+		s := &ss[i]
+		s.Int = rand.Intn(64)
+		s.Int16 = int16(rand.Intn(64))
+		s.Int64 = int64(rand.Intn(64))
+		s.Uint = uint(rand.Intn(128))
+		s.Uint8 = uint8(rand.Intn(128))
+		s.Uint32 = uint32(rand.Intn(128))
+		small(s.SubPointer)
+		for j := range s.Subs {
+			small(&s.Subs[j])
+		}
+	}
+	return ss
+}
+
+// BenchmarkFixed は整数が一様乱数の場合と小さい値の場合で固定長とvarintを比べる
+// エンコード後の大きさをbytes/opで出す
+func BenchmarkFixed(b *testing.B) {
+	datasets := []struct {
+		name string
+		ss   TestStructs
+	}{
+		{name: "random", ss: testStructsMap[1000]},
+		{name: "small", ss: smallTestStructs(1000)},
+	}
+	codecs := []struct {
+		name   string
+		encode func(TestStructs) ([]byte, error)
+		decode func([]byte) (TestStructs, error)
+	}{
+		{name: "varint", encode: encodeSelfTime, decode: decodeSelf},
+		{name: "fixed", encode: encodeFixed, decode: decodeFixed},
+	}
+	for _, ds := range datasets {
+		for _, c := range codecs {
+			bs, err := c.encode(ds.ss)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("encode/%s/%s", ds.name, c.name), func(b *testing.B) {
+				b.SetBytes(int64(len(bs)))
+				for i := 0; i < b.N; i++ {
+					if _, err := c.encode(ds.ss); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(bs)), "bytes/op")
+			})
+			b.Run(fmt.Sprintf("decode/%s/%s", ds.name, c.name), func(b *testing.B) {
+				b.SetBytes(int64(len(bs)))
+				for i := 0; i < b.N; i++ {
+					if _, err := c.decode(bs); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(bs)), "bytes/op")
+			})
+		}
+	}
+}
+
+// BenchmarkCodecs はbenchコマンドと同じエンコード方式を-benchで絞り込めるように並べる
+func BenchmarkCodecs(b *testing.B) {
+	for _, size := range []int{1, 10, 100, 1000, 10000} {
+		ss := testStructsMap[size]
+		for _, c := range benchCodecs {
+			encodeFn, err := c.encoder(ss)
+			if err != nil {
+				b.Fatal(err)
+			}
+			bs, err := encodeFn()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("encode/%s/%d", c.name, size), func(b *testing.B) {
+				b.SetBytes(int64(len(bs)))
+				for i := 0; i < b.N; i++ {
+					if _, err := encodeFn(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run(fmt.Sprintf("decode/%s/%d", c.name, size), func(b *testing.B) {
+				b.SetBytes(int64(len(bs)))
+				for i := 0; i < b.N; i++ {
+					if err := c.decode(bs); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
 func Benchmark_encode_____json_____1(b *testing.B) {
 	encodeBase(b, 1, encodeJson)
 }
 
 func Benchmark_encode______gob_____1(b *testing.B) {
-	encodeBase(b, 1, encodeGob)
+	encodeGobBase(b, 1)
 }
 
 func Benchmark_encode_____self_____1(b *testing.B) {
@@ -147,12 +280,16 @@ func Benchmark_encode_protobuf_____1(b *testing.B) {
 	encodeProto(b, 1)
 }
 
+func Benchmark_encode___pbwire_____1(b *testing.B) {
+	encodeBase(b, 1, encodeProtoWire)
+}
+
 func Benchmark_encode_____json____10(b *testing.B) {
 	encodeBase(b, 10, encodeJson)
 }
 
 func Benchmark_encode______gob____10(b *testing.B) {
-	encodeBase(b, 10, encodeGob)
+	encodeGobBase(b, 10)
 }
 
 func Benchmark_encode_____self____10(b *testing.B) {
@@ -167,12 +304,16 @@ func Benchmark_encode_protobuf____10(b *testing.B) {
 	encodeProto(b, 10)
 }
 
+func Benchmark_encode___pbwire____10(b *testing.B) {
+	encodeBase(b, 10, encodeProtoWire)
+}
+
 func Benchmark_encode_____json___100(b *testing.B) {
 	encodeBase(b, 100, encodeJson)
 }
 
 func Benchmark_encode______gob___100(b *testing.B) {
-	encodeBase(b, 100, encodeGob)
+	encodeGobBase(b, 100)
 }
 
 func Benchmark_encode_____self___100(b *testing.B) {
@@ -187,12 +328,16 @@ func Benchmark_encode_protobuf___100(b *testing.B) {
 	encodeProto(b, 100)
 }
 
+func Benchmark_encode___pbwire___100(b *testing.B) {
+	encodeBase(b, 100, encodeProtoWire)
+}
+
 func Benchmark_encode_____json__1000(b *testing.B) {
 	encodeBase(b, 1000, encodeJson)
 }
 
 func Benchmark_encode______gob__1000(b *testing.B) {
-	encodeBase(b, 1000, encodeGob)
+	encodeGobBase(b, 1000)
 }
 
 func Benchmark_encode_____self__1000(b *testing.B) {
@@ -207,12 +352,16 @@ func Benchmark_encode_protobuf__1000(b *testing.B) {
 	encodeProto(b, 1000)
 }
 
+func Benchmark_encode___pbwire__1000(b *testing.B) {
+	encodeBase(b, 1000, encodeProtoWire)
+}
+
 func Benchmark_encode_____json_10000(b *testing.B) {
 	encodeBase(b, 10000, encodeJson)
 }
 
 func Benchmark_encode______gob_10000(b *testing.B) {
-	encodeBase(b, 10000, encodeGob)
+	encodeGobBase(b, 10000)
 }
 
 func Benchmark_encode_____self_10000(b *testing.B) {
@@ -227,12 +376,16 @@ func Benchmark_encode_protobuf_10000(b *testing.B) {
 	encodeProto(b, 10000)
 }
 
+func Benchmark_encode___pbwire_10000(b *testing.B) {
+	encodeBase(b, 10000, encodeProtoWire)
+}
+
 func Benchmark_decode_____json_____1(b *testing.B) {
 	decodeBase(b, 1, encodeJson, decodeJson)
 }
 
 func Benchmark_decode______gob_____1(b *testing.B) {
-	decodeBase(b, 1, encodeGob, decodeGob)
+	decodeGobBase(b, 1)
 }
 
 func Benchmark_decode_____self_____1(b *testing.B) {
@@ -252,7 +405,7 @@ func Benchmark_decode_____json____10(b *testing.B) {
 }
 
 func Benchmark_decode______gob____10(b *testing.B) {
-	decodeBase(b, 10, encodeGob, decodeGob)
+	decodeGobBase(b, 10)
 }
 
 func Benchmark_decode_____self____10(b *testing.B) {
@@ -272,7 +425,7 @@ func Benchmark_decode_____json___100(b *testing.B) {
 }
 
 func Benchmark_decode______gob___100(b *testing.B) {
-	decodeBase(b, 100, encodeGob, decodeGob)
+	decodeGobBase(b, 100)
 }
 
 func Benchmark_decode_____self___100(b *testing.B) {
@@ -292,7 +445,7 @@ func Benchmark_decode_____json__1000(b *testing.B) {
 }
 
 func Benchmark_decode______gob__1000(b *testing.B) {
-	decodeBase(b, 1000, encodeGob, decodeGob)
+	decodeGobBase(b, 1000)
 }
 
 func Benchmark_decode_____self__1000(b *testing.B) {
@@ -312,7 +465,7 @@ func Benchmark_decode_____json_10000(b *testing.B) {
 }
 
 func Benchmark_decode______gob_10000(b *testing.B) {
-	decodeBase(b, 10000, encodeGob, decodeGob)
+	decodeGobBase(b, 10000)
 }
 
 func Benchmark_decode_____self_10000(b *testing.B) {
@@ -326,3 +479,39 @@ func Benchmark_decode_selftime_10000(b *testing.B) {
 func Benchmark_decode_protobuf_10000(b *testing.B) {
 	decodeProto(b, 10000)
 }
+
+// checkTestStructsMode はEncodeFixedなど別のエンコード方式のencodeとdecodeの組で、
+// nilと空のスライスとcasesが元の値に戻り、途中で切れた入力が全てio.ErrUnexpectedEOFになることを確認する
+func checkTestStructsMode(t *testing.T, cases map[string]TestStructs, encode func(TestStructs) ([]byte, error), decode func(*TestStructs, []byte) (int, error)) {
+	t.Helper()
+	all := map[string]TestStructs{"nil": nil, "empty": {}}
+	for name, ss := range cases {
+		all[name] = ss
+	}
+	for name, ss := range all {
+		t.Run(name, func(t *testing.T) {
+			bs, err := encode(ss)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := TestStructs{}
+			n, err := decode(&decoded, bs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(bs) {
+				t.Errorf("decoded %d bytes, want %d", n, len(bs))
+			}
+			if diff := cmp.Diff(ss, decoded); diff != "" {
+				t.Error(diff)
+			}
+
+			for i := 0; i < len(bs); i++ {
+				decoded := TestStructs{}
+				if _, err := decode(&decoded, bs[:i]); !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("decode(bs[:%d]) error = %v, want %v", i, err, io.ErrUnexpectedEOF)
+				}
+			}
+		})
+	}
+}
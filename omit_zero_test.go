@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// sparseTestStructs はほとんどのフィールドがゼロ値のTestStructs
+func sparseTestStructs() TestStructs {
+	return TestStructs{
+		{},
+		{Str: "only"},
+		{Bool: true, Uint32: 7},
+		{SubPointer: &TestSubStruct{}},
+		{Subs: TestSubStructs{}},
+		{Subs: TestSubStructs{{}, {Int16: -1}}},
+		{Time: time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)},
+	}
+}
+
+func TestOmitZeroRoundTrip(t *testing.T) {
+	cases := map[string]TestStructs{
+		"sparse": sparseTestStructs(),
+		"full":   createTestStructs(3),
+	}
+	checkTestStructsMode(t, cases, TestStructs.EncodeOmitZero, (*TestStructs).DecodeOmitZero)
+}
+
+func TestOmitZeroSize(t *testing.T) {
+	// ゼロ値のTestStructはマスクの1バイトだけになる
+	bs, err := TestStructs{{}}.EncodeOmitZero()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{1, 2, 0}; !cmp.Equal(bs, want) {
+		t.Errorf("EncodeOmitZero() = %x, want %x", bs, want)
+	}
+
+	ss := sparseTestStructs()
+	sparse, err := ss.EncodeOmitZero()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ss.EncodeTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sparse) >= len(plain) {
+		t.Errorf("len(EncodeOmitZero()) = %d, want less than len(EncodeTime()) = %d", len(sparse), len(plain))
+	}
+}
+
+func TestOmitZeroInvalid(t *testing.T) {
+	// フィールドの数より上のビット
+	bs := appendUvarint([]byte{1, 2}, 1<<testStructMaskFields)
+	decoded := TestStructs{}
+	if _, err := decoded.DecodeOmitZero(bs); !errors.Is(err, ErrInvalidBitmap) {
+		t.Errorf("DecodeOmitZero(unused bit) error = %v, want %v", err, ErrInvalidBitmap)
+	}
+}
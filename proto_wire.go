@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MarshalProto は構造体をprotobufのワイヤー形式でエンコードする
+// フィールド番号は`proto:"1"`のようなタグから読み取る
+// 型の対応はproto/struct.protoと同じく、整数はint64/int32/uint64/uint32、time.TimeはTimestampになる
+func MarshalProto(v interface{}) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, ErrUnsupportedType
+	}
+	size, err := sizeProtoMessage(rv)
+	if err != nil {
+		return nil, err
+	}
+	return appendProtoMessage(make([]byte, 0, size), rv), nil
+}
+
+// MarshalProto はTestStructsをmessage TestStructs { repeated TestStruct ss = 1; }としてエンコードする
+func (ss TestStructs) MarshalProto() ([]byte, error) {
+	rv := reflect.ValueOf(ss)
+	size, err := sizeProtoValue(1, rv, false)
+	if err != nil {
+		return nil, err
+	}
+	return appendProtoValue(make([]byte, 0, size), 1, rv, false), nil
+}
+
+type protoField struct {
+	num   protowire.Number
+	index int
+}
+
+var protoFieldsCache sync.Map
+
+func protoFields(t reflect.Type) ([]protoField, error) {
+	if fields, ok := protoFieldsCache.Load(t); ok {
+		return fields.([]protoField), nil
+	}
+	var fields []protoField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("proto")
+		if tag == "-" {
+			continue
+		}
+		num, err := strconv.Atoi(tag)
+		if err != nil || !protowire.Number(num).IsValid() {
+			return nil, fmt.Errorf("proto: %s.%s has no valid field number in its tag", t.Name(), sf.Name)
+		}
+		fields = append(fields, protoField{num: protowire.Number(num), index: i})
+	}
+	// ワイヤー形式ではフィールド番号の順に並べる
+	for i := 1; i < len(fields); i++ {
+		for j := i; j > 0 && fields[j].num < fields[j-1].num; j-- {
+			fields[j], fields[j-1] = fields[j-1], fields[j]
+		}
+	}
+	protoFieldsCache.Store(t, fields)
+	return fields, nil
+}
+
+func sizeProtoMessage(rv reflect.Value) (int, error) {
+	if rv.Type() == timeType {
+		seconds, nanos := timestampOf(rv)
+		size := 0
+		if seconds != 0 {
+			size += protowire.SizeTag(1) + protowire.SizeVarint(uint64(seconds))
+		}
+		if nanos != 0 {
+			size += protowire.SizeTag(2) + protowire.SizeVarint(uint64(nanos))
+		}
+		return size, nil
+	}
+	fields, err := protoFields(rv.Type())
+	if err != nil {
+		return 0, err
+	}
+	size := 0
+	for _, f := range fields {
+		fSize, err := sizeProtoValue(f.num, rv.Field(f.index), false)
+		if err != nil {
+			return 0, err
+		}
+		size += fSize
+	}
+	return size, nil
+}
+
+func appendProtoMessage(b []byte, rv reflect.Value) []byte {
+	if rv.Type() == timeType {
+		// google.protobuf.Timestamp
+		seconds, nanos := timestampOf(rv)
+		if seconds != 0 {
+			b = protowire.AppendTag(b, 1, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(seconds))
+		}
+		if nanos != 0 {
+			b = protowire.AppendTag(b, 2, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(nanos))
+		}
+		return b
+	}
+	fields, _ := protoFields(rv.Type())
+	for _, f := range fields {
+		b = appendProtoValue(b, f.num, rv.Field(f.index), false)
+	}
+	return b
+}
+
+func timestampOf(rv reflect.Value) (int64, int64) {
+	t := rv.Interface().(time.Time)
+	return t.Unix(), int64(t.Nanosecond())
+}
+
+// sizeProtoValue はフィールドのタグを含むサイズを返す
+// repeatedの要素はゼロ値でも省略しないのでalwaysをtrueにする
+func sizeProtoValue(num protowire.Number, rv reflect.Value, always bool) (int, error) {
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return 0, nil
+		}
+		return sizeProtoValue(num, rv.Elem(), true)
+	case reflect.Struct:
+		size, err := sizeProtoMessage(rv)
+		if err != nil {
+			return 0, err
+		}
+		return protowire.SizeTag(num) + protowire.SizeBytes(size), nil
+	case reflect.Slice:
+		elem := rv.Type().Elem()
+		if elem.Kind() == reflect.Uint8 {
+			if rv.Len() == 0 && !always {
+				return 0, nil
+			}
+			return protowire.SizeTag(num) + protowire.SizeBytes(rv.Len()), nil
+		}
+		if isProtoPackable(elem) {
+			if rv.Len() == 0 {
+				return 0, nil
+			}
+			size := 0
+			for i := 0; i < rv.Len(); i++ {
+				size += sizeProtoScalar(rv.Index(i))
+			}
+			return protowire.SizeTag(num) + protowire.SizeBytes(size), nil
+		}
+		size := 0
+		for i := 0; i < rv.Len(); i++ {
+			elemSize, err := sizeProtoValue(num, rv.Index(i), true)
+			if err != nil {
+				return 0, err
+			}
+			size += elemSize
+		}
+		return size, nil
+	case reflect.String:
+		if rv.Len() == 0 && !always {
+			return 0, nil
+		}
+		return protowire.SizeTag(num) + protowire.SizeBytes(rv.Len()), nil
+	}
+	if !isProtoPackable(rv.Type()) {
+		return 0, ErrUnsupportedType
+	}
+	if rv.IsZero() && !always {
+		return 0, nil
+	}
+	return protowire.SizeTag(num) + sizeProtoScalar(rv), nil
+}
+
+func appendProtoValue(b []byte, num protowire.Number, rv reflect.Value, always bool) []byte {
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return b
+		}
+		return appendProtoValue(b, num, rv.Elem(), true)
+	case reflect.Struct:
+		size, _ := sizeProtoMessage(rv)
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(size))
+		return appendProtoMessage(b, rv)
+	case reflect.Slice:
+		elem := rv.Type().Elem()
+		if elem.Kind() == reflect.Uint8 {
+			if rv.Len() == 0 && !always {
+				return b
+			}
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			return protowire.AppendBytes(b, rv.Bytes())
+		}
+		if isProtoPackable(elem) {
+			// proto3のrepeatedのスカラーはpackedでエンコードする
+			if rv.Len() == 0 {
+				return b
+			}
+			size := 0
+			for i := 0; i < rv.Len(); i++ {
+				size += sizeProtoScalar(rv.Index(i))
+			}
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendVarint(b, uint64(size))
+			for i := 0; i < rv.Len(); i++ {
+				b = appendProtoScalar(b, rv.Index(i))
+			}
+			return b
+		}
+		for i := 0; i < rv.Len(); i++ {
+			b = appendProtoValue(b, num, rv.Index(i), true)
+		}
+		return b
+	case reflect.String:
+		if rv.Len() == 0 && !always {
+			return b
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, rv.String())
+	}
+	if rv.IsZero() && !always {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protoScalarType(rv.Kind()))
+	return appendProtoScalar(b, rv)
+}
+
+func isProtoPackable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func protoScalarType(k reflect.Kind) protowire.Type {
+	switch k {
+	case reflect.Float32:
+		return protowire.Fixed32Type
+	case reflect.Float64:
+		return protowire.Fixed64Type
+	}
+	return protowire.VarintType
+}
+
+func sizeProtoScalar(rv reflect.Value) int {
+	switch rv.Kind() {
+	case reflect.Bool:
+		return 1
+	case reflect.Float32:
+		return protowire.SizeFixed32()
+	case reflect.Float64:
+		return protowire.SizeFixed64()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return protowire.SizeVarint(uint64(rv.Int()))
+	}
+	return protowire.SizeVarint(rv.Uint())
+}
+
+func appendProtoScalar(b []byte, rv reflect.Value) []byte {
+	switch rv.Kind() {
+	case reflect.Bool:
+		return protowire.AppendVarint(b, protowire.EncodeBool(rv.Bool()))
+	case reflect.Float32:
+		return protowire.AppendFixed32(b, math.Float32bits(float32(rv.Float())))
+	case reflect.Float64:
+		return protowire.AppendFixed64(b, math.Float64bits(rv.Float()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// int32もint64と同じく符号拡張した10バイトのvarintになる
+		return protowire.AppendVarint(b, uint64(rv.Int()))
+	}
+	return protowire.AppendVarint(b, rv.Uint())
+}
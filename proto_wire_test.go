@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encode/proto"
+	"testing"
+
+	protobuf "github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMarshalProtoMatchesProtobuf(t *testing.T) {
+	data := createTestStructs(10)
+	// ゼロ値のフィールドとnilのポインタ
+	data[1] = TestStruct{Time: data[1].Time, Subs: TestSubStructs{{}}}
+	data[2].SubPointer = nil
+	data[3].Int16 = -1
+	data[3].Int = -1000
+
+	bs, err := data.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := protobuf.Marshal(makeProtoTestStructs(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, want) {
+		t.Error("MarshalProto output differs from protobuf.Marshal")
+	}
+
+	decoded := &proto.TestStructs{}
+	if err := protobuf.Unmarshal(bs, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(makeProtoTestStructs(data), decoded); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestMarshalProtoStruct(t *testing.T) {
+	sub := createTestSubStruct()
+	bs, err := MarshalProto(&sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subProto, err := sub.ToProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := protobuf.Marshal(subProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, want) {
+		t.Error("MarshalProto output differs from protobuf.Marshal")
+	}
+}
+
+func TestMarshalProtoRequiresFieldNumbers(t *testing.T) {
+	type untagged struct {
+		Str string
+	}
+	if _, err := MarshalProto(untagged{Str: "test_string"}); err == nil {
+		t.Error("MarshalProto succeeded without field numbers")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/types"
+	"path"
+	"strings"
+	"unicode"
+)
+
+//go:generate go run . proto -go -o struct_proto.go test_struct.go test_sub_struct.go
+
+// ErrProtoOverflow はprotobufの値が狭いGoの型に収まらない場合のエラー
+var ErrProtoOverflow = errors.New("proto: value overflows the Go type")
+
+// protoGoScalarTypes はprotobufの型とprotocが生成するGoの型の対応
+var protoGoScalarTypes = map[string]string{
+	"string": "string",
+	"bool":   "bool",
+	"int32":  "int32",
+	"int64":  "int64",
+	"uint32": "uint32",
+	"uint64": "uint64",
+	"float":  "float32",
+	"double": "float64",
+	"bytes":  "[]byte",
+}
+
+// generateProtoConverters はGoの型とprotocで生成した型を相互に変換する
+// ToProtoとFromProtoのメソッドを出力する
+func generateProtoConverters(schema *protoSchema, goPkg, protoImport string) ([]byte, error) {
+	g := &protoConverterGenerator{
+		pkg: path.Base(protoImport),
+		buf: bytes.NewBuffer(nil),
+	}
+	for _, msg := range schema.orderedMessages() {
+		var err error
+		if len(msg.fields) == 1 && msg.fields[0].goName == msg.name {
+			err = g.sliceMessage(msg)
+		} else {
+			err = g.structMessage(msg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 桁あふれの確認がある場合だけfmtを使う
+	body := g.buf.Bytes()
+	header := bytes.NewBuffer(nil)
+	fmt.Fprintf(header, "// Code generated by structenc proto -go. DO NOT EDIT.\n\n")
+	fmt.Fprintf(header, "package %s\n\nimport (\n", goPkg)
+	if bytes.Contains(body, []byte("fmt.Errorf")) {
+		fmt.Fprintf(header, "\t\"fmt\"\n\n")
+	}
+	fmt.Fprintf(header, "\t%q\n", protoImport)
+	if schema.usesTimestamp {
+		fmt.Fprintf(header, "\n\t\"github.com/gogo/protobuf/types\"\n")
+	}
+	fmt.Fprintf(header, ")\n")
+	return format.Source(append(header.Bytes(), body...))
+}
+
+type protoConverterGenerator struct {
+	// protocで生成した型のパッケージ名
+	pkg string
+	buf *bytes.Buffer
+}
+
+func (g *protoConverterGenerator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(g.buf, format, args...)
+}
+
+// sliceMessage はTestStructsのようなスライスの型の変換を出力する
+func (g *protoConverterGenerator) sliceMessage(msg *protoMessage) error {
+	f := msg.fields[0]
+	if f.message == "" || f.message == "google.protobuf.Timestamp" {
+		return fmt.Errorf("proto: %s must be a slice of messages", msg.name)
+	}
+	name := protoGoName(f.name)
+	elemPtr := ""
+	if f.elemPointer {
+		elemPtr = "&"
+	}
+
+	g.printf("\nfunc (ss %s) ToProto() (*%s.%s, error) {\n", msg.name, g.pkg, msg.name)
+	g.printf("p := &%s.%s{}\n", g.pkg, msg.name)
+	g.printf("if ss != nil {\n")
+	g.printf("p.%s = make([]*%s.%s, len(ss))\n", name, g.pkg, f.message)
+	g.printf("for i := range ss {\n")
+	g.printf("elem, err := ss[i].ToProto()\nif err != nil {\nreturn nil, err\n}\n")
+	g.printf("p.%s[i] = elem\n}\n}\n", name)
+	g.printf("return p, nil\n}\n")
+
+	g.printf("\nfunc (ss *%s) FromProto(p *%s.%s) error {\n", msg.name, g.pkg, msg.name)
+	g.printf("*ss = nil\n")
+	g.printf("if p == nil || p.%s == nil {\nreturn nil\n}\n", name)
+	g.printf("*ss = make(%s, len(p.%s))\n", msg.name, name)
+	g.printf("for i := range p.%s {\n", name)
+	if f.elemPointer {
+		g.printf("(*ss)[i] = %s%s{}\n", elemPtr, f.message)
+	}
+	g.printf("if err := (*ss)[i].FromProto(p.%s[i]); err != nil {\nreturn err\n}\n}\n", name)
+	g.printf("return nil\n}\n")
+	return nil
+}
+
+// structMessage は構造体の変換を出力する
+func (g *protoConverterGenerator) structMessage(msg *protoMessage) error {
+	g.printf("\nfunc (s *%s) ToProto() (*%s.%s, error) {\n", msg.name, g.pkg, msg.name)
+	g.printf("if s == nil {\nreturn nil, nil\n}\n")
+	g.printf("p := &%s.%s{}\n", g.pkg, msg.name)
+	for _, f := range msg.fields {
+		g.printf("// %s\n", f.goName)
+		if err := g.toProtoField(msg, f); err != nil {
+			return err
+		}
+	}
+	g.printf("return p, nil\n}\n")
+
+	g.printf("\nfunc (s *%s) FromProto(p *%s.%s) error {\n", msg.name, g.pkg, msg.name)
+	g.printf("*s = %s{}\n", msg.name)
+	g.printf("if p == nil {\nreturn nil\n}\n")
+	for _, f := range msg.fields {
+		g.printf("// %s\n", f.goName)
+		g.fromProtoField(msg, f)
+	}
+	g.printf("return nil\n}\n")
+	return nil
+}
+
+func (g *protoConverterGenerator) toProtoField(msg *protoMessage, f protoMessageField) error {
+	name := protoGoName(f.name)
+	local := lowerFirst(f.goName) + "Proto"
+	if f.pointer && f.message == "" {
+		return fmt.Errorf("proto: pointer field %s.%s must be a message", msg.name, f.goName)
+	}
+	if f.pointer && f.message == "google.protobuf.Timestamp" {
+		return fmt.Errorf("proto: pointer field %s.%s is not supported", msg.name, f.goName)
+	}
+
+	switch {
+	case f.repeated && f.message != "":
+		g.printf("if s.%s != nil {\n", f.goName)
+		g.printf("p.%s = make([]*%s, len(s.%s))\n", name, g.protoTypeName(f), f.goName)
+		g.printf("for i := range s.%s {\n", f.goName)
+		if f.message == "google.protobuf.Timestamp" {
+			g.printf("elem, err := types.TimestampProto(s.%s[i])\n", f.goName)
+		} else {
+			g.printf("elem, err := s.%s[i].ToProto()\n", f.goName)
+		}
+		g.printf("if err != nil {\nreturn nil, err\n}\n")
+		g.printf("p.%s[i] = elem\n}\n}\n", name)
+	case f.repeated:
+		pt := protoGoScalarTypes[f.typ]
+		g.printf("if s.%s != nil {\n", f.goName)
+		g.printf("p.%s = make([]%s, len(s.%s))\n", name, pt, f.goName)
+		g.printf("for i, v := range s.%s {\n", f.goName)
+		g.printf("p.%s[i] = %s(v)\n}\n}\n", name, pt)
+	case f.message == "google.protobuf.Timestamp":
+		g.printf("%s, err := types.TimestampProto(s.%s)\n", local, f.goName)
+		g.printf("if err != nil {\nreturn nil, err\n}\n")
+		g.printf("p.%s = %s\n", name, local)
+	case f.message != "":
+		g.printf("%s, err := s.%s.ToProto()\n", local, f.goName)
+		g.printf("if err != nil {\nreturn nil, err\n}\n")
+		g.printf("p.%s = %s\n", name, local)
+	case f.typ == "bytes" || protoGoScalarTypes[f.typ] == f.goScalar:
+		g.printf("p.%s = s.%s\n", name, f.goName)
+	default:
+		g.printf("p.%s = %s(s.%s)\n", name, protoGoScalarTypes[f.typ], f.goName)
+	}
+	return nil
+}
+
+func (g *protoConverterGenerator) fromProtoField(msg *protoMessage, f protoMessageField) {
+	name := protoGoName(f.name)
+	container := types.ExprString(f.goType)
+
+	switch {
+	case f.repeated && f.message != "":
+		g.printf("if p.%s != nil {\n", name)
+		g.printf("s.%s = make(%s, len(p.%s))\n", f.goName, container, name)
+		g.printf("for i := range p.%s {\n", name)
+		if f.message == "google.protobuf.Timestamp" {
+			g.printf("elem, err := types.TimestampFromProto(p.%s[i])\n", name)
+			g.printf("if err != nil {\nreturn err\n}\n")
+			g.printf("s.%s[i] = elem\n}\n}\n", f.goName)
+			return
+		}
+		if f.elemPointer {
+			g.printf("s.%s[i] = &%s{}\n", f.goName, f.message)
+		}
+		g.printf("if err := s.%s[i].FromProto(p.%s[i]); err != nil {\nreturn err\n}\n}\n}\n", f.goName, name)
+	case f.repeated:
+		g.printf("if p.%s != nil {\n", name)
+		g.printf("s.%s = make(%s, len(p.%s))\n", f.goName, container, name)
+		g.printf("for i, v := range p.%s {\n", name)
+		if protoGoScalarTypes[f.typ] == f.goScalar {
+			g.printf("s.%s[i] = v\n}\n}\n", f.goName)
+			return
+		}
+		g.printf("if %s(%s(v)) != v {\n", protoGoScalarTypes[f.typ], f.goScalar)
+		g.printf("return fmt.Errorf(\"%%w: %s.%s[%%d] = %%v\", ErrProtoOverflow, i, v)\n}\n", msg.name, f.goName)
+		g.printf("s.%s[i] = %s(v)\n}\n}\n", f.goName, f.goScalar)
+	case f.message == "google.protobuf.Timestamp":
+		g.printf("if p.%s != nil {\n", name)
+		g.printf("t, err := types.TimestampFromProto(p.%s)\n", name)
+		g.printf("if err != nil {\nreturn err\n}\n")
+		g.printf("s.%s = t\n}\n", f.goName)
+	case f.message != "" && f.pointer:
+		g.printf("if p.%s != nil {\n", name)
+		g.printf("s.%s = &%s{}\n", f.goName, f.message)
+		g.printf("if err := s.%s.FromProto(p.%s); err != nil {\nreturn err\n}\n}\n", f.goName, name)
+	case f.message != "":
+		g.printf("if err := s.%s.FromProto(p.%s); err != nil {\nreturn err\n}\n", f.goName, name)
+	case f.typ == "bytes" || protoGoScalarTypes[f.typ] == f.goScalar:
+		g.printf("s.%s = p.%s\n", f.goName, name)
+	default:
+		// 狭いGoの型に戻す場合は桁あふれを確認する
+		g.printf("if %s(%s(p.%s)) != p.%s {\n", protoGoScalarTypes[f.typ], f.goScalar, name, name)
+		g.printf("return fmt.Errorf(\"%%w: %s.%s = %%v\", ErrProtoOverflow, p.%s)\n}\n", msg.name, f.goName, name)
+		g.printf("s.%s = %s(p.%s)\n", f.goName, f.goScalar, name)
+	}
+}
+
+// protoTypeName はprotocで生成したmessageのGoの型名を返す
+func (g *protoConverterGenerator) protoTypeName(f protoMessageField) string {
+	if f.message == "google.protobuf.Timestamp" {
+		return "types.Timestamp"
+	}
+	return g.pkg + "." + f.message
+}
+
+// protoGoName はprotocと同じくsub_pointerをSubPointerのように変換する
+func protoGoName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '_' && i+1 < len(name) && 'a' <= name[i+1] && name[i+1] <= 'z' {
+			continue
+		}
+		if '0' <= c && c <= '9' {
+			b.WriteByte(c)
+			continue
+		}
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		b.WriteByte(c)
+		for i+1 < len(name) && 'a' <= name[i+1] && name[i+1] <= 'z' {
+			i++
+			b.WriteByte(name[i])
+		}
+	}
+	return b.String()
+}
+
+func lowerFirst(name string) string {
+	runes := []rune(name)
+	runes[0] = unicode.ToLower(runes[0])
+	return string(runes)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"testing"
+
+	"encode/proto"
+
+	protobuf "github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGenerateProtoConvertersMatchesCheckedIn(t *testing.T) {
+	schema, err := parseProtoSchema([]string{"test_struct.go", "test_sub_struct.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := generateProtoConverters(schema, "main", "encode/proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("struct_proto.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(want), string(got)); diff != "" {
+		t.Errorf("struct_proto.go is out of date; run go generate (-want +got):\n%s", diff)
+	}
+}
+
+func TestProtoConvertRoundTrip(t *testing.T) {
+	data := createTestStructs(10)
+	data[0].SubPointer = nil
+	data[1].Subs = nil
+
+	p, err := data.ToProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := protobuf.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedProto := &proto.TestStructs{}
+	if err := protobuf.Unmarshal(bs, decodedProto); err != nil {
+		t.Fatal(err)
+	}
+	decoded := TestStructs{}
+	if err := decoded.FromProto(decodedProto); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(data, decoded); diff != "" {
+		t.Error(diff)
+	}
+	if decoded[0].SubPointer != nil {
+		t.Error("nil SubPointer was decoded as non-nil")
+	}
+}
+
+func TestProtoConvertNil(t *testing.T) {
+	var s *TestStruct
+	p, err := s.ToProto()
+	if err != nil || p != nil {
+		t.Errorf("ToProto() on nil = %v, %v, want nil, nil", p, err)
+	}
+
+	decoded := TestStruct{Str: "test_string"}
+	if err := decoded.FromProto(nil); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(TestStruct{}, decoded); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestProtoConvertOverflow(t *testing.T) {
+	tests := []struct {
+		name string
+		p    *proto.TestSubStruct
+	}{
+		{name: "Int16", p: &proto.TestSubStruct{Int16: math.MaxInt16 + 1}},
+		{name: "Int16 negative", p: &proto.TestSubStruct{Int16: math.MinInt16 - 1}},
+		{name: "Uint8", p: &proto.TestSubStruct{Uint8: math.MaxUint8 + 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded := TestSubStruct{}
+			if err := decoded.FromProto(tt.p); !errors.Is(err, ErrProtoOverflow) {
+				t.Errorf("FromProto() error = %v, want %v", err, ErrProtoOverflow)
+			}
+		})
+	}
+}
+
+func TestProtoGoName(t *testing.T) {
+	for name, want := range map[string]string{
+		"ss":          "Ss",
+		"sub_pointer": "SubPointer",
+		"int16":       "Int16",
+		"sha256_sum":  "Sha256Sum",
+		"uint8":       "Uint8",
+	} {
+		if got := protoGoName(name); got != want {
+			t.Errorf("protoGoName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
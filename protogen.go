@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//go:generate go run . proto -o proto/struct.proto test_struct.go test_sub_struct.go
+
+// protoMessage はGoの型から作るprotobufのmessage
+type protoMessage struct {
+	name   string
+	fields []protoMessageField
+}
+
+type protoMessageField struct {
+	goName string
+	goType ast.Expr
+	// protobufのフィールド名
+	name string
+	num  int
+	// protobufの型
+	typ      string
+	repeated bool
+	// messageの場合の型名
+	message string
+	// スカラーの場合のGoの型名
+	goScalar string
+	// *TestSubStructのようなポインタか
+	pointer bool
+	// []*TestSubStructのような要素がポインタのスライスか
+	elemPointer bool
+}
+
+// protoSchema はGoのソースから読み取った型の定義
+type protoSchema struct {
+	messages []*protoMessage
+	byName   map[string]*protoMessage
+	// TestSubStructsのようなスライスの型と要素の型
+	slices map[string]ast.Expr
+	// Timestampを使うか
+	usesTimestamp bool
+}
+
+// parseProtoSchema はGoのソースファイルから構造体の定義を読み取る
+// 構造体はmessageになり、`proto:"1"`のタグがあればフィールド番号に使う
+// スライスの型は`//structenc:proto ss=1`のコメントがあれば、その名前と番号のrepeatedフィールドを1つ持つmessageになる
+func parseProtoSchema(filenames []string) (*protoSchema, error) {
+	schema := &protoSchema{
+		byName: map[string]*protoMessage{},
+		slices: map[string]ast.Expr{},
+	}
+	fset := token.NewFileSet()
+	for _, filename := range filenames {
+		f, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				doc := ts.Doc
+				if doc == nil && len(gen.Specs) == 1 {
+					doc = gen.Doc
+				}
+				msg, err := schema.addType(ts, doc)
+				if err != nil {
+					return nil, err
+				}
+				if msg != nil {
+					schema.messages = append(schema.messages, msg)
+					schema.byName[msg.name] = msg
+				}
+			}
+		}
+	}
+
+	for _, msg := range schema.messages {
+		for i := range msg.fields {
+			if err := schema.resolveField(msg, &msg.fields[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return schema, nil
+}
+
+func (s *protoSchema) addType(ts *ast.TypeSpec, doc *ast.CommentGroup) (*protoMessage, error) {
+	switch t := ts.Type.(type) {
+	case *ast.StructType:
+		msg := &protoMessage{name: ts.Name.Name}
+		for i, field := range t.Fields.List {
+			if len(field.Names) == 0 {
+				return nil, fmt.Errorf("proto: embedded field in %s is not supported", msg.name)
+			}
+			tag := ""
+			if field.Tag != nil {
+				unquoted, err := strconv.Unquote(field.Tag.Value)
+				if err != nil {
+					return nil, err
+				}
+				tag = reflect.StructTag(unquoted).Get("proto")
+			}
+			for _, name := range field.Names {
+				if !name.IsExported() || tag == "-" {
+					continue
+				}
+				num := i + 1
+				if tag != "" {
+					n, err := strconv.Atoi(tag)
+					if err != nil {
+						return nil, fmt.Errorf("proto: invalid field number %q for %s.%s", tag, msg.name, name.Name)
+					}
+					num = n
+				}
+				msg.fields = append(msg.fields, protoMessageField{
+					goName: name.Name,
+					goType: field.Type,
+					name:   snakeCase(name.Name),
+					num:    num,
+				})
+			}
+		}
+		return msg, nil
+	case *ast.ArrayType:
+		if t.Len != nil {
+			return nil, nil
+		}
+		s.slices[ts.Name.Name] = t.Elt
+		name, num, ok, err := protoDirective(doc)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return &protoMessage{
+			name: ts.Name.Name,
+			fields: []protoMessageField{{
+				goName: ts.Name.Name,
+				goType: t,
+				name:   name,
+				num:    num,
+			}},
+		}, nil
+	}
+	return nil, nil
+}
+
+// protoDirective は`//structenc:proto ss=1`のコメントからフィールド名と番号を読み取る
+func protoDirective(doc *ast.CommentGroup) (string, int, bool, error) {
+	if doc == nil {
+		return "", 0, false, nil
+	}
+	for _, c := range doc.List {
+		value := strings.TrimPrefix(c.Text, "//structenc:proto ")
+		if value == c.Text {
+			continue
+		}
+		name, numStr, ok := strings.Cut(strings.TrimSpace(value), "=")
+		num, err := strconv.Atoi(numStr)
+		if !ok || err != nil {
+			return "", 0, false, fmt.Errorf("proto: invalid directive %s", c.Text)
+		}
+		return name, num, true, nil
+	}
+	return "", 0, false, nil
+}
+
+func (s *protoSchema) resolveField(msg *protoMessage, f *protoMessageField) error {
+	expr := f.goType
+	if arr, ok := expr.(*ast.ArrayType); ok && msg.name == f.goName {
+		// スライスの型のmessageは要素をrepeatedで持つ
+		expr = arr.Elt
+		f.repeated = true
+	}
+	for {
+		switch t := expr.(type) {
+		case *ast.StarExpr:
+			if f.repeated {
+				f.elemPointer = true
+			} else {
+				f.pointer = true
+			}
+			expr = t.X
+			continue
+		case *ast.ArrayType:
+			if t.Len != nil {
+				return fmt.Errorf("proto: array field %s.%s is not supported", msg.name, f.goName)
+			}
+			if ident, ok := t.Elt.(*ast.Ident); ok && (ident.Name == "byte" || ident.Name == "uint8") {
+				f.typ = "bytes"
+				return nil
+			}
+			if f.repeated {
+				return fmt.Errorf("proto: nested repeated field %s.%s is not supported", msg.name, f.goName)
+			}
+			f.repeated = true
+			expr = t.Elt
+			continue
+		case *ast.SelectorExpr:
+			if pkg, ok := t.X.(*ast.Ident); ok && pkg.Name == "time" && t.Sel.Name == "Time" {
+				f.typ = "google.protobuf.Timestamp"
+				f.message = f.typ
+				s.usesTimestamp = true
+				return nil
+			}
+		case *ast.Ident:
+			if typ, ok := protoScalarTypes[t.Name]; ok {
+				f.typ = typ
+				f.goScalar = t.Name
+				return nil
+			}
+			if _, ok := s.byName[t.Name]; ok {
+				f.typ = t.Name
+				f.message = t.Name
+				return nil
+			}
+			if elem, ok := s.slices[t.Name]; ok {
+				// TestSubStructsなどスライスの型は要素のrepeatedにする
+				expr = &ast.ArrayType{Elt: elem}
+				continue
+			}
+		}
+		return fmt.Errorf("proto: unsupported type for %s.%s", msg.name, f.goName)
+	}
+}
+
+// protoScalarTypes はGoの型とprotobufの型の対応
+// protobufにない幅の整数は広げる
+var protoScalarTypes = map[string]string{
+	"string":  "string",
+	"bool":    "bool",
+	"int":     "int64",
+	"int8":    "int32",
+	"int16":   "int32",
+	"int32":   "int32",
+	"int64":   "int64",
+	"uint":    "uint64",
+	"uint8":   "uint32",
+	"byte":    "uint32",
+	"uint16":  "uint32",
+	"uint32":  "uint32",
+	"uint64":  "uint64",
+	"float32": "float",
+	"float64": "double",
+}
+
+// snakeCase はSubPointerをsub_pointerのように変換する
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// orderedMessages は他から参照されないmessageから順に、参照される順で並べる
+func (s *protoSchema) orderedMessages() []*protoMessage {
+	referenced := map[string]bool{}
+	for _, msg := range s.messages {
+		for _, f := range msg.fields {
+			referenced[f.message] = true
+		}
+	}
+	var ordered []*protoMessage
+	visited := map[string]bool{}
+	var visit func(msg *protoMessage)
+	visit = func(msg *protoMessage) {
+		if visited[msg.name] {
+			return
+		}
+		visited[msg.name] = true
+		ordered = append(ordered, msg)
+		for _, f := range msg.fields {
+			if ref, ok := s.byName[f.message]; ok {
+				visit(ref)
+			}
+		}
+	}
+	for _, msg := range s.messages {
+		if !referenced[msg.name] {
+			visit(msg)
+		}
+	}
+	// 循環して参照されるmessage
+	for _, msg := range s.messages {
+		visit(msg)
+	}
+	return ordered
+}
+
+// generateProto はproto3の.protoファイルを出力する
+func generateProto(schema *protoSchema, pkg string) []byte {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "syntax = \"proto3\";\n\npackage %s;\n", pkg)
+	if schema.usesTimestamp {
+		fmt.Fprintf(buf, "\nimport \"google/protobuf/timestamp.proto\";\n")
+	}
+	for _, msg := range schema.orderedMessages() {
+		typeWidth, nameWidth := 0, 0
+		types := make([]string, len(msg.fields))
+		for i, f := range msg.fields {
+			types[i] = f.typ
+			if f.repeated {
+				types[i] = "repeated " + f.typ
+			}
+			if len(types[i]) > typeWidth {
+				typeWidth = len(types[i])
+			}
+			if len(f.name) > nameWidth {
+				nameWidth = len(f.name)
+			}
+		}
+		fmt.Fprintf(buf, "\nmessage %s {\n", msg.name)
+		for i, f := range msg.fields {
+			fmt.Fprintf(buf, "  %-*s %-*s = %d;\n", typeWidth, types[i], nameWidth, f.name, f.num)
+		}
+		fmt.Fprintf(buf, "}\n")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGenerateProtoMatchesCheckedIn(t *testing.T) {
+	schema, err := parseProtoSchema([]string{"test_struct.go", "test_sub_struct.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("proto/struct.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(want), string(generateProto(schema, "proto"))); diff != "" {
+		t.Errorf("proto/struct.proto is out of date; run go generate (-want +got):\n%s", diff)
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	for name, want := range map[string]string{
+		"Str":        "str",
+		"Int16":      "int16",
+		"SubPointer": "sub_pointer",
+		"ID":         "id",
+		"HTTPServer": "http_server",
+		"Sha256Sum":  "sha256_sum",
+	} {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
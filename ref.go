@@ -0,0 +1,58 @@
+package main
+
+import "errors"
+
+// 参照追跡モードのポインタのマーカー
+const (
+	// nil
+	RefNil = 0
+	// 初出のポインタ。直後に値が続く
+	RefNew = 1
+	// 2以上は既出のポインタへの後方参照 (ID + refBackOffset)
+	refBackOffset = 2
+)
+
+var ErrInvalidRef = errors.New("decode: invalid reference")
+
+// RefEncoder はエンコードしたポインタに初出順でIDを割り当てる
+type RefEncoder struct {
+	ids map[interface{}]uint64
+}
+
+func NewRefEncoder() *RefEncoder {
+	return &RefEncoder{ids: map[interface{}]uint64{}}
+}
+
+// Ref は初出のポインタにIDを割り当てる
+// 既出のポインタの場合は割り当て済みのIDとtrueを返す
+func (r *RefEncoder) Ref(p interface{}) (uint64, bool) {
+	if id, ok := r.ids[p]; ok {
+		return id, true
+	}
+	id := uint64(len(r.ids))
+	r.ids[p] = id
+	return id, false
+}
+
+// RefDecoder はデコードしたポインタをIDの順に保持する
+type RefDecoder struct {
+	ptrs []interface{}
+}
+
+func NewRefDecoder() *RefDecoder {
+	return &RefDecoder{}
+}
+
+// Add はデコードしたポインタに次のIDを割り当てる
+// 自己参照を解決できるように、値をデコードする前に呼ぶ
+func (r *RefDecoder) Add(p interface{}) {
+	r.ptrs = append(r.ptrs, p)
+}
+
+// Get は後方参照のマーカーが指すポインタを返す
+func (r *RefDecoder) Get(marker uint64) (interface{}, error) {
+	if marker < refBackOffset || marker-refBackOffset >= uint64(len(r.ptrs)) {
+		return nil, ErrInvalidRef
+	}
+	return r.ptrs[marker-refBackOffset], nil
+}
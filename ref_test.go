@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncodeRefSharedPointer(t *testing.T) {
+	ss := createTestStructs(3)
+	ss[2].SubPointer = ss[0].SubPointer
+
+	bs, err := ss.EncodeRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := TestStructs{}
+	n, err := decoded.DecodeRef(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(bs) {
+		t.Errorf("decoded %d bytes, want %d", n, len(bs))
+	}
+	if diff := cmp.Diff(ss, decoded); diff != "" {
+		t.Error(diff)
+	}
+	if decoded[0].SubPointer != decoded[2].SubPointer {
+		t.Error("shared SubPointer decoded as separate copies")
+	}
+	if decoded[0].SubPointer == decoded[1].SubPointer {
+		t.Error("distinct SubPointers decoded as shared")
+	}
+}
+
+func TestEncodeRefWithoutSharingMatchesEncode(t *testing.T) {
+	ss := createTestStructs(10)
+	ss[3].SubPointer = nil
+
+	want, err := ss.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ss.EncodeRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("EncodeRef output differs from Encode without shared pointers")
+	}
+}
+
+func TestTestNodeCycle(t *testing.T) {
+	a := &TestNode{Str: "a", Int: 1}
+	b := &TestNode{Str: "b", Int: -2}
+	c := &TestNode{Str: "c", Int: 3}
+	a.Next = b
+	b.Next = c
+	c.Next = a
+
+	bs, err := a.EncodeRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &TestNode{}
+	n, err := decoded.Decode(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(bs) {
+		t.Errorf("decoded %d bytes, want %d", n, len(bs))
+	}
+	got := []string{decoded.Str, decoded.Next.Str, decoded.Next.Next.Str}
+	if diff := cmp.Diff([]string{"a", "b", "c"}, got); diff != "" {
+		t.Error(diff)
+	}
+	if decoded.Next.Next.Next != decoded {
+		t.Error("cycle back to the first node was not preserved")
+	}
+}
+
+func TestDecodeRefInvalidBackReference(t *testing.T) {
+	// Str="" Int=0 Next=ID 5への後方参照
+	in := []byte{0, 0, 5 + refBackOffset}
+	decoded := &TestNode{}
+	if _, err := decoded.Decode(in); err != ErrInvalidRef {
+		t.Errorf("got %v, want %v", err, ErrInvalidRef)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+)
+
+// rpcMaxFrameLen はnet/rpcのコーデックで読み取るヘッダーと本体の長さの上限
+const rpcMaxFrameLen = 64 << 20
+
+// rpcHeader はリクエストとレスポンスのヘッダー
+// リクエストではErrorは空
+type rpcHeader struct {
+	ServiceMethod string
+	Seq           uint64
+	Error         string
+}
+
+// rpcConn はヘッダーと本体をそれぞれ長さ + バイト列のフレームで読み書きする
+// 本体は生成されたエンコードメソッドを持つ型ならそれを使い、
+// 持たない構造体はEncodeStructのLayoutFlatten、intやstringなどはリフレクションでエンコードする
+type rpcConn struct {
+	rwc io.ReadWriteCloser
+	r   *bufio.Reader
+	// mu はヘッダーと本体を1回のWriteで書くためのロック
+	mu  sync.Mutex
+	buf []byte
+	// header は最後に読んだヘッダー
+	header rpcHeader
+}
+
+func newRPCConn(conn io.ReadWriteCloser) *rpcConn {
+	return &rpcConn{rwc: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *rpcConn) write(h rpcHeader, body interface{}) error {
+	hb, err := EncodeStruct(h, LayoutFlatten)
+	if err != nil {
+		return err
+	}
+	bb, err := encodeCodec(body)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = appendUvarint(c.buf[:0], uint64(len(hb)))
+	c.buf = append(c.buf, hb...)
+	c.buf = appendUvarint(c.buf, uint64(len(bb)))
+	c.buf = append(c.buf, bb...)
+	_, err = c.rwc.Write(c.buf)
+	return err
+}
+
+// readFrame は長さ + バイト列を読み取る
+// フレームの区切りで接続が閉じた場合はio.EOFを返す
+func (c *rpcConn) readFrame() ([]byte, error) {
+	l, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if l > rpcMaxFrameLen {
+		return nil, fmt.Errorf("%w: frame length %d exceeds %d", ErrDecodeLimit, l, rpcMaxFrameLen)
+	}
+	// 長さだけ送って本体を送らない相手に上限まで確保させないように、届いた分だけバッファを伸ばす
+	frame, err := io.ReadAll(io.LimitReader(c.r, int64(l)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(frame)) < l {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return frame, nil
+}
+
+func (c *rpcConn) readHeader() error {
+	frame, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	c.header = rpcHeader{}
+	_, err = DecodeStruct(frame, &c.header, LayoutFlatten)
+	return err
+}
+
+// readBody は本体を読み取り、bodyがnilなら読み捨てる
+func (c *rpcConn) readBody(body interface{}) error {
+	frame, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+	_, err = DecodeWithOptions(frame, body, DecodeOptions{})
+	return err
+}
+
+func (c *rpcConn) Close() error {
+	return c.rwc.Close()
+}
+
+type rpcClientCodec struct {
+	*rpcConn
+}
+
+// NewRPCClientCodec はこのパッケージの形式でリクエストとレスポンスを読み書きするrpc.ClientCodecを返す
+// 引数と戻り値は生成されたメソッドを持つ型か、EncodeStructでエンコードできる構造体、
+// またはintやstring、スライスなどリフレクションでエンコードできる値
+func NewRPCClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return rpcClientCodec{newRPCConn(conn)}
+}
+
+func (c rpcClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.write(rpcHeader{ServiceMethod: r.ServiceMethod, Seq: r.Seq}, body)
+}
+
+func (c rpcClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	if err := c.readHeader(); err != nil {
+		return err
+	}
+	r.ServiceMethod = c.header.ServiceMethod
+	r.Seq = c.header.Seq
+	r.Error = c.header.Error
+	return nil
+}
+
+func (c rpcClientCodec) ReadResponseBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+type rpcServerCodec struct {
+	*rpcConn
+}
+
+// NewRPCServerCodec はNewRPCClientCodecのクライアントと通信するrpc.ServerCodecを返す
+func NewRPCServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return rpcServerCodec{newRPCConn(conn)}
+}
+
+func (c rpcServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.readHeader(); err != nil {
+		return err
+	}
+	r.ServiceMethod = c.header.ServiceMethod
+	r.Seq = c.header.Seq
+	return nil
+}
+
+func (c rpcServerCodec) ReadRequestBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c rpcServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	return c.write(rpcHeader{ServiceMethod: r.ServiceMethod, Seq: r.Seq, Error: r.Error}, body)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var errEmptyStructs = errors.New("empty TestStructs")
+
+// StructsService はnet/rpcのコーデックのテスト用のサービス
+type StructsService struct{}
+
+func (StructsService) Reverse(args TestStructs, reply *TestStructs) error {
+	if len(args) == 0 {
+		return errEmptyStructs
+	}
+	*reply = make(TestStructs, len(args))
+	for i, s := range args {
+		(*reply)[len(args)-1-i] = s
+	}
+	return nil
+}
+
+// AddArgs は生成されたメソッドを持たず、EncodeStructでエンコードする引数
+type AddArgs struct {
+	A, B int
+}
+
+type AddReply struct {
+	Sum int
+}
+
+func (StructsService) Add(args AddArgs, reply *AddReply) error {
+	reply.Sum = args.A + args.B
+	return nil
+}
+
+// Len は構造体でない引数と戻り値をリフレクションでエンコードする
+func (StructsService) Len(args string, reply *int) error {
+	*reply = len(args)
+	return nil
+}
+
+func newRPCTestClient(t *testing.T) *rpc.Client {
+	t.Helper()
+	server := rpc.NewServer()
+	if err := server.Register(StructsService{}); err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeCodec(NewRPCServerCodec(srv))
+	client := rpc.NewClientWithCodec(NewRPCClientCodec(cli))
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRPCCodec(t *testing.T) {
+	client := newRPCTestClient(t)
+
+	ss := createTestStructs(3)
+	reply := TestStructs{}
+	if err := client.Call("StructsService.Reverse", ss, &reply); err != nil {
+		t.Fatal(err)
+	}
+	want := TestStructs{ss[2], ss[1], ss[0]}
+	if diff := cmp.Diff(want, reply); diff != "" {
+		t.Error(diff)
+	}
+
+	var sum AddReply
+	if err := client.Call("StructsService.Add", AddArgs{A: 1, B: -3}, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if sum.Sum != -2 {
+		t.Errorf("Add = %d, want -2", sum.Sum)
+	}
+}
+
+func TestRPCCodecNonStruct(t *testing.T) {
+	client := newRPCTestClient(t)
+
+	var n int
+	if err := client.Call("StructsService.Len", "hello", &n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("Len = %d, want 5", n)
+	}
+}
+
+func TestRPCReadFrameShort(t *testing.T) {
+	// 上限近くの長さだけ届いても、その長さのバッファを確保しない
+	in := appendUvarint(nil, rpcMaxFrameLen)
+	in = append(in, 1, 2, 3)
+	c := newRPCConn(nopCloser{bytes.NewBuffer(in)})
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := c.readFrame()
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("readFrame error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("readFrame allocated %d bytes for a 3 byte frame", allocated)
+	}
+}
+
+// nopCloser はrpcConnのテスト用にReadWriterにCloseを足す
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestRPCCodecErrors(t *testing.T) {
+	client := newRPCTestClient(t)
+
+	reply := TestStructs{}
+	err := client.Call("StructsService.Reverse", TestStructs{}, &reply)
+	if err == nil || err.Error() != errEmptyStructs.Error() {
+		t.Errorf("Reverse(empty) error = %v, want %v", err, errEmptyStructs)
+	}
+	if err := client.Call("StructsService.Missing", TestStructs{}, &reply); err == nil {
+		t.Error("call to missing method succeeded")
+	}
+
+	// エラーの後も同じ接続で呼び出せる
+	if err := client.Call("StructsService.Reverse", createTestStructs(1), &reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRPCCodecConcurrent(t *testing.T) {
+	client := newRPCTestClient(t)
+
+	calls := make([]*rpc.Call, 10)
+	args := make([]TestStructs, len(calls))
+	for i := range calls {
+		args[i] = createTestStructs(i + 1)
+		calls[i] = client.Go("StructsService.Reverse", args[i], &TestStructs{}, nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			t.Fatal(call.Error)
+		}
+		reply := *call.Reply.(*TestStructs)
+		if len(reply) != len(args[i]) || !cmp.Equal(reply[0], args[i][len(args[i])-1]) {
+			t.Errorf("call %d returned a reply for different args", i)
+		}
+	}
+}
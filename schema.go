@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// SchemaKind はSchemaの値の種類
+type SchemaKind string
+
+const (
+	SchemaBool   SchemaKind = "bool"
+	SchemaInt    SchemaKind = "int"
+	SchemaUint   SchemaKind = "uint"
+	SchemaFloat  SchemaKind = "float"
+	SchemaString SchemaKind = "string"
+	// SchemaBytes はnil判定 + 長さ + バイト列
+	SchemaBytes SchemaKind = "bytes"
+	// SchemaTime はtime.MarshalBinaryの15バイト
+	SchemaTime SchemaKind = "time"
+	// SchemaBinary は長さ + MarshalBinaryの出力
+	SchemaBinary SchemaKind = "binary"
+	// SchemaPointer はnil判定 + Elem
+	SchemaPointer SchemaKind = "pointer"
+	// SchemaSlice はnil判定 + 要素数 + Elem
+	// 要素が構造体の場合は要素数を符号付きでエンコードする
+	SchemaSlice SchemaKind = "slice"
+	// SchemaMap はnil判定 + 要素数 + KeyとElemの組
+	SchemaMap    SchemaKind = "map"
+	SchemaStruct SchemaKind = "struct"
+)
+
+// Schema はエンコードしたバイト列をGoの型なしで読むための型の記述
+// EncodeStructのLayoutFlattenと同じレイアウトを表す
+// JSONで読み書きできるので、Goの型がない場合はファイルで渡せる
+type Schema struct {
+	Kind SchemaKind `json:"kind"`
+	// 構造体の型名
+	Name   string        `json:"name,omitempty"`
+	Fields []SchemaField `json:"fields,omitempty"`
+	Key    *Schema       `json:"key,omitempty"`
+	Elem   *Schema       `json:"elem,omitempty"`
+}
+
+// SchemaField は構造体のフィールド
+// nilになりうる埋め込みポインタは、昇格したフィールドを持つ構造体へのポインタのフィールドになる
+type SchemaField struct {
+	Name string  `json:"name"`
+	Type *Schema `json:"type"`
+	// 埋め込みポインタのフィールドか
+	// JSONでは昇格したフィールドと同じ階層に並ぶ
+	Embedded bool `json:"embedded,omitempty"`
+}
+
+var (
+	// ErrUnknownType は登録されていない型の名前を指定した場合のエラー
+	ErrUnknownType = errors.New("schema: unknown type")
+	// ErrRecursiveType は再帰する型のSchemaを作ろうとした場合のエラー
+	ErrRecursiveType = errors.New("schema: recursive type is not supported")
+)
+
+// registeredTypes はdumpなどのコマンドで名前から使える型
+var registeredTypes = map[string]reflect.Type{
+	"TestStructs":   reflect.TypeOf(TestStructs{}),
+	"TestStruct":    reflect.TypeOf(TestStruct{}),
+	"TestSubStruct": reflect.TypeOf(TestSubStruct{}),
+	"TestEnvelope":  reflect.TypeOf(TestEnvelope{}),
+	"TestOrder":     reflect.TypeOf(TestOrder{}),
+}
+
+// RegisteredTypeNames は登録されている型の名前を返す
+func RegisteredTypeNames() []string {
+	names := make([]string, 0, len(registeredTypes))
+	for name := range registeredTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupSchema は登録されている型のSchemaを返す
+func LookupSchema(name string) (*Schema, error) {
+	t, ok := registeredTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownType, name)
+	}
+	return SchemaOf(t)
+}
+
+// ReadSchema はJSONで書かれたSchemaを読み取る
+func ReadSchema(r io.Reader) (*Schema, error) {
+	s := &Schema{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return nil, err
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Schema) validate() error {
+	if s == nil {
+		return errors.New("schema: missing type")
+	}
+	switch s.Kind {
+	case SchemaBool, SchemaInt, SchemaUint, SchemaFloat, SchemaString, SchemaBytes, SchemaTime:
+		return nil
+	case SchemaBinary:
+		if s.Elem == nil {
+			return nil
+		}
+		return s.Elem.validate()
+	case SchemaPointer, SchemaSlice:
+		return s.Elem.validate()
+	case SchemaMap:
+		if err := s.Key.validate(); err != nil {
+			return err
+		}
+		return s.Elem.validate()
+	case SchemaStruct:
+		for _, f := range s.Fields {
+			if err := f.Type.validate(); err != nil {
+				return fmt.Errorf("%s.%s: %w", s.Name, f.Name, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("schema: unknown kind %q", s.Kind)
+}
+
+// SchemaOf はGoの型からSchemaを作る
+// TestStructsのようにMarshalBinaryを持つ型も、その出力のレイアウトを返す
+func SchemaOf(t reflect.Type) (*Schema, error) {
+	return schemaLayout(t, map[reflect.Type]bool{})
+}
+
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+var codecType = reflect.TypeOf((*Codec)(nil)).Elem()
+
+func schemaOf(t reflect.Type, visiting map[reflect.Type]bool) (*Schema, error) {
+	if t == timeType {
+		return &Schema{Kind: SchemaTime}, nil
+	}
+	// encodeReflectと同じく、生成されたメソッドがなくMarshalBinaryがある型は長さ + その出力になる
+	pt := reflect.PointerTo(t)
+	if !pt.Implements(codecType) && pt.Implements(binaryMarshalerType) && pt.Implements(binaryUnmarshalerType) {
+		// 出力のレイアウトがわからない型はバイト列のまま扱う
+		elem, err := schemaLayout(t, visiting)
+		if err != nil {
+			elem = nil
+		}
+		return &Schema{Kind: SchemaBinary, Elem: elem}, nil
+	}
+	return schemaLayout(t, visiting)
+}
+
+func schemaLayout(t reflect.Type, visiting map[reflect.Type]bool) (*Schema, error) {
+	if t == timeType {
+		return &Schema{Kind: SchemaTime}, nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Kind: SchemaBool}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Kind: SchemaInt}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Kind: SchemaUint}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Kind: SchemaFloat}, nil
+	case reflect.String:
+		return &Schema{Kind: SchemaString}, nil
+	case reflect.Pointer:
+		elem, err := schemaOf(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Kind: SchemaPointer, Elem: elem}, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Kind: SchemaBytes}, nil
+		}
+		elem, err := schemaOf(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Kind: SchemaSlice, Elem: elem}, nil
+	case reflect.Map:
+		key, err := schemaOf(t.Key(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		elem, err := schemaOf(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Kind: SchemaMap, Key: key, Elem: elem}, nil
+	case reflect.Struct:
+		if visiting[t] {
+			return nil, fmt.Errorf("%w: %s", ErrRecursiveType, t)
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		ops := structOps(t, LayoutFlatten)
+		fields, err := schemaFields(t, ops, visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Kind: SchemaStruct, Name: t.Name(), Fields: fields}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, t)
+}
+
+// schemaFields はfieldOpの列をフィールドにする
+// 埋め込みポインタのnil判定はskipの数の手順を持つ構造体へのポインタになる
+func schemaFields(t reflect.Type, ops []fieldOp, visiting map[reflect.Type]bool) ([]SchemaField, error) {
+	var fields []SchemaField
+	for i := 0; i < len(ops); i++ {
+		op := ops[i]
+		sf := t.FieldByIndex(op.index)
+		if op.presence {
+			elemFields, err := schemaFields(t, ops[i+1:i+1+op.skip], visiting)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, SchemaField{
+				Name:     sf.Name,
+				Type:     &Schema{Kind: SchemaPointer, Elem: &Schema{Kind: SchemaStruct, Name: sf.Type.Elem().Name(), Fields: elemFields}},
+				Embedded: true,
+			})
+			i += op.skip
+			continue
+		}
+		ft, err := schemaOf(sf.Type, visiting)
+		if err != nil {
+			return nil, err
+		}
+		// typeFieldsの名前はタグで変わる
+		fields = append(fields, SchemaField{Name: schemaFieldName(t, op.index), Type: ft})
+	}
+	return fields, nil
+}
+
+func schemaFieldName(t reflect.Type, index []int) string {
+	for _, f := range typeFields(t, LayoutFlatten) {
+		if reflect.DeepEqual(f.index, index) {
+			return f.name
+		}
+	}
+	return t.FieldByIndex(index).Name
+}
+
+// SchemaObject はSchemaでデコードした構造体
+// フィールドの順を保ってJSONにする
+type SchemaObject []SchemaObjectField
+
+type SchemaObjectField struct {
+	Name  string
+	Value interface{}
+}
+
+func (o SchemaObject) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := json.Marshal(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Get は名前のフィールドの値を返す
+func (o SchemaObject) Get(name string) (interface{}, bool) {
+	for _, f := range o {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// SchemaAnnotation はデコードした値1つのバイト列の位置
+type SchemaAnnotation struct {
+	// $[0].SubPointer.Strのような値の位置
+	Path  string
+	Start int
+	End   int
+	Value interface{}
+}
+
+// Decode はinをSchemaに従ってデコードする
+// 構造体はSchemaObject、スライスは[]interface{}、mapはmap[string]interface{}になり
+// 値はbool, int64, uint64, float64, string, []byte, time.Timeになる
+func (s *Schema) Decode(in []byte) (interface{}, int, error) {
+	d := &schemaDecoder{in: in}
+	v, err := d.decode(s, "$")
+	return v, d.n, err
+}
+
+// Annotate はDecodeと同じくデコードし、値ごとのバイト列の位置を返す
+func (s *Schema) Annotate(in []byte) ([]SchemaAnnotation, error) {
+	var annotations []SchemaAnnotation
+	d := &schemaDecoder{in: in, annotate: func(a SchemaAnnotation) {
+		annotations = append(annotations, a)
+	}}
+	_, err := d.decode(s, "$")
+	return annotations, err
+}
+
+type schemaDecoder struct {
+	in       []byte
+	n        int
+	annotate func(SchemaAnnotation)
+}
+
+func (d *schemaDecoder) emit(path string, start int, v interface{}) {
+	if d.annotate != nil {
+		d.annotate(SchemaAnnotation{Path: path, Start: start, End: d.n, Value: v})
+	}
+}
+
+func (d *schemaDecoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.in[d.n:])
+	if n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	d.n += n
+	return v, nil
+}
+
+func (d *schemaDecoder) varint() (int64, error) {
+	v, n := binary.Varint(d.in[d.n:])
+	if n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	d.n += n
+	return v, nil
+}
+
+func (d *schemaDecoder) bytes(l uint64) ([]byte, error) {
+	if l > uint64(len(d.in)-d.n) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.in[d.n : d.n+int(l)]
+	d.n += int(l)
+	return b, nil
+}
+
+// presence はnil判定を読み取り、nilでなければtrueを返す
+func (d *schemaDecoder) presence(path string) (bool, error) {
+	start := d.n
+	isNotNil, err := d.uvarint()
+	if err != nil {
+		return false, err
+	}
+	d.emit(path+" (nil?)", start, isNotNil != 0)
+	return isNotNil != 0, nil
+}
+
+// length は要素数を読み取る
+// 1要素は少なくとも1バイトなので残りのバイト数より多い要素数は不正とする
+func (d *schemaDecoder) length(path string, signed bool) (int, error) {
+	start := d.n
+	var l int64
+	if signed {
+		v, err := d.varint()
+		if err != nil {
+			return 0, err
+		}
+		l = v
+	} else {
+		v, err := d.uvarint()
+		if err != nil {
+			return 0, err
+		}
+		if v > math.MaxInt64 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		l = int64(v)
+	}
+	if l < 0 || l > int64(len(d.in)-d.n) {
+		return 0, fmt.Errorf("%s: invalid length %d: %w", path, l, io.ErrUnexpectedEOF)
+	}
+	d.emit(path+" (len)", start, l)
+	return int(l), nil
+}
+
+func (d *schemaDecoder) decode(s *Schema, path string) (interface{}, error) {
+	start := d.n
+	switch s.Kind {
+	case SchemaBool:
+		if d.n >= len(d.in) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := d.in[d.n] == 1
+		d.n += VarintLenBool
+		d.emit(path, start, v)
+		return v, nil
+	case SchemaInt:
+		v, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		d.emit(path, start, v)
+		return v, nil
+	case SchemaUint, SchemaFloat:
+		v, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if s.Kind == SchemaFloat {
+			f := math.Float64frombits(v)
+			d.emit(path, start, f)
+			return f, nil
+		}
+		d.emit(path, start, v)
+		return v, nil
+	case SchemaString, SchemaBinary:
+		l, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.bytes(l)
+		if err != nil {
+			return nil, err
+		}
+		if s.Kind == SchemaBinary {
+			if s.Elem == nil {
+				v := append([]byte{}, b...)
+				d.emit(path, start, v)
+				return v, nil
+			}
+			d.emit(path+" (len)", start, int64(l))
+			return d.decodeBinary(s.Elem, path, b)
+		}
+		d.emit(path, start, string(b))
+		return string(b), nil
+	case SchemaBytes:
+		ok, err := d.presence(path)
+		if err != nil || !ok {
+			return nil, err
+		}
+		start = d.n
+		l, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.bytes(l)
+		if err != nil {
+			return nil, err
+		}
+		v := append([]byte{}, b...)
+		d.emit(path, start, v)
+		return v, nil
+	case SchemaTime:
+		b, err := d.bytes(VarintLenTime)
+		if err != nil {
+			return nil, err
+		}
+		t := time.Time{}
+		if err := t.UnmarshalBinary(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		d.emit(path, start, t)
+		return t, nil
+	case SchemaPointer:
+		ok, err := d.presence(path)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return d.decode(s.Elem, path)
+	case SchemaSlice:
+		ok, err := d.presence(path)
+		if err != nil || !ok {
+			return nil, err
+		}
+		l, err := d.length(path, s.Elem.Kind == SchemaStruct)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]interface{}, l)
+		for i := range v {
+			if v[i], err = d.decode(s.Elem, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	case SchemaMap:
+		ok, err := d.presence(path)
+		if err != nil || !ok {
+			return nil, err
+		}
+		l, err := d.length(path, false)
+		if err != nil {
+			return nil, err
+		}
+		v := make(map[string]interface{}, l)
+		for i := 0; i < l; i++ {
+			k, err := d.decode(s.Key, fmt.Sprintf("%s.key[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			// JSONのキーにするため文字列にする
+			key := fmt.Sprint(k)
+			if v[key], err = d.decode(s.Elem, fmt.Sprintf("%s[%q]", path, key)); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	case SchemaStruct:
+		return d.appendFields(make(SchemaObject, 0, len(s.Fields)), s, path)
+	}
+	return nil, fmt.Errorf("schema: unknown kind %q", s.Kind)
+}
+
+// appendFields は構造体のフィールドをvに追加する
+// 埋め込みポインタの昇格したフィールドはencoding/jsonと同じく同じ階層に並べ、nilなら出力しない
+func (d *schemaDecoder) appendFields(v SchemaObject, s *Schema, path string) (SchemaObject, error) {
+	for _, f := range s.Fields {
+		if f.Embedded {
+			ok, err := d.presence(path + "." + f.Name)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if v, err = d.appendFields(v, f.Type.Elem, path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fv, err := d.decode(f.Type, path+"."+f.Name)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, SchemaObjectField{Name: f.Name, Value: fv})
+	}
+	return v, nil
+}
+
+// decodeBinary はMarshalBinaryの出力をElemに従ってデコードする
+// 位置は入力全体でのオフセットにする
+func (d *schemaDecoder) decodeBinary(s *Schema, path string, b []byte) (interface{}, error) {
+	offset := d.n - len(b)
+	inner := &schemaDecoder{in: b}
+	if d.annotate != nil {
+		inner.annotate = func(a SchemaAnnotation) {
+			a.Start += offset
+			a.End += offset
+			d.annotate(a)
+		}
+	}
+	v, err := inner.decode(s, path)
+	if err != nil {
+		return nil, err
+	}
+	if inner.n != len(b) {
+		return nil, fmt.Errorf("%s: %d trailing bytes", path, len(b)-inner.n)
+	}
+	return v, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSchemaDecodeMatchesJSON(t *testing.T) {
+	data := createTestStructs(10)
+	data[0].SubPointer = nil
+	data[1].Subs = nil
+
+	tests := []struct {
+		name     string
+		typeName string
+		value    interface{ Encode() ([]byte, error) }
+	}{
+		{name: "TestStructs", typeName: "TestStructs", value: data},
+		// 埋め込みポインタの昇格したフィールドは同じ階層に並び、nilなら出力しない
+		{name: "TestOrder with owner", typeName: "TestOrder", value: createTestOrder(true)},
+		{name: "TestOrder without owner", typeName: "TestOrder", value: createTestOrder(false)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := tt.value.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			schema, err := LookupSchema(tt.typeName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, n, err := schema.Decode(bs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(bs) {
+				t.Errorf("decoded %d bytes, want %d", n, len(bs))
+			}
+
+			got, err := json.Marshal(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(want), string(got)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestSchemaFile(t *testing.T) {
+	schema, err := LookupSchema("TestStructs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadSchema(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(schema, read); diff != "" {
+		t.Error(diff)
+	}
+
+	if _, err := ReadSchema(bytes.NewReader([]byte(`{"kind":"slice"}`))); err == nil {
+		t.Error("ReadSchema accepted a slice without elem")
+	}
+	if _, err := ReadSchema(bytes.NewReader([]byte(`{"kind":"int8"}`))); err == nil {
+		t.Error("ReadSchema accepted an unknown kind")
+	}
+}
+
+func TestSchemaEmbeddedPointer(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner *TestOwner
+		want  interface{}
+	}{
+		{name: "nil", owner: nil, want: nil},
+		{name: "non-nil", owner: &TestOwner{Name: "owner", Email: "owner@example.com"}, want: "owner@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := TestOrder{TestOwner: tt.owner, ID: 1, Name: "order", Amount: 2}
+			bs, err := order.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			schema, err := SchemaOf(reflect.TypeOf(order))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, _, err := schema.Decode(bs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 昇格したフィールドは埋め込みポインタの下に入れ子にしない
+			if _, ok := decoded.(SchemaObject).Get("TestOwner"); ok {
+				t.Error("embedded pointer decoded as a nested field")
+			}
+			email, _ := decoded.(SchemaObject).Get("Email")
+			if diff := cmp.Diff(tt.want, email); diff != "" {
+				t.Error(diff)
+			}
+			if name, _ := decoded.(SchemaObject).Get("Name"); name != "order" {
+				t.Errorf("Name = %v, want order", name)
+			}
+		})
+	}
+}
+
+func TestSchemaBinaryField(t *testing.T) {
+	type record struct {
+		ID testBinaryID
+		Ss TestStructs
+	}
+	data := record{ID: testBinaryID{1, 2, 3, 4}, Ss: createTestStructs(1)}
+	bs, err := EncodeStruct(data, LayoutFlatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := SchemaOf(reflect.TypeOf(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Fields[0].Type.Elem != nil {
+		t.Errorf("ID has layout %v, want opaque bytes", schema.Fields[0].Type.Elem)
+	}
+	decoded, _, err := schema.Decode(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := decoded.(SchemaObject).Get("ID"); !bytes.Equal(id.([]byte), data.ID[:]) {
+		t.Errorf("ID = %v, want %v", id, data.ID)
+	}
+	ss, _ := decoded.(SchemaObject).Get("Ss")
+	if str, _ := ss.([]interface{})[0].(SchemaObject).Get("Str"); str != data.Ss[0].Str {
+		t.Errorf("Ss[0].Str = %v, want %v", str, data.Ss[0].Str)
+	}
+}
+
+func TestSchemaAnnotateCoversInput(t *testing.T) {
+	bs, err := createTestStructs(3).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := LookupSchema("TestStructs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := schema.Annotate(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 値の位置は隙間なく入力の全体を覆う
+	offset := 0
+	for _, a := range annotations {
+		if a.Start != offset {
+			t.Fatalf("%s starts at %d, want %d", a.Path, a.Start, offset)
+		}
+		offset = a.End
+	}
+	if offset != len(bs) {
+		t.Errorf("annotations end at %d, want %d", offset, len(bs))
+	}
+}
+
+func TestSchemaTruncated(t *testing.T) {
+	bs, err := createTestStructs(2).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := LookupSchema("TestStructs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(bs); i++ {
+		if _, _, err := schema.Decode(bs[:i]); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("Decode(bs[:%d]) error = %v, want %v", i, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	if _, err := SchemaOf(reflect.TypeOf(TestNode{})); !errors.Is(err, ErrRecursiveType) {
+		t.Errorf("SchemaOf(TestNode) error = %v, want %v", err, ErrRecursiveType)
+	}
+	if _, err := LookupSchema("Unknown"); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("LookupSchema error = %v, want %v", err, ErrUnknownType)
+	}
+}
+
+func TestWriteAnnotationsWrapsLongValues(t *testing.T) {
+	in := []byte("\x00\x14abcdefghijklmnopqrst")
+	var buf bytes.Buffer
+	writeAnnotations(&buf, in, []SchemaAnnotation{{Path: "$.Str", Start: 1, End: len(in), Value: "abcdefghijklmnopqrst"}})
+	want := "00000001  14 61 62 63 64 65 66 67  $.Str = \"abcdefghijklmnopqrst\"\n" +
+		"00000009  68 69 6a 6b 6c 6d 6e 6f\n" +
+		"00000011  70 71 72 73 74\n"
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("writeAnnotations mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// 自己記述形式で値の前に付ける型タグ
+// 値の部分は位置でエンコードする形式と同じvarintなどを使う
+const (
+	TagNil    byte = iota
+	TagFalse       // 値なし
+	TagTrue        // 値なし
+	TagInt         // varint
+	TagUint        // uvarint
+	TagFloat       // math.Float64bitsのuvarint
+	TagString      // 長さ + 文字列
+	TagBytes       // 長さ + バイト列
+	TagTime        // time.MarshalBinaryの15バイト
+	TagArray       // 要素数 + 要素
+	TagMap         // 要素数 + キーと値の組
+)
+
+// FieldKey は自己記述形式で構造体のフィールドを表すキー
+type FieldKey int
+
+const (
+	// FieldKeyName はフィールド名の文字列をキーにする
+	FieldKeyName FieldKey = iota
+	// FieldKeyID はLayoutFlattenでのフィールドの位置(1から)をキーにする
+	FieldKeyID
+)
+
+// ErrInvalidTag は自己記述形式のデコードで不明な型タグを読んだ場合のエラー
+var ErrInvalidTag = errors.New("decode: invalid type tag")
+
+// selfDescribingMaxDepth は自己記述形式の配列とmapの入れ子の上限
+// 型を持たない入力は入れ子の深さだけ再帰するので、encoding/jsonと同じ深さで止める
+const selfDescribingMaxDepth = 10000
+
+// EncodeSelfDescribing はvを型タグ付きの自己記述形式でエンコードする
+// 構造体はLayoutFlattenのフィールドをキーに持つmapとしてエンコードする
+// mapのキーはエンコードしたバイト列の順に並べるので、同じ値からは同じ出力になる
+// デコードしてmapのキーに戻せない型のキーと、同じバイト列になるキーはErrUnsupportedType、
+// 自分自身を含む値はErrCyclicValueを返す
+func EncodeSelfDescribing(v interface{}, keys FieldKey) ([]byte, error) {
+	return appendSelfDescribing(nil, reflect.ValueOf(v), keys, &encodeState{})
+}
+
+// DecodeSelfDescribing はEncodeSelfDescribingの出力をGoの型なしでデコードする
+// 値はnil, bool, int64, uint64, float64, string, []byte, time.Time, []interface{}と
+// キーが全て文字列ならmap[string]interface{}、それ以外はmap[interface{}]interface{}になる
+// 配列とmapの入れ子はselfDescribingMaxDepthまでで、深い入力はErrDecodeLimitにする
+func DecodeSelfDescribing(in []byte) (interface{}, int, error) {
+	return decodeSelfDescribing(in, 0)
+}
+
+func decodeSelfDescribing(in []byte, depth int) (interface{}, int, error) {
+	if len(in) == 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	n := 1
+	switch in[0] {
+	case TagNil:
+		return nil, n, nil
+	case TagFalse:
+		return false, n, nil
+	case TagTrue:
+		return true, n, nil
+	case TagInt:
+		intRaw, intLen := binary.Varint(in[n:])
+		if intLen <= 0 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return intRaw, n + intLen, nil
+	case TagUint, TagFloat:
+		uintRaw, uintLen := binary.Uvarint(in[n:])
+		if uintLen <= 0 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		if in[0] == TagFloat {
+			return math.Float64frombits(uintRaw), n + uintLen, nil
+		}
+		return uintRaw, n + uintLen, nil
+	case TagString, TagBytes:
+		b, bLen, err := selfDescribingBytes(in[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		if in[0] == TagString {
+			return string(b), n + bLen, nil
+		}
+		return append([]byte{}, b...), n + bLen, nil
+	case TagTime:
+		if len(in[n:]) < VarintLenTime {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		t := time.Time{}
+		if err := t.UnmarshalBinary(in[n : n+VarintLenTime]); err != nil {
+			return nil, 0, err
+		}
+		return t, n + VarintLenTime, nil
+	case TagArray:
+		if depth >= selfDescribingMaxDepth {
+			return nil, 0, fmt.Errorf("%w: depth exceeds %d", ErrDecodeLimit, selfDescribingMaxDepth)
+		}
+		arrLen, arrLenLen := binary.Uvarint(in[n:])
+		// 1要素は少なくとも型タグの1バイトなので残りより多い要素数は不正
+		if arrLenLen <= 0 || arrLen > uint64(len(in)) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		n += arrLenLen
+		arr := make([]interface{}, arrLen)
+		for i := range arr {
+			elem, elemLen, err := decodeSelfDescribing(in[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			arr[i] = elem
+			n += elemLen
+		}
+		return arr, n, nil
+	case TagMap:
+		if depth >= selfDescribingMaxDepth {
+			return nil, 0, fmt.Errorf("%w: depth exceeds %d", ErrDecodeLimit, selfDescribingMaxDepth)
+		}
+		return decodeSelfDescribingMap(in, n, depth+1)
+	}
+	return nil, 0, fmt.Errorf("%w: %d", ErrInvalidTag, in[0])
+}
+
+func decodeSelfDescribingMap(in []byte, n int, depth int) (interface{}, int, error) {
+	mapLen, mapLenLen := binary.Uvarint(in[n:])
+	if mapLenLen <= 0 || mapLen > uint64(len(in)) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	n += mapLenLen
+	keys := make([]interface{}, mapLen)
+	values := make([]interface{}, mapLen)
+	stringKeys := true
+	for i := range keys {
+		k, kLen, err := decodeSelfDescribing(in[n:], depth)
+		if err != nil {
+			return nil, 0, err
+		}
+		n += kLen
+		v, vLen, err := decodeSelfDescribing(in[n:], depth)
+		if err != nil {
+			return nil, 0, err
+		}
+		n += vLen
+		if k != nil && !reflect.TypeOf(k).Comparable() {
+			return nil, 0, fmt.Errorf("%w: map key %T", ErrInvalidTag, k)
+		}
+		if _, ok := k.(string); !ok {
+			stringKeys = false
+		}
+		keys[i], values[i] = k, v
+	}
+	if stringKeys {
+		m := make(map[string]interface{}, mapLen)
+		for i, k := range keys {
+			m[k.(string)] = values[i]
+		}
+		return m, n, nil
+	}
+	m := make(map[interface{}]interface{}, mapLen)
+	for i, k := range keys {
+		m[k] = values[i]
+	}
+	return m, n, nil
+}
+
+// selfDescribingBytes は長さ + バイト列を読み取り、入力の一部をそのまま返す
+func selfDescribingBytes(in []byte) ([]byte, int, error) {
+	bLen, bLenLen := binary.Uvarint(in)
+	if bLenLen <= 0 || bLen > uint64(len(in)-bLenLen) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	n := bLenLen + int(bLen)
+	return in[bLenLen:n], n, nil
+}
+
+// selfDescribingEntry はエンコードしたmapのキーと、キーに値を続けたバイト列
+type selfDescribingEntry struct {
+	key   []byte
+	entry []byte
+}
+
+// checkSelfDescribingKey はmapのキーがDecodeSelfDescribingでmapのキーに戻せる値か確認する
+// バイト列や配列、構造体はデコードすると比較できない値になり、ポインタは指す先の値しか残らないので使えない
+func checkSelfDescribingKey(rv reflect.Value) error {
+	if rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return nil
+	case reflect.Struct:
+		if rv.Type() == timeType {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: map key %s", ErrUnsupportedType, rv.Type())
+}
+
+func appendSelfDescribing(b []byte, rv reflect.Value, keys FieldKey, e *encodeState) ([]byte, error) {
+	if !rv.IsValid() {
+		return append(b, TagNil), nil
+	}
+	if rv.Type() == timeType {
+		b = append(b, TagTime)
+		var t [VarintLenTime]byte
+		if _, err := TimeMarshalBinary(rv.Interface().(time.Time), t[:]); err != nil {
+			return nil, err
+		}
+		return append(b, t[:]...), nil
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return append(b, TagTrue), nil
+		}
+		return append(b, TagFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendVarint(append(b, TagInt), rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendUvarint(append(b, TagUint), rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return appendUvarint(append(b, TagFloat), math.Float64bits(rv.Float())), nil
+	case reflect.String:
+		b = appendUvarint(append(b, TagString), uint64(rv.Len()))
+		return append(b, rv.String()...), nil
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return append(b, TagNil), nil
+		}
+		if rv.Kind() == reflect.Pointer {
+			// 自分自身を指すポインタで再帰し続けないようにする
+			if err := e.enter(rv); err != nil {
+				return nil, err
+			}
+			defer e.leave(rv)
+		}
+		return appendSelfDescribing(b, rv.Elem(), keys, e)
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice {
+			if rv.IsNil() {
+				return append(b, TagNil), nil
+			}
+			if err := e.enter(rv); err != nil {
+				return nil, err
+			}
+			defer e.leave(rv)
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b = appendUvarint(append(b, TagBytes), uint64(rv.Len()))
+			for i := 0; i < rv.Len(); i++ {
+				b = append(b, byte(rv.Index(i).Uint()))
+			}
+			return b, nil
+		}
+		b = appendUvarint(append(b, TagArray), uint64(rv.Len()))
+		for i := 0; i < rv.Len(); i++ {
+			var err error
+			if b, err = appendSelfDescribing(b, rv.Index(i), keys, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return append(b, TagNil), nil
+		}
+		if err := e.enter(rv); err != nil {
+			return nil, err
+		}
+		defer e.leave(rv)
+		entries := make([]selfDescribingEntry, 0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			if err := checkSelfDescribingKey(iter.Key()); err != nil {
+				return nil, err
+			}
+			key, err := appendSelfDescribing(nil, iter.Key(), keys, e)
+			if err != nil {
+				return nil, err
+			}
+			entry, err := appendSelfDescribing(key, iter.Value(), keys, e)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, selfDescribingEntry{key: entry[:len(key)], entry: entry})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i].key, entries[j].key) < 0
+		})
+		// map[interface{}]のint(1)とint64(1)のように、別のキーが同じバイト列になるとデコードで1つになる
+		for i := 1; i < len(entries); i++ {
+			if bytes.Equal(entries[i-1].key, entries[i].key) {
+				return nil, fmt.Errorf("%w: map keys of %s encode to the same bytes %x", ErrUnsupportedType, rv.Type(), entries[i].key)
+			}
+		}
+		b = appendUvarint(append(b, TagMap), uint64(len(entries)))
+		for _, entry := range entries {
+			b = append(b, entry.entry...)
+		}
+		return b, nil
+	case reflect.Struct:
+		fields := typeFields(rv.Type(), LayoutFlatten)
+		b = appendUvarint(append(b, TagMap), uint64(len(fields)))
+		for i, f := range fields {
+			if keys == FieldKeyID {
+				b = appendUvarint(append(b, TagUint), uint64(i+1))
+			} else {
+				b = appendUvarint(append(b, TagString), uint64(len(f.name)))
+				b = append(b, f.name...)
+			}
+			// 埋め込みポインタがnilの場合は昇格したフィールドをnilにする
+			fv, err := rv.FieldByIndexErr(f.index)
+			if err != nil {
+				fv = reflect.Value{}
+			}
+			if b, err = appendSelfDescribing(b, fv, keys, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
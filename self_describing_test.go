@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSelfDescribingScalars(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []byte
+	}{
+		{name: "nil", value: nil, want: []byte{TagNil}},
+		{name: "true", value: true, want: []byte{TagTrue}},
+		{name: "int", value: -1, want: []byte{TagInt, 1}},
+		{name: "uint8", value: uint8(200), want: []byte{TagUint, 200, 1}},
+		{name: "string", value: "ab", want: []byte{TagString, 2, 'a', 'b'}},
+		{name: "bytes", value: []byte{1, 2}, want: []byte{TagBytes, 2, 1, 2}},
+		{name: "nil slice", value: []int(nil), want: []byte{TagNil}},
+		{name: "slice", value: []int{1, 2}, want: []byte{TagArray, 2, TagInt, 2, TagInt, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := EncodeSelfDescribing(tt.value, FieldKeyName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bs, tt.want) {
+				t.Errorf("EncodeSelfDescribing(%v) = %v, want %v", tt.value, bs, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelfDescribingTestStructs(t *testing.T) {
+	data := createTestStructs(3)
+	data[0].SubPointer = nil
+	bs, err := EncodeSelfDescribing(data, FieldKeyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, n, err := DecodeSelfDescribing(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(bs) {
+		t.Errorf("decoded %d bytes, want %d", n, len(bs))
+	}
+
+	arr, ok := decoded.([]interface{})
+	if !ok || len(arr) != len(data) {
+		t.Fatalf("decoded %T, want []interface{} of %d elements", decoded, len(data))
+	}
+	for i, s := range data {
+		m := arr[i].(map[string]interface{})
+		want := map[string]interface{}{
+			"Str":    s.Str,
+			"Bool":   s.Bool,
+			"Int":    int64(s.Int),
+			"Int16":  int64(s.Int16),
+			"Int64":  s.Int64,
+			"Uint":   uint64(s.Uint),
+			"Uint8":  uint64(s.Uint8),
+			"Uint32": uint64(s.Uint32),
+			"Time":   s.Time,
+		}
+		for k, v := range want {
+			if diff := cmp.Diff(v, m[k]); diff != "" {
+				t.Errorf("[%d].%s: %s", i, k, diff)
+			}
+		}
+		if subs := m["Subs"].([]interface{}); len(subs) != len(s.Subs) {
+			t.Errorf("[%d].Subs has %d elements, want %d", i, len(subs), len(s.Subs))
+		}
+	}
+	if sub := arr[0].(map[string]interface{})["SubPointer"]; sub != nil {
+		t.Errorf("nil SubPointer was decoded as %v", sub)
+	}
+}
+
+func TestSelfDescribingFieldIDs(t *testing.T) {
+	type record struct {
+		Name string
+		At   time.Time
+		Tags map[string]int
+	}
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	bs, err := EncodeSelfDescribing(record{Name: "test_string", At: at, Tags: map[string]int{"b": 2, "a": 1}}, FieldKeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := DecodeSelfDescribing(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[interface{}]interface{}{
+		uint64(1): "test_string",
+		uint64(2): at,
+		uint64(3): map[string]interface{}{"a": int64(1), "b": int64(2)},
+	}
+	if diff := cmp.Diff(want, decoded); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestSelfDescribingMapOrder(t *testing.T) {
+	m := map[int]string{}
+	for i := 0; i < 100; i++ {
+		m[i] = randString(5)
+	}
+	first, err := EncodeSelfDescribing(m, FieldKeyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		bs, err := EncodeSelfDescribing(m, FieldKeyName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, bs) {
+			t.Fatal("encoding the same map produced different bytes")
+		}
+	}
+}
+
+func TestSelfDescribingTruncated(t *testing.T) {
+	bs, err := EncodeSelfDescribing(createTestStructs(2), FieldKeyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(bs); i++ {
+		if _, _, err := DecodeSelfDescribing(bs[:i]); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("DecodeSelfDescribing(bs[:%d]) error = %v, want %v", i, err, io.ErrUnexpectedEOF)
+		}
+	}
+	if _, _, err := DecodeSelfDescribing([]byte{0xff}); !errors.Is(err, ErrInvalidTag) {
+		t.Errorf("DecodeSelfDescribing error = %v, want %v", err, ErrInvalidTag)
+	}
+}
+
+func TestSelfDescribingDepthLimit(t *testing.T) {
+	// 要素が1つの配列を上限より深く入れ子にする
+	var bs []byte
+	for i := 0; i <= selfDescribingMaxDepth; i++ {
+		bs = append(bs, TagArray, 1)
+	}
+	bs = append(bs, TagNil)
+	if _, _, err := DecodeSelfDescribing(bs); !errors.Is(err, ErrDecodeLimit) {
+		t.Errorf("DecodeSelfDescribing error = %v, want %v", err, ErrDecodeLimit)
+	}
+	if _, n, err := DecodeSelfDescribing(bs[2:]); err != nil || n != len(bs)-2 {
+		t.Errorf("DecodeSelfDescribing at the limit = %d, %v, want %d, nil", n, err, len(bs)-2)
+	}
+}
+
+func TestSelfDescribingUnsupportedKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		// int(1)とint64(1)はどちらもTagIntの1になる
+		{name: "colliding interface keys", value: map[interface{}]string{1: "int", int64(1): "int64"}},
+		{name: "byte array key", value: map[[2]byte]int{{1, 2}: 1}},
+		{name: "bytes in interface key", value: map[interface{}]int{[2]byte{1, 2}: 1}},
+		{name: "struct key", value: map[struct{ A int }]int{{A: 1}: 1}},
+		{name: "pointer key", value: map[*int]int{new(int): 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := EncodeSelfDescribing(tt.value, FieldKeyName); !errors.Is(err, ErrUnsupportedType) {
+				t.Errorf("EncodeSelfDescribing error = %v, want %v", err, ErrUnsupportedType)
+			}
+		})
+	}
+
+	// 型の違う同じ値でも、キーが1つなら戻せる
+	bs, err := EncodeSelfDescribing(map[interface{}]string{int8(1): "a", "b": "c", nil: "d"}, FieldKeyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := DecodeSelfDescribing(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[interface{}]interface{}{int64(1): "a", "b": "c", nil: "d"}
+	if diff := cmp.Diff(want, decoded); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestSelfDescribingCycle(t *testing.T) {
+	self := &cycleNode{V: 1}
+	self.Next = self
+	viaMap := map[string]interface{}{}
+	viaMap["self"] = viaMap
+	viaSlice := []interface{}{nil}
+	viaSlice[0] = viaSlice
+
+	for name, v := range map[string]interface{}{"pointer": self, "map": viaMap, "slice": viaSlice} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := EncodeSelfDescribing(v, FieldKeyName); !errors.Is(err, ErrCyclicValue) {
+				t.Errorf("EncodeSelfDescribing error = %v, want %v", err, ErrCyclicValue)
+			}
+		})
+	}
+}
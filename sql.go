@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+)
+
+// Blob はVをこのパッケージの形式のバイト列としてSQLの列に読み書きする
+// Vは生成されたメソッドを持つ型か、EncodeStructでエンコードできる構造体
+type Blob[T any] struct {
+	V T
+}
+
+// Value はVをエンコードしたバイト列を返す
+func (b Blob[T]) Value() (driver.Value, error) {
+	return encodeCodec(&b.V)
+}
+
+// Scan は[]byteかstringの列をVにデコードする
+// NULLはゼロ値にする
+// デコードした値はsrcを参照しないので、ドライバーがsrcを使い回しても変わらない
+func (b *Blob[T]) Scan(src interface{}) error {
+	var in []byte
+	switch src := src.(type) {
+	case []byte:
+		in = src
+	case string:
+		in = []byte(src)
+	case nil:
+		var zero T
+		b.V = zero
+		return nil
+	default:
+		return fmt.Errorf("%w: cannot scan %T into Blob", ErrUnsupportedType, src)
+	}
+
+	var v T
+	n, err := DecodeWithOptions(in, &v, DecodeOptions{})
+	if err != nil {
+		return err
+	}
+	if n != len(in) {
+		return fmt.Errorf("%w: %d bytes after offset %d", ErrTrailingBytes, len(in)-n, n)
+	}
+	b.V = v
+	return nil
+}
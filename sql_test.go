@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// blobDriver はINSERTで受け取った値を覚えておき、SELECTで返すテスト用のドライバー
+// "SELECT STRING"は[]byteの代わりにstringで返す
+type blobDriver struct {
+	mu   sync.Mutex
+	rows []driver.Value
+}
+
+var testBlobDriver = &blobDriver{}
+
+func init() {
+	sql.Register("structenc-blob", testBlobDriver)
+}
+
+func (d *blobDriver) Open(name string) (driver.Conn, error) {
+	return blobConn{d}, nil
+}
+
+type blobConn struct {
+	d *blobDriver
+}
+
+func (c blobConn) Prepare(query string) (driver.Stmt, error) {
+	return blobStmt{d: c.d, query: query}, nil
+}
+
+func (c blobConn) Close() error {
+	return nil
+}
+
+func (c blobConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type blobStmt struct {
+	d     *blobDriver
+	query string
+}
+
+func (s blobStmt) Close() error {
+	return nil
+}
+
+func (s blobStmt) NumInput() int {
+	if s.query == "INSERT" {
+		return 1
+	}
+	return 0
+}
+
+func (s blobStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.rows = append(s.d.rows, args[0])
+	return driver.RowsAffected(1), nil
+}
+
+func (s blobStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	rows := make([]driver.Value, len(s.d.rows))
+	for i, v := range s.d.rows {
+		if b, ok := v.([]byte); ok && s.query == "SELECT STRING" {
+			v = string(b)
+		}
+		rows[i] = v
+	}
+	return &blobRows{rows: rows}, nil
+}
+
+type blobRows struct {
+	rows []driver.Value
+}
+
+func (r *blobRows) Columns() []string {
+	return []string{"blob"}
+}
+
+func (r *blobRows) Close() error {
+	return nil
+}
+
+func (r *blobRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.rows[0]
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func openBlobDB(t *testing.T) *sql.DB {
+	t.Helper()
+	testBlobDriver.mu.Lock()
+	testBlobDriver.rows = nil
+	testBlobDriver.mu.Unlock()
+	db, err := sql.Open("structenc-blob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestBlobRoundTrip(t *testing.T) {
+	db := openBlobDB(t)
+	ss := createTestStructs(3)
+	if _, err := db.Exec("INSERT", Blob[TestStructs]{V: ss}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{"SELECT", "SELECT STRING"} {
+		rows, err := db.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []TestStructs
+		for rows.Next() {
+			var b Blob[TestStructs]
+			if err := rows.Scan(&b); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, b.V)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]TestStructs{ss, nil}, got); diff != "" {
+			t.Errorf("%s: %s", query, diff)
+		}
+	}
+}
+
+func TestBlobStructs(t *testing.T) {
+	db := openBlobDB(t)
+	// 生成されたメソッドを持つ構造体と、EncodeStructでエンコードする構造体
+	s := createTestStructs(1)[0]
+	if _, err := db.Exec("INSERT", Blob[TestStruct]{V: s}); err != nil {
+		t.Fatal(err)
+	}
+	var got Blob[TestStruct]
+	if err := db.QueryRow("SELECT").Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(s, got.V); diff != "" {
+		t.Error(diff)
+	}
+
+	db = openBlobDB(t)
+	plain := AddArgs{A: 1, B: -1}
+	if _, err := db.Exec("INSERT", Blob[AddArgs]{V: plain}); err != nil {
+		t.Fatal(err)
+	}
+	var gotPlain Blob[AddArgs]
+	if err := db.QueryRow("SELECT").Scan(&gotPlain); err != nil {
+		t.Fatal(err)
+	}
+	if gotPlain.V != plain {
+		t.Errorf("Scan = %+v, want %+v", gotPlain.V, plain)
+	}
+}
+
+func TestBlobScanErrors(t *testing.T) {
+	var b Blob[TestStructs]
+	if err := b.Scan(int64(1)); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Scan(int64) error = %v, want %v", err, ErrUnsupportedType)
+	}
+	bs, err := createTestStructs(1).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Scan(append(bs, 0)); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("Scan(trailing) error = %v, want %v", err, ErrTrailingBytes)
+	}
+	if err := b.Scan(bs[:len(bs)-1]); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Scan(truncated) error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,921 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout は埋め込み構造体のエンコード方法
+type Layout int
+
+const (
+	// LayoutFlatten は昇格したフィールドを埋め込んだ位置にインラインでエンコードする
+	// フィールド名の衝突はencoding/jsonと同じ規則で解決する
+	LayoutFlatten Layout = iota
+	// LayoutNested は埋め込み構造体を1つのフィールドとしてエンコードする
+	LayoutNested
+)
+
+// EncodeStruct は構造体のフィールドを宣言順にエンコードする
+// vは構造体か構造体へのポインタ
+func EncodeStruct(v interface{}, layout Layout) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer {
+		rv = rv.Elem()
+	} else {
+		// フィールドのアドレスを取れるようにコピーする
+		c := reflect.New(rv.Type()).Elem()
+		c.Set(rv)
+		rv = c
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, ErrUnsupportedType
+	}
+	e := &encodeState{}
+	out := make([]byte, sizeStruct(rv, layout, e))
+	n, err := encodeStruct(out, rv, layout, e)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// DecodeStruct はEncodeStructの出力を構造体へのポインタvにデコードする
+func DecodeStruct(in []byte, v interface{}, layout Layout) (int, error) {
+	return decodeStructPointer(in, v, layout, nil)
+}
+
+func decodeStructPointer(in []byte, v interface{}, layout Layout, d *decodeState) (int, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return 0, ErrUnsupportedType
+	}
+	rv = rv.Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	return decodeStruct(in, rv, layout, d)
+}
+
+// fieldOp は構造体のエンコードの1手順
+type fieldOp struct {
+	// 構造体からのフィールドのパス
+	index []int
+	// 埋め込みポインタのnil判定
+	presence bool
+	// presenceでnilの場合に読み飛ばす手順の数
+	skip int
+}
+
+type structOpsKey struct {
+	typ    reflect.Type
+	layout Layout
+}
+
+var structOpsCache sync.Map
+
+func structOps(t reflect.Type, layout Layout) []fieldOp {
+	key := structOpsKey{typ: t, layout: layout}
+	if ops, ok := structOpsCache.Load(key); ok {
+		return ops.([]fieldOp)
+	}
+	ops, _ := structOpsCache.LoadOrStore(key, buildFieldOps(t, typeFields(t, layout)))
+	return ops.([]fieldOp)
+}
+
+// buildFieldOps はフィールドの間に埋め込みポインタのnil判定を差し込む
+// 同じ埋め込みポインタを経由するフィールドはパスの順で連続している
+func buildFieldOps(t reflect.Type, fields []structField) []fieldOp {
+	var ops []fieldOp
+	// 開いているnil判定の手順の位置
+	var open []int
+	closeOps := func(keep func(prefix []int) bool) {
+		for len(open) > 0 && !keep(ops[open[len(open)-1]].index) {
+			pos := open[len(open)-1]
+			ops[pos].skip = len(ops) - pos - 1
+			open = open[:len(open)-1]
+		}
+	}
+
+	for _, f := range fields {
+		closeOps(func(prefix []int) bool { return hasPrefix(f.index, prefix) })
+		cur := t
+		for d := 0; d < len(f.index)-1; d++ {
+			sf := cur.Field(f.index[d])
+			cur = sf.Type
+			if cur.Kind() != reflect.Pointer {
+				continue
+			}
+			cur = cur.Elem()
+			if len(open) > 0 && len(ops[open[len(open)-1]].index) >= d+1 {
+				continue
+			}
+			open = append(open, len(ops))
+			ops = append(ops, fieldOp{index: f.index[:d+1], presence: true})
+		}
+		ops = append(ops, fieldOp{index: f.index})
+	}
+	closeOps(func([]int) bool { return false })
+	return ops
+}
+
+func hasPrefix(index, prefix []int) bool {
+	if len(prefix) > len(index) {
+		return false
+	}
+	for i := range prefix {
+		if index[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type structField struct {
+	name   string
+	index  []int
+	typ    reflect.Type
+	tagged bool
+}
+
+// typeFields はエンコードするフィールドを返す
+// LayoutFlattenではencoding/jsonと同じく、埋め込み構造体のフィールドを昇格させ
+// 浅いフィールド、同じ深さならタグ付きのフィールドを優先し、決まらない名前は除外する
+func typeFields(t reflect.Type, layout Layout) []structField {
+	current := []structField{}
+	next := []structField{{typ: t}}
+	count := map[reflect.Type]int{}
+	nextCount := map[reflect.Type]int{}
+	visited := map[reflect.Type]bool{}
+
+	var fields []structField
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count, nextCount = nextCount, map[reflect.Type]int{}
+
+		for _, f := range current {
+			if visited[f.typ] {
+				continue
+			}
+			visited[f.typ] = true
+
+			for i := 0; i < f.typ.NumField(); i++ {
+				sf := f.typ.Field(i)
+				if sf.Anonymous {
+					t := sf.Type
+					if t.Kind() == reflect.Pointer {
+						t = t.Elem()
+					}
+					if !sf.IsExported() && t.Kind() != reflect.Struct {
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+				tag := sf.Tag.Get("structenc")
+				if tag == "-" {
+					continue
+				}
+				name := tag
+				if i := strings.Index(tag, ","); i >= 0 {
+					name = tag[:i]
+				}
+				index := make([]int, len(f.index)+1)
+				copy(index, f.index)
+				index[len(f.index)] = i
+
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+
+				if layout == LayoutNested || name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct {
+					if !sf.IsExported() {
+						continue
+					}
+					tagged := name != ""
+					if name == "" {
+						name = sf.Name
+					}
+					fields = append(fields, structField{name: name, index: index, typ: sf.Type, tagged: tagged})
+					if count[f.typ] > 1 {
+						// 同じ深さに同じ型が複数埋め込まれている場合は重複させて除外されるようにする
+						fields = append(fields, fields[len(fields)-1])
+					}
+					continue
+				}
+
+				// 次の深さで埋め込み構造体を探索する
+				nextCount[ft]++
+				if nextCount[ft] == 1 {
+					next = append(next, structField{name: ft.Name(), index: index, typ: ft})
+				}
+			}
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		x := fields
+		if x[i].name != x[j].name {
+			return x[i].name < x[j].name
+		}
+		if len(x[i].index) != len(x[j].index) {
+			return len(x[i].index) < len(x[j].index)
+		}
+		if x[i].tagged != x[j].tagged {
+			return x[i].tagged
+		}
+		return indexLess(x[i].index, x[j].index)
+	})
+
+	// 名前ごとに優先するフィールドを1つ選ぶ
+	out := fields[:0]
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		fi := fields[i]
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].name != fi.name {
+				break
+			}
+		}
+		if advance == 1 {
+			out = append(out, fi)
+			continue
+		}
+		if dominant, ok := dominantField(fields[i : i+advance]); ok {
+			out = append(out, dominant)
+		}
+	}
+
+	fields = out
+	sort.Slice(fields, func(i, j int) bool {
+		return indexLess(fields[i].index, fields[j].index)
+	})
+	return fields
+}
+
+func dominantField(fields []structField) (structField, bool) {
+	// 深さとタグの順に並んでいるので、先頭と同じ優先度のフィールドが他にあれば決まらない
+	if len(fields) > 1 && len(fields[0].index) == len(fields[1].index) && fields[0].tagged == fields[1].tagged {
+		return structField{}, false
+	}
+	return fields[0], true
+}
+
+func indexLess(x, y []int) bool {
+	for k, xik := range x {
+		if k >= len(y) {
+			return false
+		}
+		if xik != y[k] {
+			return xik < y[k]
+		}
+	}
+	return len(x) < len(y)
+}
+
+// signedSliceLen はスライスの長さを符号付きでエンコードするかを返す
+// 構造体の要素はTestSubStructsなど生成されたスライスに合わせて符号付きにする
+func signedSliceLen(elem reflect.Type) bool {
+	return elem.Kind() == reflect.Struct && elem != timeType
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// zeroSizeEncoding はtの値が常に0バイトにエンコードされるか返す
+// struct{}のようにエンコードするフィールドを持たない構造体が該当し、Goでのサイズも0になる
+func zeroSizeEncoding(t reflect.Type, layout Layout) bool {
+	if t.Kind() != reflect.Struct || t == timeType {
+		return false
+	}
+	pt := reflect.PointerTo(t)
+	if pt.Implements(codecType) || (pt.Implements(binaryMarshalerType) && pt.Implements(binaryUnmarshalerType)) {
+		return false
+	}
+	for _, op := range structOps(t, layout) {
+		if op.presence || !zeroSizeEncoding(t.FieldByIndex(op.index).Type, layout) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkElemSliceLen はcheckSliceLenと同じく要素数を確認するが、
+// 要素が0バイトにエンコードされる型なら入力を読まないので残りのバイト数とは比べない
+func checkElemSliceLen(in []byte, n int, l int64, zeroSize bool) error {
+	if zeroSize {
+		if l < 0 {
+			return ErrInvalidLength
+		}
+		return nil
+	}
+	return checkSliceLen(in, n, l)
+}
+
+func sizeStruct(rv reflect.Value, layout Layout, e *encodeState) int {
+	size := 0
+	ops := structOps(rv.Type(), layout)
+	for i := 0; i < len(ops); i++ {
+		op := ops[i]
+		fv := rv.FieldByIndex(op.index)
+		if op.presence {
+			size += VarintLenPointer
+			if fv.IsNil() {
+				i += op.skip
+			}
+			continue
+		}
+		size += sizeReflect(fv, layout, e)
+	}
+	return size
+}
+
+func encodeStruct(out []byte, rv reflect.Value, layout Layout, e *encodeState) (int, error) {
+	n := 0
+	ops := structOps(rv.Type(), layout)
+	for i := 0; i < len(ops); i++ {
+		op := ops[i]
+		fv := rv.FieldByIndex(op.index)
+		if op.presence {
+			if fv.IsNil() {
+				// nilの場合は0をセットして昇格したフィールドを飛ばす
+				out[n] = 0
+				n += VarintLenPointer
+				i += op.skip
+			} else {
+				out[n] = 1
+				n += VarintLenPointer
+			}
+			continue
+		}
+		fLen, err := encodeReflect(out[n:], fv, layout, e)
+		if err != nil {
+			return 0, err
+		}
+		n += fLen
+	}
+	return n, nil
+}
+
+func decodeStruct(in []byte, rv reflect.Value, layout Layout, d *decodeState) (int, error) {
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+	n := 0
+	ops := structOps(rv.Type(), layout)
+	for i := 0; i < len(ops); i++ {
+		op := ops[i]
+		fv := rv.FieldByIndex(op.index)
+		if !fv.CanSet() {
+			return 0, ErrUnsupportedType
+		}
+		if op.presence {
+			isNotNil, isNotNilLen := binary.Uvarint(in[n:])
+			if isNotNilLen <= 0 {
+				return 0, varintErr(isNotNilLen)
+			}
+			if err := d.checkUvarint(isNotNil, isNotNilLen, 1); err != nil {
+				return 0, err
+			}
+			n += isNotNilLen
+			if isNotNil == 0 {
+				fv.Set(reflect.Zero(fv.Type()))
+				i += op.skip
+			} else if fv.IsNil() {
+				if err := d.alloc(int(fv.Type().Elem().Size())); err != nil {
+					return 0, err
+				}
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			continue
+		}
+		fLen, err := decodeReflect(in[n:], fv, layout, d)
+		if err != nil {
+			return 0, err
+		}
+		n += fLen
+	}
+	return n, nil
+}
+
+// ErrCyclicValue はポインタやスライス、mapが自分自身を含む値をエンコードしようとした場合のエラー
+var ErrCyclicValue = errors.New("encode: cyclic value")
+
+// startDetectingCyclesAfter はencoding/jsonと同じく、たどったポインタなどがこの数を超えてから循環を調べる
+// 浅い値では記録する手間をかけない
+const startDetectingCyclesAfter = 1000
+
+// encodeState はリフレクションでのエンコード中にたどっているポインタ、スライス、mapを数える
+type encodeState struct {
+	ptrLevel int
+	ptrSeen  map[encodePtr]struct{}
+}
+
+// encodePtr は値を指すポインタ
+// 構造体とその最初のフィールドは同じアドレスなので型も含め、スライスは長さも含める
+type encodePtr struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+func newEncodePtr(rv reflect.Value) encodePtr {
+	p := encodePtr{typ: rv.Type(), ptr: rv.Pointer()}
+	if rv.Kind() == reflect.Slice {
+		p.len = rv.Len()
+	}
+	return p
+}
+
+// enter はnilでないポインタ、スライス、mapの中をエンコードする前に呼ぶ
+// 今たどっている値をもう一度たどる場合はErrCyclicValueを返す
+func (e *encodeState) enter(rv reflect.Value) error {
+	e.ptrLevel++
+	if e.ptrLevel <= startDetectingCyclesAfter {
+		return nil
+	}
+	p := newEncodePtr(rv)
+	if _, ok := e.ptrSeen[p]; ok {
+		e.ptrLevel--
+		return fmt.Errorf("%w: %s", ErrCyclicValue, rv.Type())
+	}
+	if e.ptrSeen == nil {
+		e.ptrSeen = make(map[encodePtr]struct{})
+	}
+	e.ptrSeen[p] = struct{}{}
+	return nil
+}
+
+// leave はenterが成功した値の中をエンコードし終えたら呼ぶ
+func (e *encodeState) leave(rv reflect.Value) {
+	if e.ptrLevel > startDetectingCyclesAfter {
+		delete(e.ptrSeen, newEncodePtr(rv))
+	}
+	e.ptrLevel--
+}
+
+// sizeReflect はrvのエンコードに必要な最大サイズを返す
+func sizeReflect(rv reflect.Value, layout Layout, e *encodeState) int {
+	if rv.CanAddr() {
+		switch p := rv.Addr().Interface().(type) {
+		case *time.Time:
+			return VarintLenTime
+		case Codec:
+			return p.Size()
+		}
+		if m, ok := binaryMarshaler(rv); ok {
+			b, err := m.MarshalBinary()
+			if err != nil {
+				// エラーはencodeReflectで返す
+				return 0
+			}
+			return binary.MaxVarintLen64 + len(b)
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return VarintLenBool
+	case reflect.String:
+		return binary.MaxVarintLen64 + rv.Len()
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return VarintLenPointer
+		}
+		if err := e.enter(rv); err != nil {
+			// 循環はencodeReflectでエラーにする
+			return VarintLenPointer
+		}
+		defer e.leave(rv)
+		return VarintLenPointer + sizeReflect(rv.Elem(), layout, e)
+	case reflect.Slice:
+		size := VarintLenPointer + binary.MaxVarintLen64
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return size + rv.Len()
+		}
+		if err := e.enter(rv); err != nil {
+			return size
+		}
+		defer e.leave(rv)
+		for i := 0; i < rv.Len(); i++ {
+			size += sizeReflect(rv.Index(i), layout, e)
+		}
+		return size
+	case reflect.Map:
+		size := VarintLenPointer + binary.MaxVarintLen64
+		if err := e.enter(rv); err != nil {
+			return size
+		}
+		defer e.leave(rv)
+		iter := rv.MapRange()
+		for iter.Next() {
+			size += sizeReflect(addressable(iter.Key()), layout, e)
+			size += sizeReflect(addressable(iter.Value()), layout, e)
+		}
+		return size
+	case reflect.Struct:
+		return sizeStruct(rv, layout, e)
+	}
+	return binary.MaxVarintLen64
+}
+
+// encodeReflect はrvをエンコードする
+// 生成されたメソッドを持つ型はそれを使う
+func encodeReflect(out []byte, rv reflect.Value, layout Layout, e *encodeState) (int, error) {
+	if rv.CanAddr() {
+		switch p := rv.Addr().Interface().(type) {
+		case *time.Time:
+			return TimeMarshalBinary(*p, out)
+		case Codec:
+			return p.EncodeWithBytes(out)
+		}
+		if m, ok := binaryMarshaler(rv); ok {
+			// MarshalBinaryの出力を長さ + バイト列でエンコードする
+			b, err := m.MarshalBinary()
+			if err != nil {
+				return 0, err
+			}
+			n := binary.PutUvarint(out, uint64(len(b)))
+			copy(out[n:n+len(b)], b)
+			return n + len(b), nil
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.PutVarint(out, rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return binary.PutUvarint(out, rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.PutUvarint(out, math.Float64bits(rv.Float())), nil
+	case reflect.Bool:
+		if rv.Bool() {
+			out[0] = 1
+		} else {
+			out[0] = 0
+		}
+		return VarintLenBool, nil
+	case reflect.String:
+		str := rv.String()
+		n := binary.PutUvarint(out, uint64(len(str)))
+		copy(out[n:n+len(str)], str)
+		return n + len(str), nil
+	case reflect.Pointer:
+		if rv.IsNil() {
+			out[0] = 0
+			return VarintLenPointer, nil
+		}
+		if err := e.enter(rv); err != nil {
+			return 0, err
+		}
+		defer e.leave(rv)
+		out[0] = 1
+		elemLen, err := encodeReflect(out[VarintLenPointer:], rv.Elem(), layout, e)
+		if err != nil {
+			return 0, err
+		}
+		return VarintLenPointer + elemLen, nil
+	case reflect.Slice:
+		if rv.IsNil() {
+			out[0] = 0
+			return VarintLenPointer, nil
+		}
+		out[0] = 1
+		n := VarintLenPointer
+		elem := rv.Type().Elem()
+		if elem.Kind() == reflect.Uint8 {
+			// []byteを基にした型はまとめてコピーする
+			b := rv.Bytes()
+			n += binary.PutUvarint(out[n:], uint64(len(b)))
+			copy(out[n:n+len(b)], b)
+			return n + len(b), nil
+		}
+		if err := e.enter(rv); err != nil {
+			return 0, err
+		}
+		defer e.leave(rv)
+		n += putSliceLen(out[n:], rv.Len(), signedSliceLen(elem))
+		for i := 0; i < rv.Len(); i++ {
+			elemLen, err := encodeReflect(out[n:], rv.Index(i), layout, e)
+			if err != nil {
+				return 0, err
+			}
+			n += elemLen
+		}
+		return n, nil
+	case reflect.Map:
+		if rv.IsNil() {
+			out[0] = 0
+			return VarintLenPointer, nil
+		}
+		if err := e.enter(rv); err != nil {
+			return 0, err
+		}
+		defer e.leave(rv)
+		out[0] = 1
+		n := VarintLenPointer
+		n += binary.PutUvarint(out[n:], uint64(rv.Len()))
+		entries, err := sortedMapEntries(rv, layout, e)
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			n += copy(out[n:], entry.key)
+			vLen, err := encodeReflect(out[n:], addressable(entry.value), layout, e)
+			if err != nil {
+				return 0, err
+			}
+			n += vLen
+		}
+		return n, nil
+	case reflect.Struct:
+		return encodeStruct(out, rv, layout, e)
+	}
+	return 0, ErrUnsupportedType
+}
+
+// decodeReflect はアドレスを取れるrvにデコードする
+// dがnilでなければ長さと入れ子の深さをdの上限で確認する
+func decodeReflect(in []byte, rv reflect.Value, layout Layout, d *decodeState) (int, error) {
+	switch p := rv.Addr().Interface().(type) {
+	case *time.Time:
+		if err := checkLen(in, 0, VarintLenTime); err != nil {
+			return 0, err
+		}
+		if err := p.UnmarshalBinary(in[:VarintLenTime]); err != nil {
+			return 0, err
+		}
+		if err := d.checkTime(*p, in[:VarintLenTime]); err != nil {
+			return 0, err
+		}
+		return VarintLenTime, nil
+	case Codec:
+		if sd, ok := p.(stateDecoder); ok {
+			return sd.decodeWith(in, d)
+		}
+		return p.Decode(in)
+	case encoding.BinaryUnmarshaler:
+		if _, ok := binaryMarshaler(rv); ok {
+			b, n, err := decodeLenBytes(in, d)
+			if err != nil {
+				return 0, err
+			}
+			// 生成された型なら上限を引き継いでデコードする
+			if sd, ok := p.(stateDecoder); ok {
+				_, err = sd.decodeWith(b, d)
+			} else {
+				err = p.UnmarshalBinary(b)
+			}
+			if err != nil {
+				return 0, err
+			}
+			return n, nil
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		intRaw, intLen := binary.Varint(in)
+		if intLen <= 0 {
+			return 0, varintErr(intLen)
+		}
+		bits := rv.Type().Bits()
+		if err := d.checkVarint(intRaw, intLen, -1<<(bits-1), 1<<(bits-1)-1); err != nil {
+			return 0, err
+		}
+		rv.SetInt(intRaw)
+		return intLen, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		uintRaw, uintLen := binary.Uvarint(in)
+		if uintLen <= 0 {
+			return 0, varintErr(uintLen)
+		}
+		if err := d.checkUvarint(uintRaw, uintLen, math.MaxUint64>>(64-rv.Type().Bits())); err != nil {
+			return 0, err
+		}
+		rv.SetUint(uintRaw)
+		return uintLen, nil
+	case reflect.Float32, reflect.Float64:
+		floatRaw, floatLen := binary.Uvarint(in)
+		if floatLen <= 0 {
+			return 0, varintErr(floatLen)
+		}
+		if err := d.checkUvarint(floatRaw, floatLen, math.MaxUint64); err != nil {
+			return 0, err
+		}
+		// float32に丸めると再エンコードで変わる
+		if f := math.Float64frombits(floatRaw); d.strict() && rv.Kind() == reflect.Float32 && math.Float64bits(float64(float32(f))) != floatRaw {
+			return 0, fmt.Errorf("%w: %v overflows float32", ErrNonCanonical, f)
+		}
+		rv.SetFloat(math.Float64frombits(floatRaw))
+		return floatLen, nil
+	case reflect.Bool:
+		b, bLen := BoolDecode(in)
+		if bLen <= 0 {
+			return 0, varintErr(bLen)
+		}
+		if err := d.checkUvarint(uint64(in[0]), bLen, 1); err != nil {
+			return 0, err
+		}
+		rv.SetBool(b)
+		return bLen, nil
+	case reflect.String:
+		str, strLen, err := decodeLenBytes(in, d)
+		if err != nil {
+			return 0, err
+		}
+		rv.SetString(d.decodeString(rv.String(), str))
+		return strLen, nil
+	case reflect.Pointer:
+		isNotNil, isNotNilLen := binary.Uvarint(in)
+		if isNotNilLen <= 0 {
+			return 0, varintErr(isNotNilLen)
+		}
+		if err := d.checkUvarint(isNotNil, isNotNilLen, 1); err != nil {
+			return 0, err
+		}
+		if isNotNil == 0 {
+			rv.Set(reflect.Zero(rv.Type()))
+			return isNotNilLen, nil
+		}
+		if err := d.alloc(int(rv.Type().Elem().Size())); err != nil {
+			return 0, err
+		}
+		elem := reflect.New(rv.Type().Elem())
+		elemLen, err := decodeReflect(in[isNotNilLen:], elem.Elem(), layout, d)
+		if err != nil {
+			return 0, err
+		}
+		rv.Set(elem)
+		return isNotNilLen + elemLen, nil
+	case reflect.Slice:
+		elem := rv.Type().Elem()
+		if elem.Kind() == reflect.Uint8 {
+			b, bLen, err := decodeBytesWith(in, d)
+			if err != nil {
+				return 0, err
+			}
+			if b != nil {
+				b = append([]byte{}, b...)
+			}
+			rv.SetBytes(b)
+			return bLen, nil
+		}
+		n := 0
+		isNotNil, isNotNilLen := binary.Uvarint(in)
+		if isNotNilLen <= 0 {
+			return 0, varintErr(isNotNilLen)
+		}
+		if err := d.checkUvarint(isNotNil, isNotNilLen, 1); err != nil {
+			return 0, err
+		}
+		n += isNotNilLen
+		if isNotNil == 0 {
+			rv.Set(reflect.Zero(rv.Type()))
+			return n, nil
+		}
+		sliceLen, sliceLenLen := sliceLenValue(in[n:], signedSliceLen(elem))
+		if sliceLenLen <= 0 {
+			return 0, varintErr(sliceLenLen)
+		}
+		if err := d.checkSliceLen(sliceLen, sliceLenLen, signedSliceLen(elem)); err != nil {
+			return 0, err
+		}
+		n += sliceLenLen
+		zeroSize := zeroSizeEncoding(elem, layout)
+		if err := checkElemSliceLen(in, n, int64(sliceLen), zeroSize); err != nil {
+			return 0, err
+		}
+		if err := d.enter(); err != nil {
+			return 0, err
+		}
+		defer d.leave()
+		if err := d.sliceLen(sliceLen, elem.Size()); err != nil {
+			return 0, err
+		}
+		s := reflect.MakeSlice(rv.Type(), sliceLen, sliceLen)
+		if zeroSize {
+			// 要素は入力を読まずにゼロ値のままなので、長さだけのループを回さない
+			rv.Set(s)
+			return n, nil
+		}
+		for i := 0; i < sliceLen; i++ {
+			elemLen, err := decodeReflect(in[n:], s.Index(i), layout, d)
+			if err != nil {
+				return 0, err
+			}
+			n += elemLen
+		}
+		rv.Set(s)
+		return n, nil
+	case reflect.Map:
+		n := 0
+		isNotNil, isNotNilLen := binary.Uvarint(in)
+		if isNotNilLen <= 0 {
+			return 0, varintErr(isNotNilLen)
+		}
+		if err := d.checkUvarint(isNotNil, isNotNilLen, 1); err != nil {
+			return 0, err
+		}
+		n += isNotNilLen
+		if isNotNil == 0 {
+			rv.Set(reflect.Zero(rv.Type()))
+			return n, nil
+		}
+		mapLen, mapLenLen := binary.Uvarint(in[n:])
+		if mapLenLen <= 0 {
+			return 0, varintErr(mapLenLen)
+		}
+		if err := d.checkUvarint(mapLen, mapLenLen, math.MaxUint64); err != nil {
+			return 0, err
+		}
+		n += mapLenLen
+		if err := checkLen(in, n, mapLen); err != nil {
+			return 0, err
+		}
+		if err := d.enter(); err != nil {
+			return 0, err
+		}
+		defer d.leave()
+		if err := d.sliceLen(int(mapLen), rv.Type().Key().Size()+rv.Type().Elem().Size()); err != nil {
+			return 0, err
+		}
+		m := reflect.MakeMapWithSize(rv.Type(), int(mapLen))
+		var prevKey []byte
+		for i := uint64(0); i < mapLen; i++ {
+			k := reflect.New(rv.Type().Key()).Elem()
+			kLen, err := decodeReflect(in[n:], k, layout, d)
+			if err != nil {
+				return 0, err
+			}
+			// 正規形ではキーのエンコード結果が昇順に並び、重複しない
+			if d.strict() {
+				key := in[n : n+kLen]
+				if i > 0 && bytes.Compare(prevKey, key) >= 0 {
+					return 0, fmt.Errorf("%w: map key %x is not after %x", ErrNonCanonical, key, prevKey)
+				}
+				prevKey = key
+			}
+			n += kLen
+			v := reflect.New(rv.Type().Elem()).Elem()
+			vLen, err := decodeReflect(in[n:], v, layout, d)
+			if err != nil {
+				return 0, err
+			}
+			n += vLen
+			m.SetMapIndex(k, v)
+		}
+		rv.Set(m)
+		return n, nil
+	case reflect.Struct:
+		return decodeStruct(in, rv, layout, d)
+	}
+	return 0, ErrUnsupportedType
+}
+
+// mapEntry はエンコードしたキーと値の組
+type mapEntry struct {
+	key   []byte
+	value reflect.Value
+}
+
+// sortedMapEntries はmapの要素をキーのエンコード結果のバイト列の昇順で返す
+// 走査順によらず同じmapは同じバイト列にエンコードされる
+func sortedMapEntries(rv reflect.Value, layout Layout, e *encodeState) ([]mapEntry, error) {
+	entries := make([]mapEntry, 0, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		k := addressable(iter.Key())
+		key := make([]byte, sizeReflect(k, layout, e))
+		kLen, err := encodeReflect(key, k, layout, e)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, mapEntry{key: key[:kLen], value: iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	return entries, nil
+}
+
+// binaryMarshaler はMarshalBinaryとUnmarshalBinaryの両方を持つ値のMarshalerを返す
+func binaryMarshaler(rv reflect.Value) (encoding.BinaryMarshaler, bool) {
+	p := rv.Addr().Interface()
+	if _, ok := p.(encoding.BinaryUnmarshaler); !ok {
+		return nil, false
+	}
+	m, ok := p.(encoding.BinaryMarshaler)
+	return m, ok
+}
+
+// addressable はmapのキーや値などアドレスを取れない値をコピーする
+func addressable(rv reflect.Value) reflect.Value {
+	c := reflect.New(rv.Type()).Elem()
+	c.Set(rv)
+	return c
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func createTestOrder(withOwner bool) TestOrder {
+	order := TestOrder{
+		TestAudit: TestAudit{
+			CreatedBy: randString(10),
+			CreatedAt: time.Now(),
+			Version:   3,
+		},
+		ID:     12345,
+		Name:   randString(10),
+		Amount: 1000,
+	}
+	if withOwner {
+		order.TestOwner = &TestOwner{Name: "owner", Email: "owner@example.com", Version: 7}
+	}
+	return order
+}
+
+func TestEncodeStructFlattenMatchesGenerated(t *testing.T) {
+	for _, withOwner := range []bool{true, false} {
+		order := createTestOrder(withOwner)
+		want, err := order.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := EncodeStruct(order, LayoutFlatten)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("withOwner=%v: EncodeStruct = %v, want %v", withOwner, got, want)
+		}
+
+		// 隠されたフィールドと衝突したフィールドはエンコードされない
+		expected := order
+		expected.TestAudit.Version = 0
+		if expected.TestOwner != nil {
+			expected.TestOwner = &TestOwner{Email: order.Email}
+		}
+		for _, decode := range []func([]byte, *TestOrder) (int, error){
+			func(in []byte, v *TestOrder) (int, error) { return DecodeStruct(in, v, LayoutFlatten) },
+			func(in []byte, v *TestOrder) (int, error) { return v.Decode(in) },
+		} {
+			decoded := TestOrder{}
+			n, err := decode(got, &decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(got) {
+				t.Errorf("decoded %d bytes, want %d", n, len(got))
+			}
+			if diff := cmp.Diff(expected, decoded); diff != "" {
+				t.Error(diff)
+			}
+		}
+	}
+}
+
+func TestEncodeStructNested(t *testing.T) {
+	for _, withOwner := range []bool{true, false} {
+		order := createTestOrder(withOwner)
+		bs, err := EncodeStruct(&order, LayoutNested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := TestOrder{}
+		if _, err := DecodeStruct(bs, &decoded, LayoutNested); err != nil {
+			t.Fatal(err)
+		}
+		// 入れ子のレイアウトでは全てのフィールドが残る
+		if diff := cmp.Diff(order, decoded); diff != "" {
+			t.Error(diff)
+		}
+	}
+}
+
+type collisionInner struct {
+	A int
+	B int `json:"B" structenc:"B"`
+	C int
+}
+
+type CollisionPointer struct {
+	C int
+	D int
+}
+
+type collisionDeep struct {
+	collisionInner
+}
+
+type CollisionOuter struct {
+	collisionInner
+	*CollisionPointer
+	collisionDeep
+	A     int
+	Other int `json:"B2" structenc:"B2"`
+	Skip  int `json:"-" structenc:"-"`
+	skip  int
+}
+
+func TestTypeFieldsMatchesJSON(t *testing.T) {
+	v := CollisionOuter{CollisionPointer: &CollisionPointer{}}
+	js, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// encoding/jsonが出力するキーの順序
+	dec := json.NewDecoder(bytes.NewReader(js))
+	if _, err := dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key.(string))
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for _, f := range typeFields(reflect.TypeOf(v), LayoutFlatten) {
+		got = append(got, f.name)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestGenericSliceOfEmbeddingStructs(t *testing.T) {
+	type order struct {
+		TestAudit
+		ID int
+	}
+	orders := []order{{TestAudit: TestAudit{CreatedBy: "a", CreatedAt: time.Now()}, ID: 1}, {ID: 2}}
+	bs, err := EncodeSlice(orders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := DecodeSlice[order](bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(orders, decoded); diff != "" {
+		t.Error(diff)
+	}
+}
+
+// cycleNode は自分自身を指せるテスト用の型
+type cycleNode struct {
+	V    int
+	Next *cycleNode
+	Kids []cycleNode
+	Refs map[string]*cycleNode
+}
+
+func TestEncodeStructCycle(t *testing.T) {
+	self := &cycleNode{V: 1}
+	self.Next = self
+
+	viaSlice := &cycleNode{V: 2, Kids: make([]cycleNode, 1)}
+	viaSlice.Kids[0].Next = viaSlice
+
+	viaMap := &cycleNode{V: 3, Refs: map[string]*cycleNode{}}
+	viaMap.Refs["self"] = viaMap
+
+	for name, n := range map[string]*cycleNode{"pointer": self, "slice": viaSlice, "map": viaMap} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := EncodeStruct(n, LayoutFlatten); !errors.Is(err, ErrCyclicValue) {
+				t.Errorf("EncodeStruct error = %v, want %v", err, ErrCyclicValue)
+			}
+			// net/rpcなどのコーデックも同じ経路でエンコードする
+			if _, err := encodeCodec(n); !errors.Is(err, ErrCyclicValue) {
+				t.Errorf("encodeCodec error = %v, want %v", err, ErrCyclicValue)
+			}
+		})
+	}
+
+	// 循環を調べ始める深さより深くても、循環していなければエンコードできる
+	deep := &cycleNode{}
+	for i := 0; i < 2*startDetectingCyclesAfter; i++ {
+		deep = &cycleNode{V: i, Next: deep}
+	}
+	bs, err := EncodeStruct(deep, LayoutFlatten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := cycleNode{}
+	if _, err := DecodeStruct(bs, &decoded, LayoutFlatten); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(*deep, decoded); diff != "" {
+		t.Error(diff)
+	}
+}
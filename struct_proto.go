@@ -0,0 +1,221 @@
+// Code generated by structenc proto -go. DO NOT EDIT.
+
+package main
+
+import (
+	"fmt"
+
+	"encode/proto"
+
+	"github.com/gogo/protobuf/types"
+)
+
+func (ss TestStructs) ToProto() (*proto.TestStructs, error) {
+	p := &proto.TestStructs{}
+	if ss != nil {
+		p.Ss = make([]*proto.TestStruct, len(ss))
+		for i := range ss {
+			elem, err := ss[i].ToProto()
+			if err != nil {
+				return nil, err
+			}
+			p.Ss[i] = elem
+		}
+	}
+	return p, nil
+}
+
+func (ss *TestStructs) FromProto(p *proto.TestStructs) error {
+	*ss = nil
+	if p == nil || p.Ss == nil {
+		return nil
+	}
+	*ss = make(TestStructs, len(p.Ss))
+	for i := range p.Ss {
+		if err := (*ss)[i].FromProto(p.Ss[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *TestStruct) ToProto() (*proto.TestStruct, error) {
+	if s == nil {
+		return nil, nil
+	}
+	p := &proto.TestStruct{}
+	// Str
+	p.Str = s.Str
+	// Bool
+	p.Bool = s.Bool
+	// Int
+	p.Int = int64(s.Int)
+	// Int16
+	p.Int16 = int32(s.Int16)
+	// Int64
+	p.Int64 = s.Int64
+	// Uint
+	p.Uint = uint64(s.Uint)
+	// Uint8
+	p.Uint8 = uint32(s.Uint8)
+	// Uint32
+	p.Uint32 = s.Uint32
+	// Time
+	timeProto, err := types.TimestampProto(s.Time)
+	if err != nil {
+		return nil, err
+	}
+	p.Time = timeProto
+	// SubPointer
+	subPointerProto, err := s.SubPointer.ToProto()
+	if err != nil {
+		return nil, err
+	}
+	p.SubPointer = subPointerProto
+	// Subs
+	if s.Subs != nil {
+		p.Subs = make([]*proto.TestSubStruct, len(s.Subs))
+		for i := range s.Subs {
+			elem, err := s.Subs[i].ToProto()
+			if err != nil {
+				return nil, err
+			}
+			p.Subs[i] = elem
+		}
+	}
+	return p, nil
+}
+
+func (s *TestStruct) FromProto(p *proto.TestStruct) error {
+	*s = TestStruct{}
+	if p == nil {
+		return nil
+	}
+	// Str
+	s.Str = p.Str
+	// Bool
+	s.Bool = p.Bool
+	// Int
+	if int64(int(p.Int)) != p.Int {
+		return fmt.Errorf("%w: TestStruct.Int = %v", ErrProtoOverflow, p.Int)
+	}
+	s.Int = int(p.Int)
+	// Int16
+	if int32(int16(p.Int16)) != p.Int16 {
+		return fmt.Errorf("%w: TestStruct.Int16 = %v", ErrProtoOverflow, p.Int16)
+	}
+	s.Int16 = int16(p.Int16)
+	// Int64
+	s.Int64 = p.Int64
+	// Uint
+	if uint64(uint(p.Uint)) != p.Uint {
+		return fmt.Errorf("%w: TestStruct.Uint = %v", ErrProtoOverflow, p.Uint)
+	}
+	s.Uint = uint(p.Uint)
+	// Uint8
+	if uint32(uint8(p.Uint8)) != p.Uint8 {
+		return fmt.Errorf("%w: TestStruct.Uint8 = %v", ErrProtoOverflow, p.Uint8)
+	}
+	s.Uint8 = uint8(p.Uint8)
+	// Uint32
+	s.Uint32 = p.Uint32
+	// Time
+	if p.Time != nil {
+		t, err := types.TimestampFromProto(p.Time)
+		if err != nil {
+			return err
+		}
+		s.Time = t
+	}
+	// SubPointer
+	if p.SubPointer != nil {
+		s.SubPointer = &TestSubStruct{}
+		if err := s.SubPointer.FromProto(p.SubPointer); err != nil {
+			return err
+		}
+	}
+	// Subs
+	if p.Subs != nil {
+		s.Subs = make(TestSubStructs, len(p.Subs))
+		for i := range p.Subs {
+			if err := s.Subs[i].FromProto(p.Subs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *TestSubStruct) ToProto() (*proto.TestSubStruct, error) {
+	if s == nil {
+		return nil, nil
+	}
+	p := &proto.TestSubStruct{}
+	// Str
+	p.Str = s.Str
+	// Bool
+	p.Bool = s.Bool
+	// Int
+	p.Int = int64(s.Int)
+	// Int16
+	p.Int16 = int32(s.Int16)
+	// Int64
+	p.Int64 = s.Int64
+	// Uint
+	p.Uint = uint64(s.Uint)
+	// Uint8
+	p.Uint8 = uint32(s.Uint8)
+	// Uint32
+	p.Uint32 = s.Uint32
+	// Time
+	timeProto, err := types.TimestampProto(s.Time)
+	if err != nil {
+		return nil, err
+	}
+	p.Time = timeProto
+	return p, nil
+}
+
+func (s *TestSubStruct) FromProto(p *proto.TestSubStruct) error {
+	*s = TestSubStruct{}
+	if p == nil {
+		return nil
+	}
+	// Str
+	s.Str = p.Str
+	// Bool
+	s.Bool = p.Bool
+	// Int
+	if int64(int(p.Int)) != p.Int {
+		return fmt.Errorf("%w: TestSubStruct.Int = %v", ErrProtoOverflow, p.Int)
+	}
+	s.Int = int(p.Int)
+	// Int16
+	if int32(int16(p.Int16)) != p.Int16 {
+		return fmt.Errorf("%w: TestSubStruct.Int16 = %v", ErrProtoOverflow, p.Int16)
+	}
+	s.Int16 = int16(p.Int16)
+	// Int64
+	s.Int64 = p.Int64
+	// Uint
+	if uint64(uint(p.Uint)) != p.Uint {
+		return fmt.Errorf("%w: TestSubStruct.Uint = %v", ErrProtoOverflow, p.Uint)
+	}
+	s.Uint = uint(p.Uint)
+	// Uint8
+	if uint32(uint8(p.Uint8)) != p.Uint8 {
+		return fmt.Errorf("%w: TestSubStruct.Uint8 = %v", ErrProtoOverflow, p.Uint8)
+	}
+	s.Uint8 = uint8(p.Uint8)
+	// Uint32
+	s.Uint32 = p.Uint32
+	// Time
+	if p.Time != nil {
+		t, err := types.TimestampFromProto(p.Time)
+		if err != nil {
+			return err
+		}
+		s.Time = t
+	}
+	return nil
+}
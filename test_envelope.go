@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+)
+
+// TestEnvelope はペイロードをバイト列のまま運ぶ構造体
+type TestEnvelope struct {
+	Kind    string
+	Payload []byte
+	Raw     json.RawMessage
+}
+
+func (s *TestEnvelope) Size() int {
+	size := 0
+	if s == nil {
+		return 0
+	}
+
+	// Kind
+	size += binary.MaxVarintLen64
+	size += len(s.Kind)
+	// Payload
+	size += VarintLenPointer
+	size += binary.MaxVarintLen64
+	size += len(s.Payload)
+	// Raw
+	size += VarintLenPointer
+	size += binary.MaxVarintLen64
+	size += len(s.Raw)
+	return size
+}
+
+func (s TestEnvelope) EncodeWithBytes(out []byte) (int, error) {
+	n := 0
+	// Kind
+	kindSize := len(s.Kind)
+	n += binary.PutUvarint(out[n:], uint64(kindSize))
+	copy(out[n:n+kindSize], s.Kind)
+	n += kindSize
+	// Payload
+	if s.Payload == nil {
+		out[n] = 0
+		n += VarintLenPointer
+	} else {
+		out[n] = 1
+		n += VarintLenPointer
+		payloadSize := len(s.Payload)
+		n += binary.PutUvarint(out[n:], uint64(payloadSize))
+		copy(out[n:n+payloadSize], s.Payload)
+		n += payloadSize
+	}
+	// Raw
+	if s.Raw == nil {
+		out[n] = 0
+		n += VarintLenPointer
+	} else {
+		out[n] = 1
+		n += VarintLenPointer
+		rawSize := len(s.Raw)
+		n += binary.PutUvarint(out[n:], uint64(rawSize))
+		copy(out[n:n+rawSize], s.Raw)
+		n += rawSize
+	}
+
+	return n, nil
+}
+
+func (s TestEnvelope) Encode() ([]byte, error) {
+	out := make([]byte, s.Size())
+	n, err := s.EncodeWithBytes(out)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// Decode はPayloadとRawを入力からコピーする
+func (s *TestEnvelope) Decode(in []byte) (int, error) {
+	return s.decode(in, false, nil)
+}
+
+// DecodeAlias はPayloadとRawに入力の一部をそのまま使う
+// 入力を使い回す場合はDecodeを使う
+func (s *TestEnvelope) DecodeAlias(in []byte) (int, error) {
+	return s.decode(in, true, nil)
+}
+
+func (s *TestEnvelope) decodeWith(in []byte, d *decodeState) (int, error) {
+	return s.decode(in, false, d)
+}
+
+func (s *TestEnvelope) decode(in []byte, alias bool, d *decodeState) (int, error) {
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+	*s = TestEnvelope{}
+	n := 0
+
+	// Kind
+	kindLen, kindLenLen := binary.Uvarint(in)
+	if kindLenLen <= 0 {
+		return 0, varintErr(kindLenLen)
+	}
+	if err := d.checkUvarint(kindLen, kindLenLen, math.MaxUint64); err != nil {
+		return 0, err
+	}
+	n += kindLenLen
+	if err := checkLen(in, n, kindLen); err != nil {
+		return 0, err
+	}
+	if err := d.stringLen(int(kindLen)); err != nil {
+		return 0, err
+	}
+	s.Kind = d.decodeString(s.Kind, in[n:n+int(kindLen)])
+	n += int(kindLen)
+	// Payload
+	payload, payloadLen, err := decodeBytesWith(in[n:], d)
+	if err != nil {
+		return 0, err
+	}
+	s.Payload = payload
+	if !alias && payload != nil {
+		s.Payload = append([]byte{}, payload...)
+	}
+	n += payloadLen
+	// Raw
+	raw, rawLen, err := decodeBytesWith(in[n:], d)
+	if err != nil {
+		return 0, err
+	}
+	s.Raw = raw
+	if !alias && raw != nil {
+		s.Raw = append([]byte{}, raw...)
+	}
+	n += rawLen
+
+	return n, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"unsafe"
+)
+
+// TestNode は自己参照する型。循環があるため参照追跡モードでのみエンコードできる
+type TestNode struct {
+	Str  string
+	Int  int
+	Next *TestNode
+}
+
+func (s *TestNode) SizeRef(refs *RefEncoder) int {
+	size := 0
+	if s == nil {
+		return 0
+	}
+
+	// Str
+	size += binary.MaxVarintLen64
+	size += len(s.Str)
+	// Int
+	size += binary.MaxVarintLen64
+	// Next
+	size += binary.MaxVarintLen64
+	if s.Next != nil {
+		if _, ok := refs.Ref(s.Next); !ok {
+			size += s.Next.SizeRef(refs)
+		}
+	}
+	return size
+}
+
+func (s *TestNode) EncodeWithBytesRef(out []byte, refs *RefEncoder) (int, error) {
+	n := 0
+	// Str
+	strSize := len(s.Str)
+	n += binary.PutUvarint(out[n:], uint64(strSize))
+	copy(out[n:n+strSize], s.Str)
+	n += strSize
+	// Int
+	n += binary.PutVarint(out[n:], int64(s.Int))
+	// Next
+	if s.Next == nil {
+		n += binary.PutUvarint(out[n:], RefNil)
+	} else if id, ok := refs.Ref(s.Next); ok {
+		// 既出のポインタは後方参照のみ
+		n += binary.PutUvarint(out[n:], id+refBackOffset)
+	} else {
+		n += binary.PutUvarint(out[n:], RefNew)
+		nextLen, err := s.Next.EncodeWithBytesRef(out[n:], refs)
+		if err != nil {
+			return 0, err
+		}
+		n += nextLen
+	}
+
+	return n, nil
+}
+
+// EncodeRef は先頭のノードにID 0を割り当ててエンコードする
+// 先頭のノードへ戻る循環も後方参照になる
+func (s *TestNode) EncodeRef() ([]byte, error) {
+	sizeRefs := NewRefEncoder()
+	sizeRefs.Ref(s)
+	out := make([]byte, s.SizeRef(sizeRefs))
+
+	refs := NewRefEncoder()
+	refs.Ref(s)
+	n, err := s.EncodeWithBytesRef(out, refs)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+func (s *TestNode) DecodeRef(in []byte, refs *RefDecoder) (int, error) {
+	return s.decodeRef(in, refs, nil)
+}
+
+func (s *TestNode) decodeRef(in []byte, refs *RefDecoder, d *decodeState) (int, error) {
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+	*s = TestNode{}
+	n := 0
+
+	// Str
+	strLen, strLenLen := binary.Uvarint(in)
+	if strLenLen <= 0 {
+		return 0, varintErr(strLenLen)
+	}
+	if err := d.checkUvarint(strLen, strLenLen, math.MaxUint64); err != nil {
+		return 0, err
+	}
+	n += strLenLen
+	if err := checkLen(in, n, strLen); err != nil {
+		return 0, err
+	}
+	if err := d.stringLen(int(strLen)); err != nil {
+		return 0, err
+	}
+	s.Str = d.decodeString(s.Str, in[n:n+int(strLen)])
+	n += int(strLen)
+	// Int
+	intRaw, intLen := binary.Varint(in[n:])
+	if intLen <= 0 {
+		return 0, varintErr(intLen)
+	}
+	if err := d.checkVarint(intRaw, intLen, math.MinInt, math.MaxInt); err != nil {
+		return 0, err
+	}
+	s.Int = int(intRaw)
+	n += intLen
+	// Next
+	nextRef, nextRefLen := binary.Uvarint(in[n:])
+	if nextRefLen <= 0 {
+		return 0, varintErr(nextRefLen)
+	}
+	if err := d.checkUvarint(nextRef, nextRefLen, math.MaxUint64); err != nil {
+		return 0, err
+	}
+	n += nextRefLen
+	switch nextRef {
+	case RefNil:
+	case RefNew:
+		if err := d.alloc(int(unsafe.Sizeof(TestNode{}))); err != nil {
+			return 0, err
+		}
+		s.Next = &TestNode{}
+		refs.Add(s.Next)
+		nextLen, err := s.Next.decodeRef(in[n:], refs, d)
+		if err != nil {
+			return 0, err
+		}
+		n += nextLen
+	default:
+		p, err := refs.Get(nextRef)
+		if err != nil {
+			return 0, err
+		}
+		next, ok := p.(*TestNode)
+		if !ok {
+			return 0, ErrInvalidRef
+		}
+		s.Next = next
+	}
+
+	return n, nil
+}
+
+// Decode はEncodeRefの出力をデコードする
+func (s *TestNode) Decode(in []byte) (int, error) {
+	return s.decodeWith(in, nil)
+}
+
+func (s *TestNode) decodeWith(in []byte, d *decodeState) (int, error) {
+	refs := NewRefDecoder()
+	refs.Add(s)
+	return s.decodeRef(in, refs, d)
+}
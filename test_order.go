@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+	"unsafe"
+)
+
+type TestAudit struct {
+	CreatedBy string
+	CreatedAt time.Time
+	Version   int
+}
+
+type TestOwner struct {
+	Name    string
+	Email   string
+	Version int
+}
+
+// TestOrder は構造体を埋め込む
+// 昇格したフィールドのうち、NameはTestOrder.Nameに隠され
+// 同じ深さで衝突するVersionはencoding/jsonと同じく除外される
+type TestOrder struct {
+	TestAudit
+	*TestOwner
+	ID     int
+	Name   string
+	Amount uint
+}
+
+// 以下はLayoutFlattenのレイアウトでエンコードする
+
+func (s *TestOrder) Size() int {
+	size := 0
+	if s == nil {
+		return 0
+	}
+
+	// CreatedBy
+	size += binary.MaxVarintLen64
+	size += len(s.CreatedBy)
+	// CreatedAt
+	size += VarintLenTime
+	// TestOwner
+	size += VarintLenPointer
+	if s.TestOwner != nil {
+		// Email
+		size += binary.MaxVarintLen64
+		size += len(s.Email)
+	}
+	// ID
+	size += binary.MaxVarintLen64
+	// Name
+	size += binary.MaxVarintLen64
+	size += len(s.Name)
+	// Amount
+	size += binary.MaxVarintLen64
+	return size
+}
+
+func (s TestOrder) EncodeWithBytes(out []byte) (int, error) {
+	n := 0
+	// CreatedBy
+	createdBySize := len(s.CreatedBy)
+	n += binary.PutUvarint(out[n:], uint64(createdBySize))
+	copy(out[n:n+createdBySize], s.CreatedBy)
+	n += createdBySize
+	// CreatedAt
+	createdAtLen, err := TimeMarshalBinary(s.CreatedAt, out[n:])
+	if err != nil {
+		return 0, err
+	}
+	n += createdAtLen
+	// TestOwner
+	if s.TestOwner == nil {
+		out[n] = 0
+		n += VarintLenPointer
+	} else {
+		out[n] = 1
+		n += VarintLenPointer
+		// Email
+		emailSize := len(s.Email)
+		n += binary.PutUvarint(out[n:], uint64(emailSize))
+		copy(out[n:n+emailSize], s.Email)
+		n += emailSize
+	}
+	// ID
+	n += binary.PutVarint(out[n:], int64(s.ID))
+	// Name
+	nameSize := len(s.Name)
+	n += binary.PutUvarint(out[n:], uint64(nameSize))
+	copy(out[n:n+nameSize], s.Name)
+	n += nameSize
+	// Amount
+	n += binary.PutUvarint(out[n:], uint64(s.Amount))
+
+	return n, nil
+}
+
+func (s TestOrder) Encode() ([]byte, error) {
+	out := make([]byte, s.Size())
+	n, err := s.EncodeWithBytes(out)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+func (s *TestOrder) Decode(in []byte) (int, error) {
+	return s.decodeWith(in, nil)
+}
+
+func (s *TestOrder) decodeWith(in []byte, d *decodeState) (int, error) {
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+	*s = TestOrder{}
+	n := 0
+
+	// CreatedBy
+	createdByLen, createdByLenLen := binary.Uvarint(in)
+	if createdByLenLen <= 0 {
+		return 0, varintErr(createdByLenLen)
+	}
+	if err := d.checkUvarint(createdByLen, createdByLenLen, math.MaxUint64); err != nil {
+		return 0, err
+	}
+	n += createdByLenLen
+	if err := checkLen(in, n, createdByLen); err != nil {
+		return 0, err
+	}
+	if err := d.stringLen(int(createdByLen)); err != nil {
+		return 0, err
+	}
+	s.CreatedBy = d.decodeString(s.CreatedBy, in[n:n+int(createdByLen)])
+	n += int(createdByLen)
+	// CreatedAt
+	if err := checkLen(in, n, VarintLenTime); err != nil {
+		return 0, err
+	}
+	err := s.CreatedAt.UnmarshalBinary(in[n : n+VarintLenTime])
+	if err != nil {
+		return 0, err
+	}
+	if err := d.checkTime(s.CreatedAt, in[n:n+VarintLenTime]); err != nil {
+		return 0, err
+	}
+	n += VarintLenTime
+	// TestOwner
+	testOwnerIsNotNil, testOwnerIsNotNilLen := binary.Uvarint(in[n:])
+	if testOwnerIsNotNilLen <= 0 {
+		return 0, varintErr(testOwnerIsNotNilLen)
+	}
+	if err := d.checkUvarint(testOwnerIsNotNil, testOwnerIsNotNilLen, 1); err != nil {
+		return 0, err
+	}
+	n += testOwnerIsNotNilLen
+	if testOwnerIsNotNil == 1 {
+		if err := d.alloc(int(unsafe.Sizeof(TestOwner{}))); err != nil {
+			return 0, err
+		}
+		s.TestOwner = &TestOwner{}
+		// Email
+		emailLen, emailLenLen := binary.Uvarint(in[n:])
+		if emailLenLen <= 0 {
+			return 0, varintErr(emailLenLen)
+		}
+		if err := d.checkUvarint(emailLen, emailLenLen, math.MaxUint64); err != nil {
+			return 0, err
+		}
+		n += emailLenLen
+		if err := checkLen(in, n, emailLen); err != nil {
+			return 0, err
+		}
+		if err := d.stringLen(int(emailLen)); err != nil {
+			return 0, err
+		}
+		s.Email = d.decodeString(s.Email, in[n:n+int(emailLen)])
+		n += int(emailLen)
+	}
+	// ID
+	idRaw, idLen := binary.Varint(in[n:])
+	if idLen <= 0 {
+		return 0, varintErr(idLen)
+	}
+	if err := d.checkVarint(idRaw, idLen, math.MinInt, math.MaxInt); err != nil {
+		return 0, err
+	}
+	s.ID = int(idRaw)
+	n += idLen
+	// Name
+	nameLen, nameLenLen := binary.Uvarint(in[n:])
+	if nameLenLen <= 0 {
+		return 0, varintErr(nameLenLen)
+	}
+	if err := d.checkUvarint(nameLen, nameLenLen, math.MaxUint64); err != nil {
+		return 0, err
+	}
+	n += nameLenLen
+	if err := checkLen(in, n, nameLen); err != nil {
+		return 0, err
+	}
+	if err := d.stringLen(int(nameLen)); err != nil {
+		return 0, err
+	}
+	s.Name = d.decodeString(s.Name, in[n:n+int(nameLen)])
+	n += int(nameLen)
+	// Amount
+	amountRaw, amountLen := binary.Uvarint(in[n:])
+	if amountLen <= 0 {
+		return 0, varintErr(amountLen)
+	}
+	if err := d.checkUvarint(amountRaw, amountLen, math.MaxUint); err != nil {
+		return 0, err
+	}
+	s.Amount = uint(amountRaw)
+	n += amountLen
+
+	return n, nil
+}
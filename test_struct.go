@@ -2,21 +2,23 @@ package main
 
 import (
 	"encoding/binary"
+	"math"
 	"time"
+	"unsafe"
 )
 
 type TestStruct struct {
-	Str        string
-	Bool       bool
-	Int        int
-	Int16      int16
-	Int64      int64
-	Uint       uint
-	Uint8      uint8
-	Uint32     uint32
-	Time       time.Time
-	SubPointer *TestSubStruct
-	Subs       TestSubStructs
+	Str        string         `proto:"1"`
+	Bool       bool           `proto:"2"`
+	Int        int            `proto:"3"`
+	Int16      int16          `proto:"4"`
+	Int64      int64          `proto:"5"`
+	Uint       uint           `proto:"6"`
+	Uint8      uint8          `proto:"7"`
+	Uint32     uint32         `proto:"8"`
+	Time       time.Time      `proto:"9"`
+	SubPointer *TestSubStruct `proto:"10"`
+	Subs       TestSubStructs `proto:"11"`
 }
 
 func (s *TestStruct) Size() int {
@@ -52,6 +54,24 @@ func (s *TestStruct) Size() int {
 	return size
 }
 
+func (s *TestStruct) SizeRef(refs *RefEncoder) int {
+	size := 0
+	if s == nil {
+		return 0
+	}
+
+	// SubPointer以外
+	size += s.Size() - VarintLenPointer - s.SubPointer.Size()
+	// SubPointer
+	size += binary.MaxVarintLen64
+	if s.SubPointer != nil {
+		if _, ok := refs.Ref(s.SubPointer); !ok {
+			size += s.SubPointer.Size()
+		}
+	}
+	return size
+}
+
 func (s TestStruct) EncodeWithBytes(out []byte) (int, error) {
 	n := 0
 	// Str
@@ -183,62 +203,374 @@ func (s TestStruct) EncodeWithBytesTime(out []byte) (int, error) {
 	return n, nil
 }
 
+func (s TestStruct) EncodeWithBytesRef(out []byte, refs *RefEncoder) (int, error) {
+	n := 0
+	// Str
+	strSize := len(s.Str)
+	n += binary.PutUvarint(out[n:], uint64(strSize))
+	copy(out[n:n+strSize], s.Str)
+	n += strSize
+	// Bool
+	if s.Bool {
+		n += binary.PutUvarint(out[n:], uint64(1))
+	} else {
+		n += binary.PutUvarint(out[n:], uint64(0))
+	}
+	// Int
+	n += binary.PutVarint(out[n:], int64(s.Int))
+	// Int16
+	n += binary.PutVarint(out[n:], int64(s.Int16))
+	// Int64
+	n += binary.PutVarint(out[n:], s.Int64)
+	// Uint
+	n += binary.PutUvarint(out[n:], uint64(s.Uint))
+	// Uint8
+	n += binary.PutUvarint(out[n:], uint64(s.Uint8))
+	// Uint32
+	n += binary.PutUvarint(out[n:], uint64(s.Uint32))
+	// Time
+	timeBytes, err := s.Time.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	copy(out[n:n+VarintLenTime], timeBytes)
+	n += VarintLenTime
+	// SubPointer
+	if s.SubPointer == nil {
+		n += binary.PutUvarint(out[n:], RefNil)
+	} else if id, ok := refs.Ref(s.SubPointer); ok {
+		// 既出のポインタは後方参照のみ
+		n += binary.PutUvarint(out[n:], id+refBackOffset)
+	} else {
+		n += binary.PutUvarint(out[n:], RefNew)
+		subLen, err := s.SubPointer.EncodeWithBytes(out[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += subLen
+	}
+	// Subs
+	if s.Subs == nil {
+		out[n] = 0
+		n += VarintLenPointer
+	} else {
+		out[n] = 1
+		n += VarintLenPointer
+		// スライスの長さ
+		n += binary.PutVarint(out[n:], int64(len(s.Subs)))
+		for _, s := range s.Subs {
+			subLen, err := s.EncodeWithBytes(out[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += subLen
+		}
+	}
+
+	return n, nil
+}
+
 func (s *TestStruct) Decode(in []byte) (int, error) {
-	*s = TestStruct{}
+	return s.decodeWith(in, nil)
+}
+
+// DecodeInto はDecodeと同じくデコードするが、Subsの容量とSubPointerの領域を使い回す
+// 文字列はTestStructs.DecodeIntoと同じくアリーナに確保する
+func (s *TestStruct) DecodeInto(in []byte) (int, error) {
+	d := newReuseState(in)
+	return s.decodeWith(in, &d)
+}
+
+func (s *TestStruct) decodeWith(in []byte, d *decodeState) (int, error) {
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+	// 使い回す場合は全てのフィールドを上書きするので、SubsとSubPointerの領域を残すためにゼロ値にしない
+	if !d.reusing() {
+		*s = TestStruct{}
+	}
 	n := 0
 
 	// Str
 	strLen, strLenLen := binary.Uvarint(in)
+	if strLenLen <= 0 {
+		return 0, varintErr(strLenLen)
+	}
+	if err := d.checkUvarint(strLen, strLenLen, math.MaxUint64); err != nil {
+		return 0, err
+	}
 	n += strLenLen
-	s.Str = string(in[n : n+int(strLen)])
+	if err := checkLen(in, n, strLen); err != nil {
+		return 0, err
+	}
+	if err := d.stringLen(int(strLen)); err != nil {
+		return 0, err
+	}
+	s.Str = d.decodeString(s.Str, in[n:n+int(strLen)])
 	n += int(strLen)
 	// Bool
 	boolRaw, boolLen := binary.Uvarint(in[n:])
+	if boolLen <= 0 {
+		return 0, varintErr(boolLen)
+	}
+	if err := d.checkUvarint(boolRaw, boolLen, 1); err != nil {
+		return 0, err
+	}
 	s.Bool = boolRaw == 1
 	n += boolLen
 	// Int
 	intRaw, intLen := binary.Varint(in[n:])
+	if intLen <= 0 {
+		return 0, varintErr(intLen)
+	}
+	if err := d.checkVarint(intRaw, intLen, math.MinInt, math.MaxInt); err != nil {
+		return 0, err
+	}
 	s.Int = int(intRaw)
 	n += intLen
 	// Int16
 	int16Raw, int16Len := binary.Varint(in[n:])
+	if int16Len <= 0 {
+		return 0, varintErr(int16Len)
+	}
+	if err := d.checkVarint(int16Raw, int16Len, math.MinInt16, math.MaxInt16); err != nil {
+		return 0, err
+	}
 	s.Int16 = int16(int16Raw)
 	n += int16Len
 	// Int64
 	int64Raw, int64Len := binary.Varint(in[n:])
+	if int64Len <= 0 {
+		return 0, varintErr(int64Len)
+	}
+	if err := d.checkVarint(int64Raw, int64Len, math.MinInt64, math.MaxInt64); err != nil {
+		return 0, err
+	}
 	s.Int64 = int64(int64Raw)
 	n += int64Len
 	// Uint
 	uintRaw, uintLen := binary.Uvarint(in[n:])
+	if uintLen <= 0 {
+		return 0, varintErr(uintLen)
+	}
+	if err := d.checkUvarint(uintRaw, uintLen, math.MaxUint); err != nil {
+		return 0, err
+	}
 	s.Uint = uint(uintRaw)
 	n += uintLen
 	// Uint8
 	uint8Raw, uint8Len := binary.Uvarint(in[n:])
+	if uint8Len <= 0 {
+		return 0, varintErr(uint8Len)
+	}
+	if err := d.checkUvarint(uint8Raw, uint8Len, math.MaxUint8); err != nil {
+		return 0, err
+	}
 	s.Uint8 = uint8(uint8Raw)
 	n += uint8Len
 	// Uint32
 	uint32Raw, uint32Len := binary.Uvarint(in[n:])
+	if uint32Len <= 0 {
+		return 0, varintErr(uint32Len)
+	}
+	if err := d.checkUvarint(uint32Raw, uint32Len, math.MaxUint32); err != nil {
+		return 0, err
+	}
 	s.Uint32 = uint32(uint32Raw)
 	n += uint32Len
 	// Time
+	if err := checkLen(in, n, VarintLenTime); err != nil {
+		return 0, err
+	}
 	err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime])
 	if err != nil {
 		return 0, err
 	}
+	if err := d.checkTime(s.Time, in[n:n+VarintLenTime]); err != nil {
+		return 0, err
+	}
 	n += VarintLenTime
 	// SubPointer
 	subPointerIsNotNil, subPointerIsNotNilLen := binary.Uvarint(in[n:])
+	if subPointerIsNotNilLen <= 0 {
+		return 0, varintErr(subPointerIsNotNilLen)
+	}
+	if err := d.checkUvarint(subPointerIsNotNil, subPointerIsNotNilLen, 1); err != nil {
+		return 0, err
+	}
 	n += subPointerIsNotNilLen
 	if subPointerIsNotNil == 1 {
+		if s.SubPointer == nil {
+			if err := d.alloc(int(unsafe.Sizeof(TestSubStruct{}))); err != nil {
+				return 0, err
+			}
+			s.SubPointer = &TestSubStruct{}
+		}
+		subPointerLen, err := s.SubPointer.decodeWith(in[n:], d)
+		if err != nil {
+			return 0, err
+		}
+		n += subPointerLen
+	} else {
+		s.SubPointer = nil
+	}
+	// Subs
+	subsLen, err := s.Subs.decodeWith(in[n:], d)
+	if err != nil {
+		return 0, err
+	}
+	n += subsLen
+
+	return n, nil
+}
+
+func (s *TestStruct) DecodeRef(in []byte, refs *RefDecoder) (int, error) {
+	return s.decodeRef(in, refs, nil)
+}
+
+func (s *TestStruct) decodeRef(in []byte, refs *RefDecoder, d *decodeState) (int, error) {
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+	*s = TestStruct{}
+	n := 0
+
+	// Str
+	strLen, strLenLen := binary.Uvarint(in)
+	if strLenLen <= 0 {
+		return 0, varintErr(strLenLen)
+	}
+	if err := d.checkUvarint(strLen, strLenLen, math.MaxUint64); err != nil {
+		return 0, err
+	}
+	n += strLenLen
+	if err := checkLen(in, n, strLen); err != nil {
+		return 0, err
+	}
+	if err := d.stringLen(int(strLen)); err != nil {
+		return 0, err
+	}
+	s.Str = d.decodeString(s.Str, in[n:n+int(strLen)])
+	n += int(strLen)
+	// Bool
+	boolRaw, boolLen := binary.Uvarint(in[n:])
+	if boolLen <= 0 {
+		return 0, varintErr(boolLen)
+	}
+	if err := d.checkUvarint(boolRaw, boolLen, 1); err != nil {
+		return 0, err
+	}
+	s.Bool = boolRaw == 1
+	n += boolLen
+	// Int
+	intRaw, intLen := binary.Varint(in[n:])
+	if intLen <= 0 {
+		return 0, varintErr(intLen)
+	}
+	if err := d.checkVarint(intRaw, intLen, math.MinInt, math.MaxInt); err != nil {
+		return 0, err
+	}
+	s.Int = int(intRaw)
+	n += intLen
+	// Int16
+	int16Raw, int16Len := binary.Varint(in[n:])
+	if int16Len <= 0 {
+		return 0, varintErr(int16Len)
+	}
+	if err := d.checkVarint(int16Raw, int16Len, math.MinInt16, math.MaxInt16); err != nil {
+		return 0, err
+	}
+	s.Int16 = int16(int16Raw)
+	n += int16Len
+	// Int64
+	int64Raw, int64Len := binary.Varint(in[n:])
+	if int64Len <= 0 {
+		return 0, varintErr(int64Len)
+	}
+	if err := d.checkVarint(int64Raw, int64Len, math.MinInt64, math.MaxInt64); err != nil {
+		return 0, err
+	}
+	s.Int64 = int64(int64Raw)
+	n += int64Len
+	// Uint
+	uintRaw, uintLen := binary.Uvarint(in[n:])
+	if uintLen <= 0 {
+		return 0, varintErr(uintLen)
+	}
+	if err := d.checkUvarint(uintRaw, uintLen, math.MaxUint); err != nil {
+		return 0, err
+	}
+	s.Uint = uint(uintRaw)
+	n += uintLen
+	// Uint8
+	uint8Raw, uint8Len := binary.Uvarint(in[n:])
+	if uint8Len <= 0 {
+		return 0, varintErr(uint8Len)
+	}
+	if err := d.checkUvarint(uint8Raw, uint8Len, math.MaxUint8); err != nil {
+		return 0, err
+	}
+	s.Uint8 = uint8(uint8Raw)
+	n += uint8Len
+	// Uint32
+	uint32Raw, uint32Len := binary.Uvarint(in[n:])
+	if uint32Len <= 0 {
+		return 0, varintErr(uint32Len)
+	}
+	if err := d.checkUvarint(uint32Raw, uint32Len, math.MaxUint32); err != nil {
+		return 0, err
+	}
+	s.Uint32 = uint32(uint32Raw)
+	n += uint32Len
+	// Time
+	if err := checkLen(in, n, VarintLenTime); err != nil {
+		return 0, err
+	}
+	err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime])
+	if err != nil {
+		return 0, err
+	}
+	if err := d.checkTime(s.Time, in[n:n+VarintLenTime]); err != nil {
+		return 0, err
+	}
+	n += VarintLenTime
+	// SubPointer
+	subPointerRef, subPointerRefLen := binary.Uvarint(in[n:])
+	if subPointerRefLen <= 0 {
+		return 0, varintErr(subPointerRefLen)
+	}
+	if err := d.checkUvarint(subPointerRef, subPointerRefLen, math.MaxUint64); err != nil {
+		return 0, err
+	}
+	n += subPointerRefLen
+	switch subPointerRef {
+	case RefNil:
+	case RefNew:
+		if err := d.alloc(int(unsafe.Sizeof(TestSubStruct{}))); err != nil {
+			return 0, err
+		}
 		s.SubPointer = &TestSubStruct{}
-		subPointerLen, err := s.SubPointer.Decode(in[n:])
+		refs.Add(s.SubPointer)
+		subPointerLen, err := s.SubPointer.decodeWith(in[n:], d)
 		if err != nil {
 			return 0, err
 		}
 		n += subPointerLen
+	default:
+		p, err := refs.Get(subPointerRef)
+		if err != nil {
+			return 0, err
+		}
+		sub, ok := p.(*TestSubStruct)
+		if !ok {
+			return 0, ErrInvalidRef
+		}
+		s.SubPointer = sub
 	}
 	// Subs
-	subsLen, err := s.Subs.Decode(in[n:])
+	subsLen, err := s.Subs.decodeWith(in[n:], d)
 	if err != nil {
 		return 0, err
 	}
@@ -247,6 +579,21 @@ func (s *TestStruct) Decode(in []byte) (int, error) {
 	return n, nil
 }
 
+func (s TestStruct) MarshalBinary() ([]byte, error) {
+	out := make([]byte, s.Size())
+	n, err := s.EncodeWithBytes(out)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+func (s *TestStruct) UnmarshalBinary(data []byte) error {
+	_, err := s.Decode(data)
+	return err
+}
+
+//structenc:proto ss=1
 type TestStructs []TestStruct
 
 func (ss TestStructs) Encode() ([]byte, error) {
@@ -312,8 +659,34 @@ func (ss TestStructs) EncodeTime() ([]byte, error) {
 }
 
 func (ss *TestStructs) Decode(in []byte) (int, error) {
+	return ss.decodeWith(in, nil)
+}
+
+// DecodeInto はDecodeと同じくデコードするが、ssの容量と各要素のSubsとSubPointerを使い回す
+// 前にデコードした値を参照し続けている場合は上書きされるのでDecodeを使う
+// 前の値と同じ文字列はそのまま残し、変わった文字列はStringArenaと同じく1つの領域にまとめて確保する
+// そのため入力が毎回変わっても割り当ては1回あたり1回で済むが、
+// 文字列を1つでも残していると、その呼び出しのアリーナ全体が解放されない
+func (ss *TestStructs) DecodeInto(in []byte) (int, error) {
+	d := newReuseState(in)
+	return ss.decodeWith(in, &d)
+}
+
+// Reset は容量を残して長さを0にする
+// 続けてDecodeIntoを呼ぶと容量の範囲にある要素の領域を使い回す
+func (ss *TestStructs) Reset() {
+	*ss = (*ss)[:0]
+}
+
+func (ss *TestStructs) decodeWith(in []byte, d *decodeState) (int, error) {
 	n := 0
 	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return 0, varintErr(isNotNilLen)
+	}
+	if err := d.checkUvarint(isNotNil, isNotNilLen, 1); err != nil {
+		return 0, err
+	}
 	if isNotNil == 0 {
 		*ss = nil
 		return isNotNilLen, nil
@@ -321,15 +694,1403 @@ func (ss *TestStructs) Decode(in []byte) (int, error) {
 	n += isNotNilLen
 
 	ssLen, ssLenLen := binary.Varint(in[n:])
+	if ssLenLen <= 0 {
+		return 0, varintErr(ssLenLen)
+	}
+	if err := d.checkVarint(ssLen, ssLenLen, math.MinInt64, math.MaxInt64); err != nil {
+		return 0, err
+	}
 	n += ssLenLen
+	if err := checkSliceLen(in, n, ssLen); err != nil {
+		return 0, err
+	}
 	ssLenInt := int(ssLen)
-	*ss = make(TestStructs, ssLenInt)
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+	if err := d.sliceLen(ssLenInt, unsafe.Sizeof(TestStruct{})); err != nil {
+		return 0, err
+	}
+	if d.reusing() && cap(*ss) >= ssLenInt {
+		*ss = (*ss)[:ssLenInt]
+	} else {
+		*ss = make(TestStructs, ssLenInt)
+	}
 	for i := 0; i < ssLenInt; i++ {
-		sLen, err := (*ss)[i].Decode(in[n:])
+		sLen, err := (*ss)[i].decodeWith(in[n:], d)
 		if err != nil {
-			return 0, nil
+			return 0, err
 		}
 		n += sLen
 	}
 	return n, nil
 }
+
+func (ss TestStructs) MarshalBinary() ([]byte, error) {
+	return ss.Encode()
+}
+
+func (ss *TestStructs) UnmarshalBinary(data []byte) error {
+	_, err := ss.Decode(data)
+	return err
+}
+
+// EncodeRef は同じTestSubStructを指すSubPointerを後方参照としてエンコードする
+// 共有されたポインタがなければEncodeと同じバイト列になる
+func (ss TestStructs) EncodeRef() ([]byte, error) {
+	size := VarintLenPointer
+
+	if ss == nil {
+		// nil
+		return []byte{0}, nil
+	}
+
+	size += binary.MaxVarintLen64
+	ssLen := len(ss)
+	sizeRefs := NewRefEncoder()
+	for _, s := range ss {
+		size += s.SizeRef(sizeRefs)
+	}
+
+	out := make([]byte, size)
+	n := 0
+	// nilでない
+	n += binary.PutUvarint(out[n:], uint64(1))
+	// スライスの長さ
+	n += binary.PutVarint(out[n:], int64(ssLen))
+	refs := NewRefEncoder()
+	for _, s := range ss {
+		bytesLen, err := s.EncodeWithBytesRef(out[n:], refs)
+		if err != nil {
+			return nil, err
+		}
+		n += bytesLen
+	}
+
+	return out[:n], nil
+}
+
+func (ss *TestStructs) DecodeRef(in []byte) (int, error) {
+	return ss.decodeRef(in, nil)
+}
+
+// DecodeRefWithOptions はDecodeRefと同じくデコードするが、DecodeWithOptionsと同じくoptsの上限を確認する
+func (ss *TestStructs) DecodeRefWithOptions(in []byte, opts DecodeOptions) (int, error) {
+	d := &decodeState{opts: opts, arenaSize: len(in)}
+	n, err := ss.decodeRef(in, d)
+	if err != nil {
+		return 0, err
+	}
+	return n, d.checkTrailing(in, n)
+}
+
+func (ss *TestStructs) decodeRef(in []byte, d *decodeState) (int, error) {
+	n := 0
+	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return 0, varintErr(isNotNilLen)
+	}
+	if err := d.checkUvarint(isNotNil, isNotNilLen, 1); err != nil {
+		return 0, err
+	}
+	if isNotNil == 0 {
+		*ss = nil
+		return isNotNilLen, nil
+	}
+	n += isNotNilLen
+
+	ssLen, ssLenLen := binary.Varint(in[n:])
+	if ssLenLen <= 0 {
+		return 0, varintErr(ssLenLen)
+	}
+	if err := d.checkVarint(ssLen, ssLenLen, math.MinInt64, math.MaxInt64); err != nil {
+		return 0, err
+	}
+	n += ssLenLen
+	if err := checkSliceLen(in, n, ssLen); err != nil {
+		return 0, err
+	}
+	ssLenInt := int(ssLen)
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+	if err := d.sliceLen(ssLenInt, unsafe.Sizeof(TestStruct{})); err != nil {
+		return 0, err
+	}
+	*ss = make(TestStructs, ssLenInt)
+	refs := NewRefDecoder()
+	for i := 0; i < ssLenInt; i++ {
+		sLen, err := (*ss)[i].decodeRef(in[n:], refs, d)
+		if err != nil {
+			return 0, err
+		}
+		n += sLen
+	}
+	return n, nil
+}
+
+// SizeFixed は整数を固定長でエンコードしたときの正確なサイズを返す
+func (s *TestStruct) SizeFixed() int {
+	size := 0
+	if s == nil {
+		return 0
+	}
+
+	// Str
+	size += uvarintLen(uint64(len(s.Str)))
+	size += len(s.Str)
+	// Bool
+	size += VarintLenBool
+	// Int
+	size += FixedLen64
+	// Int16
+	size += FixedLen16
+	// Int64
+	size += FixedLen64
+	// Uint
+	size += FixedLen64
+	// Uint8
+	size += FixedLen8
+	// Uint32
+	size += FixedLen32
+	// Time
+	size += VarintLenTime
+	// SubPointer
+	size += VarintLenPointer
+	size += s.SubPointer.SizeFixed()
+	// Subs
+	size += s.Subs.SizeFixed()
+	return size
+}
+
+// EncodeWithBytesFixed は整数をリトルエンディアンの固定長でエンコードする
+// 文字列とスライスの長さ、nil判定、Timeはvarintのモードと同じ
+func (s TestStruct) EncodeWithBytesFixed(out []byte) (int, error) {
+	n := 0
+	// Str
+	strSize := len(s.Str)
+	n += binary.PutUvarint(out[n:], uint64(strSize))
+	copy(out[n:n+strSize], s.Str)
+	n += strSize
+	// Bool
+	if s.Bool {
+		out[n] = 1
+	} else {
+		out[n] = 0
+	}
+	n += VarintLenBool
+	// Int
+	binary.LittleEndian.PutUint64(out[n:], uint64(s.Int))
+	n += FixedLen64
+	// Int16
+	binary.LittleEndian.PutUint16(out[n:], uint16(s.Int16))
+	n += FixedLen16
+	// Int64
+	binary.LittleEndian.PutUint64(out[n:], uint64(s.Int64))
+	n += FixedLen64
+	// Uint
+	binary.LittleEndian.PutUint64(out[n:], uint64(s.Uint))
+	n += FixedLen64
+	// Uint8
+	out[n] = s.Uint8
+	n += FixedLen8
+	// Uint32
+	binary.LittleEndian.PutUint32(out[n:], s.Uint32)
+	n += FixedLen32
+	// Time
+	timeLen, err := TimeMarshalBinary(s.Time, out[n:])
+	if err != nil {
+		return 0, err
+	}
+	n += timeLen
+	// SubPointer
+	if s.SubPointer == nil {
+		out[n] = 0
+		n += VarintLenPointer
+	} else {
+		out[n] = 1
+		n += VarintLenPointer
+		subLen, err := s.SubPointer.EncodeWithBytesFixed(out[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += subLen
+	}
+	// Subs
+	if s.Subs == nil {
+		out[n] = 0
+		n += VarintLenPointer
+	} else {
+		out[n] = 1
+		n += VarintLenPointer
+		// スライスの長さ
+		n += binary.PutVarint(out[n:], int64(len(s.Subs)))
+		for _, s := range s.Subs {
+			subLen, err := s.EncodeWithBytesFixed(out[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += subLen
+		}
+	}
+
+	return n, nil
+}
+
+// DecodeFixed はEncodeWithBytesFixedの出力をデコードする
+func (s *TestStruct) DecodeFixed(in []byte) (int, error) {
+	*s = TestStruct{}
+	n := 0
+
+	// Str
+	strLen, strLenLen := binary.Uvarint(in)
+	if strLenLen <= 0 {
+		return 0, varintErr(strLenLen)
+	}
+	n += strLenLen
+	if err := checkLen(in, n, strLen); err != nil {
+		return 0, err
+	}
+	s.Str = string(in[n : n+int(strLen)])
+	n += int(strLen)
+	// Bool以降のSubPointerのnil判定までは固定長なのでまとめて長さを確認する
+	if err := checkLen(in, n, VarintLenBool+FixedLen64+FixedLen16+FixedLen64+FixedLen64+FixedLen8+FixedLen32+VarintLenTime+VarintLenPointer); err != nil {
+		return 0, err
+	}
+	// Bool
+	s.Bool = in[n] == 1
+	n += VarintLenBool
+	// Int
+	s.Int = int(binary.LittleEndian.Uint64(in[n:]))
+	n += FixedLen64
+	// Int16
+	s.Int16 = int16(binary.LittleEndian.Uint16(in[n:]))
+	n += FixedLen16
+	// Int64
+	s.Int64 = int64(binary.LittleEndian.Uint64(in[n:]))
+	n += FixedLen64
+	// Uint
+	s.Uint = uint(binary.LittleEndian.Uint64(in[n:]))
+	n += FixedLen64
+	// Uint8
+	s.Uint8 = in[n]
+	n += FixedLen8
+	// Uint32
+	s.Uint32 = binary.LittleEndian.Uint32(in[n:])
+	n += FixedLen32
+	// Time
+	err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime])
+	if err != nil {
+		return 0, err
+	}
+	n += VarintLenTime
+	// SubPointer
+	isNotNil := in[n]
+	n += VarintLenPointer
+	if isNotNil == 1 {
+		s.SubPointer = &TestSubStruct{}
+		subLen, err := s.SubPointer.DecodeFixed(in[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += subLen
+	}
+	// Subs
+	subsLen, err := s.Subs.DecodeFixed(in[n:])
+	if err != nil {
+		return 0, err
+	}
+	n += subsLen
+
+	return n, nil
+}
+
+// SizeFixed はEncodeFixedの出力の正確なサイズを返す
+func (ss TestStructs) SizeFixed() int {
+	size := VarintLenPointer
+	if ss == nil {
+		return size
+	}
+
+	size += varintLen(int64(len(ss)))
+	for i := range ss {
+		size += ss[i].SizeFixed()
+	}
+	return size
+}
+
+// EncodeFixed は整数をリトルエンディアンの固定長でエンコードする
+// 値の小さい整数が多いとEncodeより大きくなるが、SizeFixedで正確なサイズが分かる
+func (ss TestStructs) EncodeFixed() ([]byte, error) {
+	if ss == nil {
+		// nil
+		return []byte{0}, nil
+	}
+
+	out := make([]byte, ss.SizeFixed())
+	n := 0
+	// nilでない
+	n += binary.PutUvarint(out[n:], uint64(1))
+	// スライスの長さ
+	n += binary.PutVarint(out[n:], int64(len(ss)))
+	for _, s := range ss {
+		bytesLen, err := s.EncodeWithBytesFixed(out[n:])
+		if err != nil {
+			return nil, err
+		}
+		n += bytesLen
+	}
+
+	return out[:n], nil
+}
+
+// DecodeFixed はEncodeFixedの出力をデコードする
+func (ss *TestStructs) DecodeFixed(in []byte) (int, error) {
+	n := 0
+	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return 0, varintErr(isNotNilLen)
+	}
+	if isNotNil == 0 {
+		*ss = nil
+		return isNotNilLen, nil
+	}
+	n += isNotNilLen
+
+	ssLen, ssLenLen := binary.Varint(in[n:])
+	if ssLenLen <= 0 {
+		return 0, varintErr(ssLenLen)
+	}
+	n += ssLenLen
+	if err := checkSliceLen(in, n, ssLen); err != nil {
+		return 0, err
+	}
+	ssLenInt := int(ssLen)
+	*ss = make(TestStructs, ssLenInt)
+	for i := 0; i < ssLenInt; i++ {
+		sLen, err := (*ss)[i].DecodeFixed(in[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += sLen
+	}
+	return n, nil
+}
+
+// TestStructのビットマップのビット
+const (
+	testStructBitBool = 1 << iota
+	testStructBitSubPointer
+	testStructBitSubs
+
+	testStructBitmapFlags = iota
+)
+
+// SizeBitmap はビットマップモードでエンコードしたときの最大サイズを返す
+func (s *TestStruct) SizeBitmap() int {
+	size := 0
+	if s == nil {
+		return 0
+	}
+
+	// Bool, SubPointerとSubsのnil判定
+	size += bitmapLen(testStructBitmapFlags)
+	// Str
+	size += binary.MaxVarintLen64
+	size += len(s.Str)
+	// Int
+	size += binary.MaxVarintLen64
+	// Int16
+	size += binary.MaxVarintLen16
+	// Int64
+	size += binary.MaxVarintLen64
+	// Uint
+	size += binary.MaxVarintLen64
+	// Uint8
+	size += MaxVarintLen8
+	// Uint32
+	size += binary.MaxVarintLen32
+	// Time
+	size += VarintLenTime
+	// SubPointer
+	size += s.SubPointer.SizeBitmap()
+	// Subs
+	size += s.Subs.SizeBitmap()
+	return size
+}
+
+// EncodeWithBytesBitmap は真偽値とnil判定を先頭のビットマップに詰めてエンコードする
+// 他のフィールドはEncodeWithBytesと同じ
+func (s TestStruct) EncodeWithBytesBitmap(out []byte) (int, error) {
+	n := 0
+	// ビットマップ
+	var bitmap byte
+	if s.Bool {
+		bitmap |= testStructBitBool
+	}
+	if s.SubPointer != nil {
+		bitmap |= testStructBitSubPointer
+	}
+	if s.Subs != nil {
+		bitmap |= testStructBitSubs
+	}
+	out[n] = bitmap
+	n += bitmapLen(testStructBitmapFlags)
+	// Str
+	strSize := len(s.Str)
+	n += binary.PutUvarint(out[n:], uint64(strSize))
+	copy(out[n:n+strSize], s.Str)
+	n += strSize
+	// Int
+	n += binary.PutVarint(out[n:], int64(s.Int))
+	// Int16
+	n += binary.PutVarint(out[n:], int64(s.Int16))
+	// Int64
+	n += binary.PutVarint(out[n:], s.Int64)
+	// Uint
+	n += binary.PutUvarint(out[n:], uint64(s.Uint))
+	// Uint8
+	n += binary.PutUvarint(out[n:], uint64(s.Uint8))
+	// Uint32
+	n += binary.PutUvarint(out[n:], uint64(s.Uint32))
+	// Time
+	timeLen, err := TimeMarshalBinary(s.Time, out[n:])
+	if err != nil {
+		return 0, err
+	}
+	n += timeLen
+	// SubPointer
+	if s.SubPointer != nil {
+		subLen, err := s.SubPointer.EncodeWithBytesBitmap(out[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += subLen
+	}
+	// Subs
+	if s.Subs != nil {
+		// スライスの長さ
+		n += binary.PutVarint(out[n:], int64(len(s.Subs)))
+		for _, s := range s.Subs {
+			subLen, err := s.EncodeWithBytesBitmap(out[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += subLen
+		}
+	}
+
+	return n, nil
+}
+
+// DecodeBitmap はEncodeWithBytesBitmapの出力をデコードする
+func (s *TestStruct) DecodeBitmap(in []byte) (int, error) {
+	*s = TestStruct{}
+	n := 0
+
+	// ビットマップ
+	if err := checkLen(in, n, uint64(bitmapLen(testStructBitmapFlags))); err != nil {
+		return 0, err
+	}
+	bitmap := in[n]
+	if bitmap>>testStructBitmapFlags != 0 {
+		return 0, ErrInvalidBitmap
+	}
+	n += bitmapLen(testStructBitmapFlags)
+	// Bool
+	s.Bool = bitmap&testStructBitBool != 0
+	// Str
+	strLen, strLenLen := binary.Uvarint(in[n:])
+	if strLenLen <= 0 {
+		return 0, varintErr(strLenLen)
+	}
+	n += strLenLen
+	if err := checkLen(in, n, strLen); err != nil {
+		return 0, err
+	}
+	s.Str = string(in[n : n+int(strLen)])
+	n += int(strLen)
+	// Int
+	intRaw, intLen := binary.Varint(in[n:])
+	if intLen <= 0 {
+		return 0, varintErr(intLen)
+	}
+	s.Int = int(intRaw)
+	n += intLen
+	// Int16
+	int16Raw, int16Len := binary.Varint(in[n:])
+	if int16Len <= 0 {
+		return 0, varintErr(int16Len)
+	}
+	s.Int16 = int16(int16Raw)
+	n += int16Len
+	// Int64
+	int64Raw, int64Len := binary.Varint(in[n:])
+	if int64Len <= 0 {
+		return 0, varintErr(int64Len)
+	}
+	s.Int64 = int64Raw
+	n += int64Len
+	// Uint
+	uintRaw, uintLen := binary.Uvarint(in[n:])
+	if uintLen <= 0 {
+		return 0, varintErr(uintLen)
+	}
+	s.Uint = uint(uintRaw)
+	n += uintLen
+	// Uint8
+	uint8Raw, uint8Len := binary.Uvarint(in[n:])
+	if uint8Len <= 0 {
+		return 0, varintErr(uint8Len)
+	}
+	s.Uint8 = uint8(uint8Raw)
+	n += uint8Len
+	// Uint32
+	uint32Raw, uint32Len := binary.Uvarint(in[n:])
+	if uint32Len <= 0 {
+		return 0, varintErr(uint32Len)
+	}
+	s.Uint32 = uint32(uint32Raw)
+	n += uint32Len
+	// Time
+	if err := checkLen(in, n, VarintLenTime); err != nil {
+		return 0, err
+	}
+	err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime])
+	if err != nil {
+		return 0, err
+	}
+	n += VarintLenTime
+	// SubPointer
+	if bitmap&testStructBitSubPointer != 0 {
+		s.SubPointer = &TestSubStruct{}
+		subLen, err := s.SubPointer.DecodeBitmap(in[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += subLen
+	}
+	// Subs
+	if bitmap&testStructBitSubs != 0 {
+		subsLen, err := s.Subs.DecodeBitmap(in[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += subsLen
+	}
+
+	return n, nil
+}
+
+// EncodeBitmap は各要素の真偽値とnil判定をビットマップに詰めてエンコードする
+// TestStructs自体のnil判定とスライスの長さはEncodeと同じ
+func (ss TestStructs) EncodeBitmap() ([]byte, error) {
+	size := VarintLenPointer
+
+	if ss == nil {
+		// nil
+		return []byte{0}, nil
+	}
+
+	size += binary.MaxVarintLen64
+	ssLen := len(ss)
+	for _, s := range ss {
+		size += s.SizeBitmap()
+	}
+
+	out := make([]byte, size)
+	n := 0
+	// nilでない
+	n += binary.PutUvarint(out[n:], uint64(1))
+	// スライスの長さ
+	n += binary.PutVarint(out[n:], int64(ssLen))
+	for _, s := range ss {
+		bytesLen, err := s.EncodeWithBytesBitmap(out[n:])
+		if err != nil {
+			return nil, err
+		}
+		n += bytesLen
+	}
+
+	return out[:n], nil
+}
+
+// DecodeBitmap はEncodeBitmapの出力をデコードする
+func (ss *TestStructs) DecodeBitmap(in []byte) (int, error) {
+	n := 0
+	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return 0, varintErr(isNotNilLen)
+	}
+	if isNotNil == 0 {
+		*ss = nil
+		return isNotNilLen, nil
+	}
+	n += isNotNilLen
+
+	ssLen, ssLenLen := binary.Varint(in[n:])
+	if ssLenLen <= 0 {
+		return 0, varintErr(ssLenLen)
+	}
+	n += ssLenLen
+	if err := checkSliceLen(in, n, ssLen); err != nil {
+		return 0, err
+	}
+	ssLenInt := int(ssLen)
+	*ss = make(TestStructs, ssLenInt)
+	for i := 0; i < ssLenInt; i++ {
+		sLen, err := (*ss)[i].DecodeBitmap(in[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += sLen
+	}
+	return n, nil
+}
+
+// TestStructのOmitZeroモードのマスクのビット
+const (
+	testStructMaskStr = 1 << iota
+	testStructMaskBool
+	testStructMaskInt
+	testStructMaskInt16
+	testStructMaskInt64
+	testStructMaskUint
+	testStructMaskUint8
+	testStructMaskUint32
+	testStructMaskTime
+	testStructMaskSubPointer
+	testStructMaskSubs
+
+	testStructMaskFields = iota
+)
+
+// SizeOmitZero はOmitZeroモードでエンコードしたときの最大サイズを返す
+func (s *TestStruct) SizeOmitZero() int {
+	size := 0
+	if s == nil {
+		return 0
+	}
+
+	// マスク
+	size += binary.MaxVarintLen16
+	// Str
+	if s.Str != "" {
+		size += binary.MaxVarintLen64
+		size += len(s.Str)
+	}
+	// Int
+	if s.Int != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Int16
+	if s.Int16 != 0 {
+		size += binary.MaxVarintLen16
+	}
+	// Int64
+	if s.Int64 != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Uint
+	if s.Uint != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Uint8
+	if s.Uint8 != 0 {
+		size += MaxVarintLen8
+	}
+	// Uint32
+	if s.Uint32 != 0 {
+		size += binary.MaxVarintLen32
+	}
+	// Time
+	if s.Time != (time.Time{}) {
+		size += VarintLenTime
+	}
+	// SubPointer
+	if s.SubPointer != nil {
+		size += s.SubPointer.SizeOmitZero()
+	}
+	// Subs
+	if s.Subs != nil {
+		size += s.Subs.SizeOmitZero()
+	}
+	return size
+}
+
+// EncodeWithBytesOmitZero はゼロ値でないフィールドのビットを立てたマスクを先頭に置き、
+// ゼロ値のフィールドを省いてエンコードする
+// Boolはマスクのビットだけで表す
+func (s TestStruct) EncodeWithBytesOmitZero(out []byte) (int, error) {
+	n := 0
+	// マスク
+	var mask uint64
+	if s.Str != "" {
+		mask |= testStructMaskStr
+	}
+	if s.Bool {
+		mask |= testStructMaskBool
+	}
+	if s.Int != 0 {
+		mask |= testStructMaskInt
+	}
+	if s.Int16 != 0 {
+		mask |= testStructMaskInt16
+	}
+	if s.Int64 != 0 {
+		mask |= testStructMaskInt64
+	}
+	if s.Uint != 0 {
+		mask |= testStructMaskUint
+	}
+	if s.Uint8 != 0 {
+		mask |= testStructMaskUint8
+	}
+	if s.Uint32 != 0 {
+		mask |= testStructMaskUint32
+	}
+	// Timeはゾーンも含めてゼロ値の場合だけ省く
+	if s.Time != (time.Time{}) {
+		mask |= testStructMaskTime
+	}
+	if s.SubPointer != nil {
+		mask |= testStructMaskSubPointer
+	}
+	if s.Subs != nil {
+		mask |= testStructMaskSubs
+	}
+	n += binary.PutUvarint(out[n:], mask)
+	// Str
+	if mask&testStructMaskStr != 0 {
+		strSize := len(s.Str)
+		n += binary.PutUvarint(out[n:], uint64(strSize))
+		copy(out[n:n+strSize], s.Str)
+		n += strSize
+	}
+	// Int
+	if mask&testStructMaskInt != 0 {
+		n += binary.PutVarint(out[n:], int64(s.Int))
+	}
+	// Int16
+	if mask&testStructMaskInt16 != 0 {
+		n += binary.PutVarint(out[n:], int64(s.Int16))
+	}
+	// Int64
+	if mask&testStructMaskInt64 != 0 {
+		n += binary.PutVarint(out[n:], s.Int64)
+	}
+	// Uint
+	if mask&testStructMaskUint != 0 {
+		n += binary.PutUvarint(out[n:], uint64(s.Uint))
+	}
+	// Uint8
+	if mask&testStructMaskUint8 != 0 {
+		n += binary.PutUvarint(out[n:], uint64(s.Uint8))
+	}
+	// Uint32
+	if mask&testStructMaskUint32 != 0 {
+		n += binary.PutUvarint(out[n:], uint64(s.Uint32))
+	}
+	// Time
+	if mask&testStructMaskTime != 0 {
+		timeLen, err := TimeMarshalBinary(s.Time, out[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += timeLen
+	}
+	// SubPointer
+	if mask&testStructMaskSubPointer != 0 {
+		subLen, err := s.SubPointer.EncodeWithBytesOmitZero(out[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += subLen
+	}
+	// Subs
+	if mask&testStructMaskSubs != 0 {
+		// スライスの長さ
+		n += binary.PutVarint(out[n:], int64(len(s.Subs)))
+		for _, s := range s.Subs {
+			subLen, err := s.EncodeWithBytesOmitZero(out[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += subLen
+		}
+	}
+
+	return n, nil
+}
+
+// DecodeOmitZero はEncodeWithBytesOmitZeroの出力をデコードする
+// マスクのビットが立っていないフィールドはゼロ値になる
+func (s *TestStruct) DecodeOmitZero(in []byte) (int, error) {
+	*s = TestStruct{}
+	n := 0
+
+	// マスク
+	mask, maskLen := binary.Uvarint(in)
+	if maskLen <= 0 {
+		return 0, varintErr(maskLen)
+	}
+	if mask>>testStructMaskFields != 0 {
+		return 0, ErrInvalidBitmap
+	}
+	n += maskLen
+	// Str
+	if mask&testStructMaskStr != 0 {
+		strLen, strLenLen := binary.Uvarint(in[n:])
+		if strLenLen <= 0 {
+			return 0, varintErr(strLenLen)
+		}
+		n += strLenLen
+		if err := checkLen(in, n, strLen); err != nil {
+			return 0, err
+		}
+		s.Str = string(in[n : n+int(strLen)])
+		n += int(strLen)
+	}
+	// Bool
+	s.Bool = mask&testStructMaskBool != 0
+	// Int
+	if mask&testStructMaskInt != 0 {
+		intRaw, intLen := binary.Varint(in[n:])
+		if intLen <= 0 {
+			return 0, varintErr(intLen)
+		}
+		s.Int = int(intRaw)
+		n += intLen
+	}
+	// Int16
+	if mask&testStructMaskInt16 != 0 {
+		int16Raw, int16Len := binary.Varint(in[n:])
+		if int16Len <= 0 {
+			return 0, varintErr(int16Len)
+		}
+		s.Int16 = int16(int16Raw)
+		n += int16Len
+	}
+	// Int64
+	if mask&testStructMaskInt64 != 0 {
+		int64Raw, int64Len := binary.Varint(in[n:])
+		if int64Len <= 0 {
+			return 0, varintErr(int64Len)
+		}
+		s.Int64 = int64Raw
+		n += int64Len
+	}
+	// Uint
+	if mask&testStructMaskUint != 0 {
+		uintRaw, uintLen := binary.Uvarint(in[n:])
+		if uintLen <= 0 {
+			return 0, varintErr(uintLen)
+		}
+		s.Uint = uint(uintRaw)
+		n += uintLen
+	}
+	// Uint8
+	if mask&testStructMaskUint8 != 0 {
+		uint8Raw, uint8Len := binary.Uvarint(in[n:])
+		if uint8Len <= 0 {
+			return 0, varintErr(uint8Len)
+		}
+		s.Uint8 = uint8(uint8Raw)
+		n += uint8Len
+	}
+	// Uint32
+	if mask&testStructMaskUint32 != 0 {
+		uint32Raw, uint32Len := binary.Uvarint(in[n:])
+		if uint32Len <= 0 {
+			return 0, varintErr(uint32Len)
+		}
+		s.Uint32 = uint32(uint32Raw)
+		n += uint32Len
+	}
+	// Time
+	if mask&testStructMaskTime != 0 {
+		if err := checkLen(in, n, VarintLenTime); err != nil {
+			return 0, err
+		}
+		if err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime]); err != nil {
+			return 0, err
+		}
+		n += VarintLenTime
+	}
+	// SubPointer
+	if mask&testStructMaskSubPointer != 0 {
+		s.SubPointer = &TestSubStruct{}
+		subLen, err := s.SubPointer.DecodeOmitZero(in[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += subLen
+	}
+	// Subs
+	if mask&testStructMaskSubs != 0 {
+		subsLen, err := s.Subs.DecodeOmitZero(in[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += subsLen
+	}
+
+	return n, nil
+}
+
+// EncodeOmitZero は各要素のゼロ値のフィールドを省いてエンコードする
+// TestStructs自体のnil判定とスライスの長さはEncodeと同じ
+func (ss TestStructs) EncodeOmitZero() ([]byte, error) {
+	size := VarintLenPointer
+
+	if ss == nil {
+		// nil
+		return []byte{0}, nil
+	}
+
+	size += binary.MaxVarintLen64
+	ssLen := len(ss)
+	for _, s := range ss {
+		size += s.SizeOmitZero()
+	}
+
+	out := make([]byte, size)
+	n := 0
+	// nilでない
+	n += binary.PutUvarint(out[n:], uint64(1))
+	// スライスの長さ
+	n += binary.PutVarint(out[n:], int64(ssLen))
+	for _, s := range ss {
+		bytesLen, err := s.EncodeWithBytesOmitZero(out[n:])
+		if err != nil {
+			return nil, err
+		}
+		n += bytesLen
+	}
+
+	return out[:n], nil
+}
+
+// DecodeOmitZero はEncodeOmitZeroの出力をデコードする
+func (ss *TestStructs) DecodeOmitZero(in []byte) (int, error) {
+	n := 0
+	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return 0, varintErr(isNotNilLen)
+	}
+	if isNotNil == 0 {
+		*ss = nil
+		return isNotNilLen, nil
+	}
+	n += isNotNilLen
+
+	ssLen, ssLenLen := binary.Varint(in[n:])
+	if ssLenLen <= 0 {
+		return 0, varintErr(ssLenLen)
+	}
+	n += ssLenLen
+	if err := checkSliceLen(in, n, ssLen); err != nil {
+		return 0, err
+	}
+	ssLenInt := int(ssLen)
+	*ss = make(TestStructs, ssLenInt)
+	for i := 0; i < ssLenInt; i++ {
+		sLen, err := (*ss)[i].DecodeOmitZero(in[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += sLen
+	}
+	return n, nil
+}
+
+// diffMask は更新前の値からupdatedで変わったフィールドのマスクを返す
+func (s *TestStruct) diffMask(updated *TestStruct) uint64 {
+	var mask uint64
+	if s.Str != updated.Str {
+		mask |= testStructMaskStr
+	}
+	if s.Bool != updated.Bool {
+		mask |= testStructMaskBool
+	}
+	if s.Int != updated.Int {
+		mask |= testStructMaskInt
+	}
+	if s.Int16 != updated.Int16 {
+		mask |= testStructMaskInt16
+	}
+	if s.Int64 != updated.Int64 {
+		mask |= testStructMaskInt64
+	}
+	if s.Uint != updated.Uint {
+		mask |= testStructMaskUint
+	}
+	if s.Uint8 != updated.Uint8 {
+		mask |= testStructMaskUint8
+	}
+	if s.Uint32 != updated.Uint32 {
+		mask |= testStructMaskUint32
+	}
+	// Timeはゾーンとモノトニック時刻も含めて比べる
+	if s.Time != updated.Time {
+		mask |= testStructMaskTime
+	}
+	if !s.SubPointer.equal(updated.SubPointer) {
+		mask |= testStructMaskSubPointer
+	}
+	if !s.Subs.equal(updated.Subs) {
+		mask |= testStructMaskSubs
+	}
+	return mask
+}
+
+func (s *TestStruct) SizeDiff(updated *TestStruct) int {
+	size := 0
+	mask := s.diffMask(updated)
+
+	// マスク
+	size += binary.MaxVarintLen16
+	// Str
+	if mask&testStructMaskStr != 0 {
+		size += binary.MaxVarintLen64
+		size += len(updated.Str)
+	}
+	// Bool
+	if mask&testStructMaskBool != 0 {
+		size += VarintLenBool
+	}
+	// Int
+	if mask&testStructMaskInt != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Int16
+	if mask&testStructMaskInt16 != 0 {
+		size += binary.MaxVarintLen16
+	}
+	// Int64
+	if mask&testStructMaskInt64 != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Uint
+	if mask&testStructMaskUint != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Uint8
+	if mask&testStructMaskUint8 != 0 {
+		size += MaxVarintLen8
+	}
+	// Uint32
+	if mask&testStructMaskUint32 != 0 {
+		size += binary.MaxVarintLen32
+	}
+	// Time
+	if mask&testStructMaskTime != 0 {
+		size += VarintLenTime
+	}
+	// SubPointer
+	if mask&testStructMaskSubPointer != 0 {
+		size += VarintLenPointer
+		switch {
+		case updated.SubPointer == nil:
+		case s.SubPointer == nil:
+			size += updated.SubPointer.Size()
+		default:
+			size += s.SubPointer.SizeDiff(updated.SubPointer)
+		}
+	}
+	// Subs
+	if mask&testStructMaskSubs != 0 {
+		size += VarintLenPointer
+		size += binary.MaxVarintLen64
+		for i := range updated.Subs {
+			if i < len(s.Subs) {
+				size += s.Subs[i].SizeDiff(&updated.Subs[i])
+			} else {
+				size += updated.Subs[i].Size()
+			}
+		}
+	}
+	return size
+}
+
+// EncodeWithBytesDiff は更新前の値からupdatedで変わったフィールドだけをエンコードする
+func (s *TestStruct) EncodeWithBytesDiff(out []byte, updated *TestStruct) (int, error) {
+	n := 0
+	mask := s.diffMask(updated)
+	// マスク
+	n += binary.PutUvarint(out[n:], mask)
+	// Str
+	if mask&testStructMaskStr != 0 {
+		strSize := len(updated.Str)
+		n += binary.PutUvarint(out[n:], uint64(strSize))
+		copy(out[n:n+strSize], updated.Str)
+		n += strSize
+	}
+	// Bool
+	if mask&testStructMaskBool != 0 {
+		if updated.Bool {
+			out[n] = 1
+		} else {
+			out[n] = 0
+		}
+		n += VarintLenBool
+	}
+	// Int
+	if mask&testStructMaskInt != 0 {
+		n += binary.PutVarint(out[n:], int64(updated.Int))
+	}
+	// Int16
+	if mask&testStructMaskInt16 != 0 {
+		n += binary.PutVarint(out[n:], int64(updated.Int16))
+	}
+	// Int64
+	if mask&testStructMaskInt64 != 0 {
+		n += binary.PutVarint(out[n:], updated.Int64)
+	}
+	// Uint
+	if mask&testStructMaskUint != 0 {
+		n += binary.PutUvarint(out[n:], uint64(updated.Uint))
+	}
+	// Uint8
+	if mask&testStructMaskUint8 != 0 {
+		n += binary.PutUvarint(out[n:], uint64(updated.Uint8))
+	}
+	// Uint32
+	if mask&testStructMaskUint32 != 0 {
+		n += binary.PutUvarint(out[n:], uint64(updated.Uint32))
+	}
+	// Time
+	if mask&testStructMaskTime != 0 {
+		timeLen, err := TimeMarshalBinary(updated.Time, out[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += timeLen
+	}
+	// SubPointer
+	if mask&testStructMaskSubPointer != 0 {
+		switch {
+		case updated.SubPointer == nil:
+			out[n] = diffNil
+			n += VarintLenPointer
+		case s.SubPointer == nil:
+			out[n] = diffFull
+			n += VarintLenPointer
+			subLen, err := updated.SubPointer.EncodeWithBytesTime(out[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += subLen
+		default:
+			out[n] = diffPatch
+			n += VarintLenPointer
+			subLen, err := s.SubPointer.EncodeWithBytesDiff(out[n:], updated.SubPointer)
+			if err != nil {
+				return 0, err
+			}
+			n += subLen
+		}
+	}
+	// Subs
+	if mask&testStructMaskSubs != 0 {
+		if updated.Subs == nil {
+			out[n] = 0
+			n += VarintLenPointer
+		} else {
+			out[n] = 1
+			n += VarintLenPointer
+			// スライスの長さ
+			n += binary.PutVarint(out[n:], int64(len(updated.Subs)))
+			// 更新前にある要素は差分、増えた要素は全てエンコードする
+			for i := range updated.Subs {
+				var subLen int
+				var err error
+				if i < len(s.Subs) {
+					subLen, err = s.Subs[i].EncodeWithBytesDiff(out[n:], &updated.Subs[i])
+				} else {
+					subLen, err = updated.Subs[i].EncodeWithBytesTime(out[n:])
+				}
+				if err != nil {
+					return 0, err
+				}
+				n += subLen
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// ApplyDiff はEncodeWithBytesDiffの出力を読み取り、変わったフィールドを書き換える
+func (s *TestStruct) ApplyDiff(in []byte) (int, error) {
+	n := 0
+
+	// マスク
+	mask, maskLen := binary.Uvarint(in)
+	if maskLen <= 0 {
+		return 0, varintErr(maskLen)
+	}
+	if mask>>testStructMaskFields != 0 {
+		return 0, ErrInvalidBitmap
+	}
+	n += maskLen
+	// Str
+	if mask&testStructMaskStr != 0 {
+		strLen, strLenLen := binary.Uvarint(in[n:])
+		if strLenLen <= 0 {
+			return 0, varintErr(strLenLen)
+		}
+		n += strLenLen
+		if err := checkLen(in, n, strLen); err != nil {
+			return 0, err
+		}
+		s.Str = string(in[n : n+int(strLen)])
+		n += int(strLen)
+	}
+	// Bool
+	if mask&testStructMaskBool != 0 {
+		if err := checkLen(in, n, VarintLenBool); err != nil {
+			return 0, err
+		}
+		s.Bool = in[n] == 1
+		n += VarintLenBool
+	}
+	// Int
+	if mask&testStructMaskInt != 0 {
+		intRaw, intLen := binary.Varint(in[n:])
+		if intLen <= 0 {
+			return 0, varintErr(intLen)
+		}
+		s.Int = int(intRaw)
+		n += intLen
+	}
+	// Int16
+	if mask&testStructMaskInt16 != 0 {
+		int16Raw, int16Len := binary.Varint(in[n:])
+		if int16Len <= 0 {
+			return 0, varintErr(int16Len)
+		}
+		s.Int16 = int16(int16Raw)
+		n += int16Len
+	}
+	// Int64
+	if mask&testStructMaskInt64 != 0 {
+		int64Raw, int64Len := binary.Varint(in[n:])
+		if int64Len <= 0 {
+			return 0, varintErr(int64Len)
+		}
+		s.Int64 = int64Raw
+		n += int64Len
+	}
+	// Uint
+	if mask&testStructMaskUint != 0 {
+		uintRaw, uintLen := binary.Uvarint(in[n:])
+		if uintLen <= 0 {
+			return 0, varintErr(uintLen)
+		}
+		s.Uint = uint(uintRaw)
+		n += uintLen
+	}
+	// Uint8
+	if mask&testStructMaskUint8 != 0 {
+		uint8Raw, uint8Len := binary.Uvarint(in[n:])
+		if uint8Len <= 0 {
+			return 0, varintErr(uint8Len)
+		}
+		s.Uint8 = uint8(uint8Raw)
+		n += uint8Len
+	}
+	// Uint32
+	if mask&testStructMaskUint32 != 0 {
+		uint32Raw, uint32Len := binary.Uvarint(in[n:])
+		if uint32Len <= 0 {
+			return 0, varintErr(uint32Len)
+		}
+		s.Uint32 = uint32(uint32Raw)
+		n += uint32Len
+	}
+	// Time
+	if mask&testStructMaskTime != 0 {
+		if err := checkLen(in, n, VarintLenTime); err != nil {
+			return 0, err
+		}
+		if err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime]); err != nil {
+			return 0, err
+		}
+		n += VarintLenTime
+	}
+	// SubPointer
+	if mask&testStructMaskSubPointer != 0 {
+		if err := checkLen(in, n, VarintLenPointer); err != nil {
+			return 0, err
+		}
+		kind := in[n]
+		n += VarintLenPointer
+		switch kind {
+		case diffNil:
+			s.SubPointer = nil
+		case diffFull:
+			s.SubPointer = &TestSubStruct{}
+			subLen, err := s.SubPointer.Decode(in[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += subLen
+		case diffPatch:
+			if s.SubPointer == nil {
+				return 0, ErrInvalidDiff
+			}
+			// 更新前の値と共有しているポインタの先は書き換えない
+			sub := *s.SubPointer
+			subLen, err := sub.ApplyDiff(in[n:])
+			if err != nil {
+				return 0, err
+			}
+			s.SubPointer = &sub
+			n += subLen
+		default:
+			return 0, ErrInvalidDiff
+		}
+	}
+	// Subs
+	if mask&testStructMaskSubs != 0 {
+		if err := checkLen(in, n, VarintLenPointer); err != nil {
+			return 0, err
+		}
+		isNotNil := in[n]
+		n += VarintLenPointer
+		if isNotNil == 0 {
+			s.Subs = nil
+		} else {
+			subsLen, subsLenLen := binary.Varint(in[n:])
+			if subsLenLen <= 0 {
+				return 0, varintErr(subsLenLen)
+			}
+			n += subsLenLen
+			if err := checkSliceLen(in, n, subsLen); err != nil {
+				return 0, err
+			}
+			// 更新前の値と共有しているスライスは書き換えない
+			subs := make(TestSubStructs, int(subsLen))
+			copy(subs, s.Subs)
+			for i := range subs {
+				var subLen int
+				var err error
+				if i < len(s.Subs) {
+					subLen, err = subs[i].ApplyDiff(in[n:])
+				} else {
+					subLen, err = subs[i].Decode(in[n:])
+				}
+				if err != nil {
+					return 0, err
+				}
+				n += subLen
+			}
+			s.Subs = subs
+		}
+	}
+
+	return n, nil
+}
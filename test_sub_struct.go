@@ -2,19 +2,21 @@ package main
 
 import (
 	"encoding/binary"
+	"math"
 	"time"
+	"unsafe"
 )
 
 type TestSubStruct struct {
-	Str    string
-	Bool   bool
-	Int    int
-	Int16  int16
-	Int64  int64
-	Uint   uint
-	Uint8  uint8
-	Uint32 uint32
-	Time   time.Time
+	Str    string    `proto:"1"`
+	Bool   bool      `proto:"2"`
+	Int    int       `proto:"3"`
+	Int16  int16     `proto:"4"`
+	Int64  int64     `proto:"5"`
+	Uint   uint      `proto:"6"`
+	Uint8  uint8     `proto:"7"`
+	Uint32 uint32    `proto:"8"`
+	Time   time.Time `proto:"9"`
 }
 
 func (s *TestSubStruct) Size() int {
@@ -178,50 +180,127 @@ func (s TestSubStruct) Encode() ([]byte, error) {
 }
 
 func (s *TestSubStruct) Decode(in []byte) (int, error) {
+	return s.decodeWith(in, nil)
+}
+
+func (s *TestSubStruct) decodeWith(in []byte, d *decodeState) (int, error) {
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
 	n := 0
 
 	// Str
 	strLen, strLenLen := binary.Uvarint(in)
+	if strLenLen <= 0 {
+		return 0, varintErr(strLenLen)
+	}
+	if err := d.checkUvarint(strLen, strLenLen, math.MaxUint64); err != nil {
+		return 0, err
+	}
 	n += strLenLen
-	s.Str = string(in[n : n+int(strLen)])
+	if err := checkLen(in, n, strLen); err != nil {
+		return 0, err
+	}
+	if err := d.stringLen(int(strLen)); err != nil {
+		return 0, err
+	}
+	s.Str = d.decodeString(s.Str, in[n:n+int(strLen)])
 	n += int(strLen)
 	// Bool
 	boolRaw, boolLen := binary.Uvarint(in[n:])
+	if boolLen <= 0 {
+		return 0, varintErr(boolLen)
+	}
+	if err := d.checkUvarint(boolRaw, boolLen, 1); err != nil {
+		return 0, err
+	}
 	s.Bool = boolRaw == 1
 	n += boolLen
 	// Int
 	intRaw, intLen := binary.Varint(in[n:])
+	if intLen <= 0 {
+		return 0, varintErr(intLen)
+	}
+	if err := d.checkVarint(intRaw, intLen, math.MinInt, math.MaxInt); err != nil {
+		return 0, err
+	}
 	s.Int = int(intRaw)
 	n += intLen
 	// Int16
 	int16Raw, int16Len := binary.Varint(in[n:])
+	if int16Len <= 0 {
+		return 0, varintErr(int16Len)
+	}
+	if err := d.checkVarint(int16Raw, int16Len, math.MinInt16, math.MaxInt16); err != nil {
+		return 0, err
+	}
 	s.Int16 = int16(int16Raw)
 	n += int16Len
 	// Int64
 	int64Raw, int64Len := binary.Varint(in[n:])
+	if int64Len <= 0 {
+		return 0, varintErr(int64Len)
+	}
+	if err := d.checkVarint(int64Raw, int64Len, math.MinInt64, math.MaxInt64); err != nil {
+		return 0, err
+	}
 	s.Int64 = int64(int64Raw)
 	n += int64Len
 	// Uint
 	uintRaw, uintLen := binary.Uvarint(in[n:])
+	if uintLen <= 0 {
+		return 0, varintErr(uintLen)
+	}
+	if err := d.checkUvarint(uintRaw, uintLen, math.MaxUint); err != nil {
+		return 0, err
+	}
 	s.Uint = uint(uintRaw)
 	n += uintLen
 	// Uint8
 	uint8Raw, uint8Len := binary.Uvarint(in[n:])
+	if uint8Len <= 0 {
+		return 0, varintErr(uint8Len)
+	}
+	if err := d.checkUvarint(uint8Raw, uint8Len, math.MaxUint8); err != nil {
+		return 0, err
+	}
 	s.Uint8 = uint8(uint8Raw)
 	n += uint8Len
 	// Uint32
 	uint32Raw, uint32Len := binary.Uvarint(in[n:])
+	if uint32Len <= 0 {
+		return 0, varintErr(uint32Len)
+	}
+	if err := d.checkUvarint(uint32Raw, uint32Len, math.MaxUint32); err != nil {
+		return 0, err
+	}
 	s.Uint32 = uint32(uint32Raw)
 	n += uint32Len
 	// Time
+	if err := checkLen(in, n, VarintLenTime); err != nil {
+		return 0, err
+	}
 	err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime])
 	if err != nil {
 		return 0, err
 	}
+	if err := d.checkTime(s.Time, in[n:n+VarintLenTime]); err != nil {
+		return 0, err
+	}
 	n += VarintLenTime
 	return n, nil
 }
 
+func (s TestSubStruct) MarshalBinary() ([]byte, error) {
+	return s.Encode()
+}
+
+func (s *TestSubStruct) UnmarshalBinary(data []byte) error {
+	_, err := s.Decode(data)
+	return err
+}
+
 type TestSubStructs []TestSubStruct
 
 func (ss TestSubStructs) Size() int {
@@ -243,8 +322,213 @@ func (ss TestSubStructs) Size() int {
 }
 
 func (ss *TestSubStructs) Decode(in []byte) (int, error) {
+	return ss.decodeWith(in, nil)
+}
+
+func (ss *TestSubStructs) decodeWith(in []byte, d *decodeState) (int, error) {
+	n := 0
+	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return 0, varintErr(isNotNilLen)
+	}
+	if err := d.checkUvarint(isNotNil, isNotNilLen, 1); err != nil {
+		return 0, err
+	}
+	if isNotNil == 0 {
+		*ss = nil
+		return isNotNilLen, nil
+	}
+	n += isNotNilLen
+
+	ssLen, ssLenLen := binary.Varint(in[n:])
+	if ssLenLen <= 0 {
+		return 0, varintErr(ssLenLen)
+	}
+	if err := d.checkVarint(ssLen, ssLenLen, math.MinInt64, math.MaxInt64); err != nil {
+		return 0, err
+	}
+	n += ssLenLen
+	if err := checkSliceLen(in, n, ssLen); err != nil {
+		return 0, err
+	}
+	ssLenInt := int(ssLen)
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+	if err := d.sliceLen(ssLenInt, unsafe.Sizeof(TestSubStruct{})); err != nil {
+		return 0, err
+	}
+	if d.reusing() && cap(*ss) >= ssLenInt {
+		*ss = (*ss)[:ssLenInt]
+	} else {
+		*ss = make(TestSubStructs, ssLenInt)
+	}
+	for i := 0; i < ssLenInt; i++ {
+		sLen, err := (*ss)[i].decodeWith(in[n:], d)
+		if err != nil {
+			return 0, err
+		}
+		n += sLen
+	}
+	return n, nil
+}
+
+// SizeFixed は整数を固定長でエンコードしたときの正確なサイズを返す
+func (s *TestSubStruct) SizeFixed() int {
+	size := 0
+	if s == nil {
+		return 0
+	}
+
+	// Str
+	size += uvarintLen(uint64(len(s.Str)))
+	size += len(s.Str)
+	// Bool
+	size += VarintLenBool
+	// Int
+	size += FixedLen64
+	// Int16
+	size += FixedLen16
+	// Int64
+	size += FixedLen64
+	// Uint
+	size += FixedLen64
+	// Uint8
+	size += FixedLen8
+	// Uint32
+	size += FixedLen32
+	// Time
+	size += VarintLenTime
+	return size
+}
+
+// EncodeWithBytesFixed は整数をリトルエンディアンの固定長でエンコードする
+func (s TestSubStruct) EncodeWithBytesFixed(out []byte) (int, error) {
+	n := 0
+	// Str
+	strSize := len(s.Str)
+	n += binary.PutUvarint(out[n:], uint64(strSize))
+	copy(out[n:n+strSize], s.Str)
+	n += strSize
+	// Bool
+	if s.Bool {
+		out[n] = 1
+	} else {
+		out[n] = 0
+	}
+	n += VarintLenBool
+	// Int
+	binary.LittleEndian.PutUint64(out[n:], uint64(s.Int))
+	n += FixedLen64
+	// Int16
+	binary.LittleEndian.PutUint16(out[n:], uint16(s.Int16))
+	n += FixedLen16
+	// Int64
+	binary.LittleEndian.PutUint64(out[n:], uint64(s.Int64))
+	n += FixedLen64
+	// Uint
+	binary.LittleEndian.PutUint64(out[n:], uint64(s.Uint))
+	n += FixedLen64
+	// Uint8
+	out[n] = s.Uint8
+	n += FixedLen8
+	// Uint32
+	binary.LittleEndian.PutUint32(out[n:], s.Uint32)
+	n += FixedLen32
+	// Time
+	timeLen, err := TimeMarshalBinary(s.Time, out[n:])
+	if err != nil {
+		return 0, err
+	}
+	n += timeLen
+
+	return n, nil
+}
+
+func (s TestSubStruct) EncodeFixed() ([]byte, error) {
+	out := make([]byte, s.SizeFixed())
+	n, err := s.EncodeWithBytesFixed(out)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// DecodeFixed はEncodeFixedの出力をデコードする
+func (s *TestSubStruct) DecodeFixed(in []byte) (int, error) {
+	n := 0
+
+	// Str
+	strLen, strLenLen := binary.Uvarint(in)
+	if strLenLen <= 0 {
+		return 0, varintErr(strLenLen)
+	}
+	n += strLenLen
+	if err := checkLen(in, n, strLen); err != nil {
+		return 0, err
+	}
+	s.Str = string(in[n : n+int(strLen)])
+	n += int(strLen)
+	// Bool以降は固定長なのでまとめて長さを確認する
+	if err := checkLen(in, n, VarintLenBool+FixedLen64+FixedLen16+FixedLen64+FixedLen64+FixedLen8+FixedLen32+VarintLenTime); err != nil {
+		return 0, err
+	}
+	// Bool
+	s.Bool = in[n] == 1
+	n += VarintLenBool
+	// Int
+	s.Int = int(binary.LittleEndian.Uint64(in[n:]))
+	n += FixedLen64
+	// Int16
+	s.Int16 = int16(binary.LittleEndian.Uint16(in[n:]))
+	n += FixedLen16
+	// Int64
+	s.Int64 = int64(binary.LittleEndian.Uint64(in[n:]))
+	n += FixedLen64
+	// Uint
+	s.Uint = uint(binary.LittleEndian.Uint64(in[n:]))
+	n += FixedLen64
+	// Uint8
+	s.Uint8 = in[n]
+	n += FixedLen8
+	// Uint32
+	s.Uint32 = binary.LittleEndian.Uint32(in[n:])
+	n += FixedLen32
+	// Time
+	err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime])
+	if err != nil {
+		return 0, err
+	}
+	n += VarintLenTime
+	return n, nil
+}
+
+// SizeFixed は要素を固定長でエンコードしたときの正確なサイズを返す
+func (ss TestSubStructs) SizeFixed() int {
+	size := 0
+
+	size += VarintLenPointer
+	if ss == nil {
+		return size
+	}
+
+	// スライスの長さのサイズ
+	size += varintLen(int64(len(ss)))
+	// スライスの要素のサイズ
+	for i := range ss {
+		size += ss[i].SizeFixed()
+	}
+
+	return size
+}
+
+func (ss *TestSubStructs) DecodeFixed(in []byte) (int, error) {
 	n := 0
 	isNotNil, isNotNilLen := binary.Uvarint(in)
+	if isNotNilLen <= 0 {
+		return 0, varintErr(isNotNilLen)
+	}
 	if isNotNil == 0 {
 		*ss = nil
 		return isNotNilLen, nil
@@ -252,15 +536,774 @@ func (ss *TestSubStructs) Decode(in []byte) (int, error) {
 	n += isNotNilLen
 
 	ssLen, ssLenLen := binary.Varint(in[n:])
+	if ssLenLen <= 0 {
+		return 0, varintErr(ssLenLen)
+	}
 	n += ssLenLen
+	if err := checkSliceLen(in, n, ssLen); err != nil {
+		return 0, err
+	}
 	ssLenInt := int(ssLen)
 	*ss = make(TestSubStructs, ssLenInt)
 	for i := 0; i < ssLenInt; i++ {
-		sLen, err := (*ss)[i].Decode(in[n:])
+		sLen, err := (*ss)[i].DecodeFixed(in[n:])
 		if err != nil {
-			return 0, nil
+			return 0, err
 		}
 		n += sLen
 	}
 	return n, nil
 }
+
+// TestSubStructのビットマップのビット
+const (
+	testSubStructBitBool = 1 << iota
+
+	testSubStructBitmapFlags = iota
+)
+
+// SizeBitmap はビットマップモードでエンコードしたときの最大サイズを返す
+func (s *TestSubStruct) SizeBitmap() int {
+	size := 0
+	if s == nil {
+		return 0
+	}
+
+	// Bool
+	size += bitmapLen(testSubStructBitmapFlags)
+	// Str
+	size += binary.MaxVarintLen64
+	size += len(s.Str)
+	// Int
+	size += binary.MaxVarintLen64
+	// Int16
+	size += binary.MaxVarintLen16
+	// Int64
+	size += binary.MaxVarintLen64
+	// Uint
+	size += binary.MaxVarintLen64
+	// Uint8
+	size += MaxVarintLen8
+	// Uint32
+	size += binary.MaxVarintLen32
+	// Time
+	size += VarintLenTime
+	return size
+}
+
+// EncodeWithBytesBitmap は真偽値を先頭のビットマップに詰めてエンコードする
+// 他のフィールドはEncodeWithBytesと同じ
+func (s TestSubStruct) EncodeWithBytesBitmap(out []byte) (int, error) {
+	n := 0
+	// ビットマップ
+	var bitmap byte
+	if s.Bool {
+		bitmap |= testSubStructBitBool
+	}
+	out[n] = bitmap
+	n += bitmapLen(testSubStructBitmapFlags)
+	// Str
+	strSize := len(s.Str)
+	n += binary.PutUvarint(out[n:], uint64(strSize))
+	copy(out[n:n+strSize], s.Str)
+	n += strSize
+	// Int
+	n += binary.PutVarint(out[n:], int64(s.Int))
+	// Int16
+	n += binary.PutVarint(out[n:], int64(s.Int16))
+	// Int64
+	n += binary.PutVarint(out[n:], s.Int64)
+	// Uint
+	n += binary.PutUvarint(out[n:], uint64(s.Uint))
+	// Uint8
+	n += binary.PutUvarint(out[n:], uint64(s.Uint8))
+	// Uint32
+	n += binary.PutUvarint(out[n:], uint64(s.Uint32))
+	// Time
+	timeLen, err := TimeMarshalBinary(s.Time, out[n:])
+	if err != nil {
+		return 0, err
+	}
+	n += timeLen
+
+	return n, nil
+}
+
+func (s TestSubStruct) EncodeBitmap() ([]byte, error) {
+	out := make([]byte, s.SizeBitmap())
+	n, err := s.EncodeWithBytesBitmap(out)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// DecodeBitmap はEncodeBitmapの出力をデコードする
+func (s *TestSubStruct) DecodeBitmap(in []byte) (int, error) {
+	n := 0
+
+	// ビットマップ
+	if err := checkLen(in, n, uint64(bitmapLen(testSubStructBitmapFlags))); err != nil {
+		return 0, err
+	}
+	bitmap := in[n]
+	if bitmap>>testSubStructBitmapFlags != 0 {
+		return 0, ErrInvalidBitmap
+	}
+	n += bitmapLen(testSubStructBitmapFlags)
+	// Bool
+	s.Bool = bitmap&testSubStructBitBool != 0
+	// Str
+	strLen, strLenLen := binary.Uvarint(in[n:])
+	if strLenLen <= 0 {
+		return 0, varintErr(strLenLen)
+	}
+	n += strLenLen
+	if err := checkLen(in, n, strLen); err != nil {
+		return 0, err
+	}
+	s.Str = string(in[n : n+int(strLen)])
+	n += int(strLen)
+	// Int
+	intRaw, intLen := binary.Varint(in[n:])
+	if intLen <= 0 {
+		return 0, varintErr(intLen)
+	}
+	s.Int = int(intRaw)
+	n += intLen
+	// Int16
+	int16Raw, int16Len := binary.Varint(in[n:])
+	if int16Len <= 0 {
+		return 0, varintErr(int16Len)
+	}
+	s.Int16 = int16(int16Raw)
+	n += int16Len
+	// Int64
+	int64Raw, int64Len := binary.Varint(in[n:])
+	if int64Len <= 0 {
+		return 0, varintErr(int64Len)
+	}
+	s.Int64 = int64Raw
+	n += int64Len
+	// Uint
+	uintRaw, uintLen := binary.Uvarint(in[n:])
+	if uintLen <= 0 {
+		return 0, varintErr(uintLen)
+	}
+	s.Uint = uint(uintRaw)
+	n += uintLen
+	// Uint8
+	uint8Raw, uint8Len := binary.Uvarint(in[n:])
+	if uint8Len <= 0 {
+		return 0, varintErr(uint8Len)
+	}
+	s.Uint8 = uint8(uint8Raw)
+	n += uint8Len
+	// Uint32
+	uint32Raw, uint32Len := binary.Uvarint(in[n:])
+	if uint32Len <= 0 {
+		return 0, varintErr(uint32Len)
+	}
+	s.Uint32 = uint32(uint32Raw)
+	n += uint32Len
+	// Time
+	if err := checkLen(in, n, VarintLenTime); err != nil {
+		return 0, err
+	}
+	err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime])
+	if err != nil {
+		return 0, err
+	}
+	n += VarintLenTime
+	return n, nil
+}
+
+// SizeBitmap は要素をビットマップモードでエンコードしたときの最大サイズを返す
+// nil判定は親の構造体のビットマップに入るので含めない
+func (ss TestSubStructs) SizeBitmap() int {
+	size := 0
+	if ss == nil {
+		return size
+	}
+
+	// スライスの長さのサイズ
+	size += binary.MaxVarintLen64
+	// スライスの要素のサイズ
+	for i := range ss {
+		size += ss[i].SizeBitmap()
+	}
+
+	return size
+}
+
+// DecodeBitmap はnil判定のない長さ + 要素を読み取る
+// nilかどうかは親の構造体のビットマップで判定済み
+func (ss *TestSubStructs) DecodeBitmap(in []byte) (int, error) {
+	n := 0
+	ssLen, ssLenLen := binary.Varint(in)
+	if ssLenLen <= 0 {
+		return 0, varintErr(ssLenLen)
+	}
+	n += ssLenLen
+	if err := checkSliceLen(in, n, ssLen); err != nil {
+		return 0, err
+	}
+	ssLenInt := int(ssLen)
+	*ss = make(TestSubStructs, ssLenInt)
+	for i := 0; i < ssLenInt; i++ {
+		sLen, err := (*ss)[i].DecodeBitmap(in[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += sLen
+	}
+	return n, nil
+}
+
+// TestSubStructのOmitZeroモードのマスクのビット
+const (
+	testSubStructMaskStr = 1 << iota
+	testSubStructMaskBool
+	testSubStructMaskInt
+	testSubStructMaskInt16
+	testSubStructMaskInt64
+	testSubStructMaskUint
+	testSubStructMaskUint8
+	testSubStructMaskUint32
+	testSubStructMaskTime
+
+	testSubStructMaskFields = iota
+)
+
+// SizeOmitZero はOmitZeroモードでエンコードしたときの最大サイズを返す
+func (s *TestSubStruct) SizeOmitZero() int {
+	size := 0
+	if s == nil {
+		return 0
+	}
+
+	// マスク
+	size += binary.MaxVarintLen16
+	// Str
+	if s.Str != "" {
+		size += binary.MaxVarintLen64
+		size += len(s.Str)
+	}
+	// Int
+	if s.Int != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Int16
+	if s.Int16 != 0 {
+		size += binary.MaxVarintLen16
+	}
+	// Int64
+	if s.Int64 != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Uint
+	if s.Uint != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Uint8
+	if s.Uint8 != 0 {
+		size += MaxVarintLen8
+	}
+	// Uint32
+	if s.Uint32 != 0 {
+		size += binary.MaxVarintLen32
+	}
+	// Time
+	if s.Time != (time.Time{}) {
+		size += VarintLenTime
+	}
+	return size
+}
+
+// EncodeWithBytesOmitZero はゼロ値でないフィールドのビットを立てたマスクを先頭に置き、
+// ゼロ値のフィールドを省いてエンコードする
+// Boolはマスクのビットだけで表す
+func (s TestSubStruct) EncodeWithBytesOmitZero(out []byte) (int, error) {
+	n := 0
+	// マスク
+	var mask uint64
+	if s.Str != "" {
+		mask |= testSubStructMaskStr
+	}
+	if s.Bool {
+		mask |= testSubStructMaskBool
+	}
+	if s.Int != 0 {
+		mask |= testSubStructMaskInt
+	}
+	if s.Int16 != 0 {
+		mask |= testSubStructMaskInt16
+	}
+	if s.Int64 != 0 {
+		mask |= testSubStructMaskInt64
+	}
+	if s.Uint != 0 {
+		mask |= testSubStructMaskUint
+	}
+	if s.Uint8 != 0 {
+		mask |= testSubStructMaskUint8
+	}
+	if s.Uint32 != 0 {
+		mask |= testSubStructMaskUint32
+	}
+	// Timeはゾーンも含めてゼロ値の場合だけ省く
+	if s.Time != (time.Time{}) {
+		mask |= testSubStructMaskTime
+	}
+	n += binary.PutUvarint(out[n:], mask)
+	// Str
+	if mask&testSubStructMaskStr != 0 {
+		strSize := len(s.Str)
+		n += binary.PutUvarint(out[n:], uint64(strSize))
+		copy(out[n:n+strSize], s.Str)
+		n += strSize
+	}
+	// Int
+	if mask&testSubStructMaskInt != 0 {
+		n += binary.PutVarint(out[n:], int64(s.Int))
+	}
+	// Int16
+	if mask&testSubStructMaskInt16 != 0 {
+		n += binary.PutVarint(out[n:], int64(s.Int16))
+	}
+	// Int64
+	if mask&testSubStructMaskInt64 != 0 {
+		n += binary.PutVarint(out[n:], s.Int64)
+	}
+	// Uint
+	if mask&testSubStructMaskUint != 0 {
+		n += binary.PutUvarint(out[n:], uint64(s.Uint))
+	}
+	// Uint8
+	if mask&testSubStructMaskUint8 != 0 {
+		n += binary.PutUvarint(out[n:], uint64(s.Uint8))
+	}
+	// Uint32
+	if mask&testSubStructMaskUint32 != 0 {
+		n += binary.PutUvarint(out[n:], uint64(s.Uint32))
+	}
+	// Time
+	if mask&testSubStructMaskTime != 0 {
+		timeLen, err := TimeMarshalBinary(s.Time, out[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += timeLen
+	}
+
+	return n, nil
+}
+
+func (s TestSubStruct) EncodeOmitZero() ([]byte, error) {
+	out := make([]byte, s.SizeOmitZero())
+	n, err := s.EncodeWithBytesOmitZero(out)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// DecodeOmitZero はEncodeWithBytesOmitZeroの出力をデコードする
+// マスクのビットが立っていないフィールドはゼロ値になる
+func (s *TestSubStruct) DecodeOmitZero(in []byte) (int, error) {
+	*s = TestSubStruct{}
+	n := 0
+
+	// マスク
+	mask, maskLen := binary.Uvarint(in)
+	if maskLen <= 0 {
+		return 0, varintErr(maskLen)
+	}
+	if mask>>testSubStructMaskFields != 0 {
+		return 0, ErrInvalidBitmap
+	}
+	n += maskLen
+	// Str
+	if mask&testSubStructMaskStr != 0 {
+		strLen, strLenLen := binary.Uvarint(in[n:])
+		if strLenLen <= 0 {
+			return 0, varintErr(strLenLen)
+		}
+		n += strLenLen
+		if err := checkLen(in, n, strLen); err != nil {
+			return 0, err
+		}
+		s.Str = string(in[n : n+int(strLen)])
+		n += int(strLen)
+	}
+	// Bool
+	s.Bool = mask&testSubStructMaskBool != 0
+	// Int
+	if mask&testSubStructMaskInt != 0 {
+		intRaw, intLen := binary.Varint(in[n:])
+		if intLen <= 0 {
+			return 0, varintErr(intLen)
+		}
+		s.Int = int(intRaw)
+		n += intLen
+	}
+	// Int16
+	if mask&testSubStructMaskInt16 != 0 {
+		int16Raw, int16Len := binary.Varint(in[n:])
+		if int16Len <= 0 {
+			return 0, varintErr(int16Len)
+		}
+		s.Int16 = int16(int16Raw)
+		n += int16Len
+	}
+	// Int64
+	if mask&testSubStructMaskInt64 != 0 {
+		int64Raw, int64Len := binary.Varint(in[n:])
+		if int64Len <= 0 {
+			return 0, varintErr(int64Len)
+		}
+		s.Int64 = int64Raw
+		n += int64Len
+	}
+	// Uint
+	if mask&testSubStructMaskUint != 0 {
+		uintRaw, uintLen := binary.Uvarint(in[n:])
+		if uintLen <= 0 {
+			return 0, varintErr(uintLen)
+		}
+		s.Uint = uint(uintRaw)
+		n += uintLen
+	}
+	// Uint8
+	if mask&testSubStructMaskUint8 != 0 {
+		uint8Raw, uint8Len := binary.Uvarint(in[n:])
+		if uint8Len <= 0 {
+			return 0, varintErr(uint8Len)
+		}
+		s.Uint8 = uint8(uint8Raw)
+		n += uint8Len
+	}
+	// Uint32
+	if mask&testSubStructMaskUint32 != 0 {
+		uint32Raw, uint32Len := binary.Uvarint(in[n:])
+		if uint32Len <= 0 {
+			return 0, varintErr(uint32Len)
+		}
+		s.Uint32 = uint32(uint32Raw)
+		n += uint32Len
+	}
+	// Time
+	if mask&testSubStructMaskTime != 0 {
+		if err := checkLen(in, n, VarintLenTime); err != nil {
+			return 0, err
+		}
+		if err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime]); err != nil {
+			return 0, err
+		}
+		n += VarintLenTime
+	}
+
+	return n, nil
+}
+
+// SizeOmitZero は要素をOmitZeroモードでエンコードしたときの最大サイズを返す
+// nil判定は親の構造体のマスクに入るので含めない
+func (ss TestSubStructs) SizeOmitZero() int {
+	size := 0
+	if ss == nil {
+		return size
+	}
+
+	// スライスの長さのサイズ
+	size += binary.MaxVarintLen64
+	// スライスの要素のサイズ
+	for i := range ss {
+		size += ss[i].SizeOmitZero()
+	}
+
+	return size
+}
+
+// DecodeOmitZero はnil判定のない長さ + 要素を読み取る
+func (ss *TestSubStructs) DecodeOmitZero(in []byte) (int, error) {
+	n := 0
+	ssLen, ssLenLen := binary.Varint(in)
+	if ssLenLen <= 0 {
+		return 0, varintErr(ssLenLen)
+	}
+	n += ssLenLen
+	if err := checkSliceLen(in, n, ssLen); err != nil {
+		return 0, err
+	}
+	ssLenInt := int(ssLen)
+	*ss = make(TestSubStructs, ssLenInt)
+	for i := 0; i < ssLenInt; i++ {
+		sLen, err := (*ss)[i].DecodeOmitZero(in[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += sLen
+	}
+	return n, nil
+}
+
+// diffMask は更新前の値からupdatedで変わったフィールドのマスクを返す
+func (s *TestSubStruct) diffMask(updated *TestSubStruct) uint64 {
+	var mask uint64
+	if s.Str != updated.Str {
+		mask |= testSubStructMaskStr
+	}
+	if s.Bool != updated.Bool {
+		mask |= testSubStructMaskBool
+	}
+	if s.Int != updated.Int {
+		mask |= testSubStructMaskInt
+	}
+	if s.Int16 != updated.Int16 {
+		mask |= testSubStructMaskInt16
+	}
+	if s.Int64 != updated.Int64 {
+		mask |= testSubStructMaskInt64
+	}
+	if s.Uint != updated.Uint {
+		mask |= testSubStructMaskUint
+	}
+	if s.Uint8 != updated.Uint8 {
+		mask |= testSubStructMaskUint8
+	}
+	if s.Uint32 != updated.Uint32 {
+		mask |= testSubStructMaskUint32
+	}
+	// Timeはゾーンとモノトニック時刻も含めて比べる
+	if s.Time != updated.Time {
+		mask |= testSubStructMaskTime
+	}
+	return mask
+}
+
+func (s *TestSubStruct) SizeDiff(updated *TestSubStruct) int {
+	size := 0
+	mask := s.diffMask(updated)
+
+	// マスク
+	size += binary.MaxVarintLen16
+	// Str
+	if mask&testSubStructMaskStr != 0 {
+		size += binary.MaxVarintLen64
+		size += len(updated.Str)
+	}
+	// Bool
+	if mask&testSubStructMaskBool != 0 {
+		size += VarintLenBool
+	}
+	// Int
+	if mask&testSubStructMaskInt != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Int16
+	if mask&testSubStructMaskInt16 != 0 {
+		size += binary.MaxVarintLen16
+	}
+	// Int64
+	if mask&testSubStructMaskInt64 != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Uint
+	if mask&testSubStructMaskUint != 0 {
+		size += binary.MaxVarintLen64
+	}
+	// Uint8
+	if mask&testSubStructMaskUint8 != 0 {
+		size += MaxVarintLen8
+	}
+	// Uint32
+	if mask&testSubStructMaskUint32 != 0 {
+		size += binary.MaxVarintLen32
+	}
+	// Time
+	if mask&testSubStructMaskTime != 0 {
+		size += VarintLenTime
+	}
+	return size
+}
+
+// EncodeWithBytesDiff は更新前の値からupdatedで変わったフィールドだけをエンコードする
+func (s *TestSubStruct) EncodeWithBytesDiff(out []byte, updated *TestSubStruct) (int, error) {
+	n := 0
+	mask := s.diffMask(updated)
+	// マスク
+	n += binary.PutUvarint(out[n:], mask)
+	// Str
+	if mask&testSubStructMaskStr != 0 {
+		strSize := len(updated.Str)
+		n += binary.PutUvarint(out[n:], uint64(strSize))
+		copy(out[n:n+strSize], updated.Str)
+		n += strSize
+	}
+	// Bool
+	if mask&testSubStructMaskBool != 0 {
+		if updated.Bool {
+			out[n] = 1
+		} else {
+			out[n] = 0
+		}
+		n += VarintLenBool
+	}
+	// Int
+	if mask&testSubStructMaskInt != 0 {
+		n += binary.PutVarint(out[n:], int64(updated.Int))
+	}
+	// Int16
+	if mask&testSubStructMaskInt16 != 0 {
+		n += binary.PutVarint(out[n:], int64(updated.Int16))
+	}
+	// Int64
+	if mask&testSubStructMaskInt64 != 0 {
+		n += binary.PutVarint(out[n:], updated.Int64)
+	}
+	// Uint
+	if mask&testSubStructMaskUint != 0 {
+		n += binary.PutUvarint(out[n:], uint64(updated.Uint))
+	}
+	// Uint8
+	if mask&testSubStructMaskUint8 != 0 {
+		n += binary.PutUvarint(out[n:], uint64(updated.Uint8))
+	}
+	// Uint32
+	if mask&testSubStructMaskUint32 != 0 {
+		n += binary.PutUvarint(out[n:], uint64(updated.Uint32))
+	}
+	// Time
+	if mask&testSubStructMaskTime != 0 {
+		timeLen, err := TimeMarshalBinary(updated.Time, out[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += timeLen
+	}
+
+	return n, nil
+}
+
+// ApplyDiff はEncodeWithBytesDiffの出力を読み取り、変わったフィールドを書き換える
+func (s *TestSubStruct) ApplyDiff(in []byte) (int, error) {
+	n := 0
+
+	// マスク
+	mask, maskLen := binary.Uvarint(in)
+	if maskLen <= 0 {
+		return 0, varintErr(maskLen)
+	}
+	if mask>>testSubStructMaskFields != 0 {
+		return 0, ErrInvalidBitmap
+	}
+	n += maskLen
+	// Str
+	if mask&testSubStructMaskStr != 0 {
+		strLen, strLenLen := binary.Uvarint(in[n:])
+		if strLenLen <= 0 {
+			return 0, varintErr(strLenLen)
+		}
+		n += strLenLen
+		if err := checkLen(in, n, strLen); err != nil {
+			return 0, err
+		}
+		s.Str = string(in[n : n+int(strLen)])
+		n += int(strLen)
+	}
+	// Bool
+	if mask&testSubStructMaskBool != 0 {
+		if err := checkLen(in, n, VarintLenBool); err != nil {
+			return 0, err
+		}
+		s.Bool = in[n] == 1
+		n += VarintLenBool
+	}
+	// Int
+	if mask&testSubStructMaskInt != 0 {
+		intRaw, intLen := binary.Varint(in[n:])
+		if intLen <= 0 {
+			return 0, varintErr(intLen)
+		}
+		s.Int = int(intRaw)
+		n += intLen
+	}
+	// Int16
+	if mask&testSubStructMaskInt16 != 0 {
+		int16Raw, int16Len := binary.Varint(in[n:])
+		if int16Len <= 0 {
+			return 0, varintErr(int16Len)
+		}
+		s.Int16 = int16(int16Raw)
+		n += int16Len
+	}
+	// Int64
+	if mask&testSubStructMaskInt64 != 0 {
+		int64Raw, int64Len := binary.Varint(in[n:])
+		if int64Len <= 0 {
+			return 0, varintErr(int64Len)
+		}
+		s.Int64 = int64Raw
+		n += int64Len
+	}
+	// Uint
+	if mask&testSubStructMaskUint != 0 {
+		uintRaw, uintLen := binary.Uvarint(in[n:])
+		if uintLen <= 0 {
+			return 0, varintErr(uintLen)
+		}
+		s.Uint = uint(uintRaw)
+		n += uintLen
+	}
+	// Uint8
+	if mask&testSubStructMaskUint8 != 0 {
+		uint8Raw, uint8Len := binary.Uvarint(in[n:])
+		if uint8Len <= 0 {
+			return 0, varintErr(uint8Len)
+		}
+		s.Uint8 = uint8(uint8Raw)
+		n += uint8Len
+	}
+	// Uint32
+	if mask&testSubStructMaskUint32 != 0 {
+		uint32Raw, uint32Len := binary.Uvarint(in[n:])
+		if uint32Len <= 0 {
+			return 0, varintErr(uint32Len)
+		}
+		s.Uint32 = uint32(uint32Raw)
+		n += uint32Len
+	}
+	// Time
+	if mask&testSubStructMaskTime != 0 {
+		if err := checkLen(in, n, VarintLenTime); err != nil {
+			return 0, err
+		}
+		if err := s.Time.UnmarshalBinary(in[n : n+VarintLenTime]); err != nil {
+			return 0, err
+		}
+		n += VarintLenTime
+	}
+
+	return n, nil
+}
+
+// equal はnilどうしも等しいとして、ポインタの先の値を比べる
+func (s *TestSubStruct) equal(t *TestSubStruct) bool {
+	if s == nil || t == nil {
+		return s == t
+	}
+	return *s == *t
+}
+
+// equal はnilと空のスライスを区別して要素を比べる
+func (ss TestSubStructs) equal(ts TestSubStructs) bool {
+	if (ss == nil) != (ts == nil) || len(ss) != len(ts) {
+		return false
+	}
+	for i := range ss {
+		if ss[i] != ts[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTranscode はJSONの値がSchemaの型と合わない場合のエラー
+var ErrTranscode = errors.New("transcode: value does not match the schema")
+
+// TranscodeJSONToBinary はrのJSONをSchemaのレイアウトのバイト列にしてwに書き出す
+// Goの型の値は作らず、json.Decoderのトークンから直接エンコードする
+// 出力はjson.Unmarshalした値をエンコードした場合と同じになる
+// JSONではUTCとオフセットが0の地域を区別できないので、"Z"の時刻はUTCとしてエンコードする
+//
+// 一番外側のスライスは要素ごとに書き出す
+// 要素数を先に書く必要があるので、rがSeekできるファイルなどなら先に要素数を数える
+// パイプから読む標準入力のようにSeekできない入力は、全体のエンコード結果をメモリにまとめてから書き出すので、
+// 大きな入力はファイルとして渡す
+func TranscodeJSONToBinary(w io.Writer, r io.Reader, s *Schema) error {
+	bw := bufio.NewWriter(w)
+	count := -1
+	if rs, ok := r.(io.ReadSeeker); ok && s.Kind == SchemaSlice {
+		// パイプの標準入力などは戻れないのでまとめてから書き出す
+		if start, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			if count, err = countJSONArray(rs); err != nil {
+				return err
+			}
+			if _, err := rs.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+
+	t := newJSONTranscoder(r)
+	tok, err := t.dec.Token()
+	if err != nil {
+		return err
+	}
+	if s.Kind != SchemaSlice || tok != json.Delim('[') || count < 0 {
+		b, err := t.value(nil, s, tok, "$")
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+
+	b := append([]byte(nil), 1)
+	b = appendSliceLen(b, count, s.Elem.Kind == SchemaStruct)
+	if _, err := bw.Write(b); err != nil {
+		return err
+	}
+	for i := 0; t.dec.More(); i++ {
+		if i >= count {
+			return fmt.Errorf("%w: $ has more than %d elements", ErrTranscode, count)
+		}
+		if b, err = t.next(b[:0], s.Elem, fmt.Sprintf("$[%d]", i)); err != nil {
+			return err
+		}
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+	if _, err := t.dec.Token(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// countJSONArray は一番外側の配列の要素数を数える
+func countJSONArray(r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	if tok != json.Delim('[') {
+		return -1, nil
+	}
+	count := 0
+	for dec.More() {
+		// 要素はバイト列のまま読み飛ばす
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+type jsonTranscoder struct {
+	dec *json.Decoder
+}
+
+func newJSONTranscoder(r io.Reader) *jsonTranscoder {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return &jsonTranscoder{dec: dec}
+}
+
+// next は次のトークンから値を読み取ってbに追加する
+func (t *jsonTranscoder) next(b []byte, s *Schema, path string) ([]byte, error) {
+	tok, err := t.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	return t.value(b, s, tok, path)
+}
+
+// value は読み取ったトークンtokから始まる値をbに追加する
+// nullはjson.Unmarshalと同じくゼロ値として扱う
+func (t *jsonTranscoder) value(b []byte, s *Schema, tok json.Token, path string) ([]byte, error) {
+	mismatch := func() error {
+		return fmt.Errorf("%w: %s is %v, want %s", ErrTranscode, path, tok, s.Kind)
+	}
+	if tok == nil {
+		return appendZero(b, s)
+	}
+	switch s.Kind {
+	case SchemaBool:
+		v, ok := tok.(bool)
+		if !ok {
+			return nil, mismatch()
+		}
+		if v {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case SchemaInt, SchemaUint, SchemaFloat:
+		num, ok := tok.(json.Number)
+		if !ok {
+			return nil, mismatch()
+		}
+		return appendNumber(b, s.Kind, string(num), path)
+	case SchemaString:
+		v, ok := tok.(string)
+		if !ok {
+			return nil, mismatch()
+		}
+		b = appendUvarint(b, uint64(len(v)))
+		return append(b, v...), nil
+	case SchemaBytes:
+		v, ok := tok.(string)
+		if !ok {
+			return nil, mismatch()
+		}
+		raw, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrTranscode, path, err)
+		}
+		b = appendUvarint(append(b, 1), uint64(len(raw)))
+		return append(b, raw...), nil
+	case SchemaTime:
+		v, ok := tok.(string)
+		if !ok {
+			return nil, mismatch()
+		}
+		tm, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrTranscode, path, err)
+		}
+		return appendTime(b, tm)
+	case SchemaBinary:
+		var inner []byte
+		if s.Elem != nil {
+			var err error
+			if inner, err = t.value(nil, s.Elem, tok, path); err != nil {
+				return nil, err
+			}
+		} else {
+			// 中身のレイアウトがわからない場合はbase64の文字列とする
+			v, ok := tok.(string)
+			if !ok {
+				return nil, mismatch()
+			}
+			var err error
+			if inner, err = base64.StdEncoding.DecodeString(v); err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrTranscode, path, err)
+			}
+		}
+		b = appendUvarint(b, uint64(len(inner)))
+		return append(b, inner...), nil
+	case SchemaPointer:
+		b = append(b, 1)
+		return t.value(b, s.Elem, tok, path)
+	case SchemaSlice:
+		if tok != json.Delim('[') {
+			return nil, mismatch()
+		}
+		var elems []byte
+		count := 0
+		for ; t.dec.More(); count++ {
+			var err error
+			if elems, err = t.next(elems, s.Elem, fmt.Sprintf("%s[%d]", path, count)); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := t.dec.Token(); err != nil {
+			return nil, err
+		}
+		b = appendSliceLen(append(b, 1), count, s.Elem.Kind == SchemaStruct)
+		return append(b, elems...), nil
+	case SchemaMap:
+		if tok != json.Delim('{') {
+			return nil, mismatch()
+		}
+		var entries []byte
+		count := 0
+		for ; t.dec.More(); count++ {
+			keyTok, err := t.dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := keyTok.(string)
+			if entries, err = appendMapKey(entries, s.Key, key, path); err != nil {
+				return nil, err
+			}
+			if entries, err = t.next(entries, s.Elem, fmt.Sprintf("%s[%q]", path, key)); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := t.dec.Token(); err != nil {
+			return nil, err
+		}
+		b = appendUvarint(append(b, 1), uint64(count))
+		return append(b, entries...), nil
+	case SchemaStruct:
+		if tok != json.Delim('{') {
+			return nil, mismatch()
+		}
+		return t.object(b, s, path)
+	}
+	return nil, fmt.Errorf("schema: unknown kind %q", s.Kind)
+}
+
+// object は構造体のフィールドをJSONのキーの順に読み取り、Schemaの順に並べて追加する
+func (t *jsonTranscoder) object(b []byte, s *Schema, path string) ([]byte, error) {
+	values := map[*Schema][][]byte{s: make([][]byte, len(s.Fields))}
+	for t.dec.More() {
+		keyTok, err := t.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := keyTok.(string)
+		owner, i, ok := lookupJSONField(s, key)
+		if !ok {
+			// 知らないフィールドはjson.Unmarshalと同じく読み飛ばす
+			var raw json.RawMessage
+			if err := t.dec.Decode(&raw); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if values[owner] == nil {
+			values[owner] = make([][]byte, len(owner.Fields))
+		}
+		v, err := t.next(nil, owner.Fields[i].Type, path+"."+owner.Fields[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		values[owner][i] = v
+	}
+	if _, err := t.dec.Token(); err != nil {
+		return nil, err
+	}
+	return appendObject(b, s, values)
+}
+
+func appendObject(b []byte, s *Schema, values map[*Schema][][]byte) ([]byte, error) {
+	for i, f := range s.Fields {
+		if f.Embedded {
+			elem := f.Type.Elem
+			// 昇格したフィールドが1つもなければ埋め込みポインタはnil
+			if values[elem] == nil {
+				b = append(b, 0)
+				continue
+			}
+			var err error
+			if b, err = appendObject(append(b, 1), elem, values); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if v := values[s][i]; v != nil {
+			b = append(b, v...)
+			continue
+		}
+		var err error
+		if b, err = appendZero(b, f.Type); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// lookupJSONField はキーのフィールドを探す
+// encoding/jsonと同じく完全に一致するものを優先し、なければ大文字と小文字を区別せずに探す
+func lookupJSONField(s *Schema, key string) (*Schema, int, bool) {
+	if owner, i, ok := findJSONField(s, func(name string) bool { return name == key }); ok {
+		return owner, i, true
+	}
+	return findJSONField(s, func(name string) bool { return strings.EqualFold(name, key) })
+}
+
+func findJSONField(s *Schema, match func(name string) bool) (*Schema, int, bool) {
+	for i, f := range s.Fields {
+		if f.Embedded {
+			if owner, j, ok := findJSONField(f.Type.Elem, match); ok {
+				return owner, j, true
+			}
+			continue
+		}
+		if match(f.Name) {
+			return s, i, true
+		}
+	}
+	return nil, 0, false
+}
+
+func appendNumber(b []byte, kind SchemaKind, num string, path string) ([]byte, error) {
+	switch kind {
+	case SchemaInt:
+		v, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrTranscode, path, err)
+		}
+		return appendVarint(b, v), nil
+	case SchemaUint:
+		v, err := strconv.ParseUint(num, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrTranscode, path, err)
+		}
+		return appendUvarint(b, v), nil
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrTranscode, path, err)
+	}
+	return appendUvarint(b, math.Float64bits(v)), nil
+}
+
+// appendMapKey はJSONのオブジェクトのキーをmapのキーの型でエンコードする
+func appendMapKey(b []byte, s *Schema, key string, path string) ([]byte, error) {
+	switch s.Kind {
+	case SchemaString:
+		b = appendUvarint(b, uint64(len(key)))
+		return append(b, key...), nil
+	case SchemaInt, SchemaUint:
+		return appendNumber(b, s.Kind, key, path)
+	}
+	return nil, fmt.Errorf("%w: %s has %s keys", ErrTranscode, path, s.Kind)
+}
+
+func appendTime(b []byte, tm time.Time) ([]byte, error) {
+	var out [VarintLenTime]byte
+	if _, err := TimeMarshalBinary(tm, out[:]); err != nil {
+		return nil, err
+	}
+	return append(b, out[:]...), nil
+}
+
+func appendSliceLen(b []byte, l int, signed bool) []byte {
+	if signed {
+		return appendVarint(b, int64(l))
+	}
+	return appendUvarint(b, uint64(l))
+}
+
+// appendZero はSchemaのゼロ値のエンコード結果を追加する
+func appendZero(b []byte, s *Schema) ([]byte, error) {
+	switch s.Kind {
+	case SchemaBool, SchemaInt, SchemaUint, SchemaFloat, SchemaString, SchemaBytes, SchemaPointer, SchemaSlice, SchemaMap:
+		// 0かnil判定の0、長さ0の1バイト
+		return append(b, 0), nil
+	case SchemaTime:
+		return appendTime(b, time.Time{})
+	case SchemaBinary:
+		if s.Elem == nil {
+			return append(b, 0), nil
+		}
+		inner, err := appendZero(nil, s.Elem)
+		if err != nil {
+			return nil, err
+		}
+		b = appendUvarint(b, uint64(len(inner)))
+		return append(b, inner...), nil
+	case SchemaStruct:
+		var err error
+		for _, f := range s.Fields {
+			if b, err = appendZero(b, f.Type); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("schema: unknown kind %q", s.Kind)
+}
+
+// TranscodeBinaryToJSON はrのバイト列をSchemaに従って読み取り、JSONにしてwに書き出す
+// 出力はデコードした値をjson.Marshalした場合と同じになる
+func TranscodeBinaryToJSON(w io.Writer, r io.Reader, s *Schema) error {
+	t := &binaryTranscoder{r: bufio.NewReader(r), w: bufio.NewWriter(w)}
+	if err := t.value(s, "$"); err != nil {
+		return err
+	}
+	return t.w.Flush()
+}
+
+type binaryTranscoder struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (t *binaryTranscoder) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(t.r)
+	return v, unexpectedEOF(err)
+}
+
+func (t *binaryTranscoder) varint() (int64, error) {
+	v, err := binary.ReadVarint(t.r)
+	return v, unexpectedEOF(err)
+}
+
+// bytes は長さlのバイト列を読み取る
+// 壊れた長さで大きな領域を確保しないように、読み取れた分だけ領域を広げる
+func (t *binaryTranscoder) bytes(l uint64) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	n, err := buf.ReadFrom(io.LimitReader(t.r, limitLen(l)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) != l {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
+
+// presence はnil判定を読み取り、nilならnullを書き出す
+func (t *binaryTranscoder) presence() (bool, error) {
+	isNotNil, err := t.uvarint()
+	if err != nil {
+		return false, err
+	}
+	if isNotNil == 0 {
+		_, err := t.w.WriteString("null")
+		return false, err
+	}
+	return true, nil
+}
+
+func (t *binaryTranscoder) writeJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = t.w.Write(b)
+	return err
+}
+
+func (t *binaryTranscoder) value(s *Schema, path string) error {
+	switch s.Kind {
+	case SchemaBool:
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		return t.writeJSON(b == 1)
+	case SchemaInt:
+		v, err := t.varint()
+		if err != nil {
+			return err
+		}
+		_, err = t.w.WriteString(strconv.FormatInt(v, 10))
+		return err
+	case SchemaUint:
+		v, err := t.uvarint()
+		if err != nil {
+			return err
+		}
+		_, err = t.w.WriteString(strconv.FormatUint(v, 10))
+		return err
+	case SchemaFloat:
+		v, err := t.uvarint()
+		if err != nil {
+			return err
+		}
+		return t.writeJSON(math.Float64frombits(v))
+	case SchemaString:
+		l, err := t.uvarint()
+		if err != nil {
+			return err
+		}
+		b, err := t.bytes(l)
+		if err != nil {
+			return err
+		}
+		return t.writeJSON(string(b))
+	case SchemaBytes:
+		if ok, err := t.presence(); err != nil || !ok {
+			return err
+		}
+		l, err := t.uvarint()
+		if err != nil {
+			return err
+		}
+		b, err := t.bytes(l)
+		if err != nil {
+			return err
+		}
+		return t.writeJSON(b)
+	case SchemaTime:
+		b, err := t.bytes(VarintLenTime)
+		if err != nil {
+			return err
+		}
+		tm := time.Time{}
+		if err := tm.UnmarshalBinary(b); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return t.writeJSON(tm)
+	case SchemaBinary:
+		l, err := t.uvarint()
+		if err != nil {
+			return err
+		}
+		if s.Elem == nil {
+			b, err := t.bytes(l)
+			if err != nil {
+				return err
+			}
+			return t.writeJSON(b)
+		}
+		// MarshalBinaryの出力の範囲だけを読み取る
+		inner := &binaryTranscoder{r: bufio.NewReader(io.LimitReader(t.r, limitLen(l))), w: t.w}
+		if err := inner.value(s.Elem, path); err != nil {
+			return err
+		}
+		if _, err := inner.r.ReadByte(); err != io.EOF {
+			return fmt.Errorf("%s: trailing bytes in the MarshalBinary output", path)
+		}
+		return nil
+	case SchemaPointer:
+		if ok, err := t.presence(); err != nil || !ok {
+			return err
+		}
+		return t.value(s.Elem, path)
+	case SchemaSlice:
+		if ok, err := t.presence(); err != nil || !ok {
+			return err
+		}
+		l, err := t.length(s.Elem.Kind == SchemaStruct)
+		if err != nil {
+			return err
+		}
+		t.w.WriteByte('[')
+		for i := uint64(0); i < l; i++ {
+			if i > 0 {
+				t.w.WriteByte(',')
+			}
+			if err := t.value(s.Elem, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return t.w.WriteByte(']')
+	case SchemaMap:
+		return t.mapValue(s, path)
+	case SchemaStruct:
+		t.w.WriteByte('{')
+		if _, err := t.fields(s, path, true); err != nil {
+			return err
+		}
+		return t.w.WriteByte('}')
+	}
+	return fmt.Errorf("schema: unknown kind %q", s.Kind)
+}
+
+// length は要素数を読み取る
+func (t *binaryTranscoder) length(signed bool) (uint64, error) {
+	if !signed {
+		return t.uvarint()
+	}
+	l, err := t.varint()
+	if err != nil {
+		return 0, err
+	}
+	if l < 0 {
+		return 0, fmt.Errorf("%w: negative length %d", ErrTranscode, l)
+	}
+	return uint64(l), nil
+}
+
+// fields は構造体のフィールドを書き出す
+// 埋め込みポインタの昇格したフィールドはjson.Marshalと同じく同じ階層に並べる
+func (t *binaryTranscoder) fields(s *Schema, path string, first bool) (bool, error) {
+	for _, f := range s.Fields {
+		if f.Embedded {
+			isNotNil, err := t.uvarint()
+			if err != nil {
+				return false, err
+			}
+			if isNotNil == 0 {
+				continue
+			}
+			if first, err = t.fields(f.Type.Elem, path, first); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if !first {
+			t.w.WriteByte(',')
+		}
+		first = false
+		if err := t.writeJSON(f.Name); err != nil {
+			return false, err
+		}
+		t.w.WriteByte(':')
+		if err := t.value(f.Type, path+"."+f.Name); err != nil {
+			return false, err
+		}
+	}
+	return first, nil
+}
+
+// mapValue はmapを書き出す
+// json.Marshalと同じくキーの順に並べるため、mapの要素だけはまとめてから書き出す
+func (t *binaryTranscoder) mapValue(s *Schema, path string) error {
+	if ok, err := t.presence(); err != nil || !ok {
+		return err
+	}
+	l, err := t.uvarint()
+	if err != nil {
+		return err
+	}
+	type entry struct {
+		key   string
+		value []byte
+	}
+	var entries []entry
+	for i := uint64(0); i < l; i++ {
+		var key string
+		switch s.Key.Kind {
+		case SchemaString:
+			kl, err := t.uvarint()
+			if err != nil {
+				return err
+			}
+			b, err := t.bytes(kl)
+			if err != nil {
+				return err
+			}
+			key = string(b)
+		case SchemaInt:
+			v, err := t.varint()
+			if err != nil {
+				return err
+			}
+			key = strconv.FormatInt(v, 10)
+		case SchemaUint:
+			v, err := t.uvarint()
+			if err != nil {
+				return err
+			}
+			key = strconv.FormatUint(v, 10)
+		default:
+			return fmt.Errorf("%w: %s has %s keys", ErrTranscode, path, s.Key.Kind)
+		}
+		buf := bytes.NewBuffer(nil)
+		elem := &binaryTranscoder{r: t.r, w: bufio.NewWriter(buf)}
+		if err := elem.value(s.Elem, fmt.Sprintf("%s[%q]", path, key)); err != nil {
+			return err
+		}
+		if err := elem.w.Flush(); err != nil {
+			return err
+		}
+		entries = append(entries, entry{key: key, value: buf.Bytes()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	t.w.WriteByte('{')
+	for i, e := range entries {
+		if i > 0 {
+			t.w.WriteByte(',')
+		}
+		if err := t.writeJSON(e.key); err != nil {
+			return err
+		}
+		t.w.WriteByte(':')
+		t.w.Write(e.value)
+	}
+	return t.w.WriteByte('}')
+}
+
+func limitLen(l uint64) int64 {
+	if l > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(l)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
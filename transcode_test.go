@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTranscodeJSONToBinary(t *testing.T) {
+	data := createTestStructs(10)
+	data[0].SubPointer = nil
+	data[1].Subs = nil
+	js, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// json.Unmarshalした値と同じになる
+	decoded := TestStructs{}
+	if err := json.Unmarshal(js, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	want, err := decoded.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := LookupSchema("TestStructs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		r    io.Reader
+	}{
+		{name: "seeker", r: bytes.NewReader(js)},
+		{name: "stream", r: io.MultiReader(bytes.NewReader(js))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			if err := TranscodeJSONToBinary(buf, tt.r, schema); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Error("TranscodeJSONToBinary output differs from TestStructs.Encode")
+			}
+		})
+	}
+}
+
+func TestTranscodeBinaryToJSON(t *testing.T) {
+	data := createTestStructs(10)
+	data[0].SubPointer = nil
+	data[1].Subs = nil
+	bs, err := data.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := LookupSchema("TestStructs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := TranscodeBinaryToJSON(buf, bytes.NewReader(bs), schema); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(want), buf.String()); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestTranscodeRoundTrip(t *testing.T) {
+	type record struct {
+		Name    string
+		Counts  map[string]int
+		Labels  map[int]string
+		Payload []byte
+		Scores  []float64
+		Ss      TestStructs
+	}
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{name: "TestOrder", value: &TestOrder{TestAudit: TestAudit{CreatedBy: "user"}, TestOwner: &TestOwner{Email: "owner@example.com"}, ID: 1, Name: "order", Amount: 2}},
+		{name: "TestOrder without owner", value: &TestOrder{ID: 1, Name: "order"}},
+		{name: "record", value: &record{
+			Name:    "test_string",
+			Counts:  map[string]int{"b": 2, "a": -1},
+			Labels:  map[int]string{10: "ten", 2: "two"},
+			Payload: []byte("<payload>"),
+			Scores:  []float64{0.5, -1},
+			Ss:      createTestStructs(1),
+		}},
+		{name: "empty record", value: &record{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ := reflect.TypeOf(tt.value).Elem()
+			schema, err := SchemaOf(typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bs, err := EncodeStruct(tt.value, LayoutFlatten)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			js := bytes.NewBuffer(nil)
+			if err := TranscodeBinaryToJSON(js, bytes.NewReader(bs), schema); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(want), js.String()); diff != "" {
+				t.Errorf("binary to JSON: %s", diff)
+			}
+
+			out := bytes.NewBuffer(nil)
+			if err := TranscodeJSONToBinary(out, js, schema); err != nil {
+				t.Fatal(err)
+			}
+			decoded := reflect.New(typ)
+			if _, err := DecodeStruct(out.Bytes(), decoded.Interface(), LayoutFlatten); err != nil {
+				t.Fatal(err)
+			}
+			unmarshaled := reflect.New(typ)
+			if err := json.Unmarshal(want, unmarshaled.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(unmarshaled.Interface(), decoded.Interface()); diff != "" {
+				t.Errorf("JSON to binary: %s", diff)
+			}
+		})
+	}
+}
+
+func TestTranscodeJSONFields(t *testing.T) {
+	schema, err := SchemaOf(reflect.TypeOf(TestSubStruct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 知らないフィールドは読み飛ばし、ないフィールドはゼロ値にする
+	js := `{"unknown":[1,{"a":2}],"uint8":7,"Str":"test_string"}`
+	buf := bytes.NewBuffer(nil)
+	if err := TranscodeJSONToBinary(buf, strings.NewReader(js), schema); err != nil {
+		t.Fatal(err)
+	}
+	decoded := TestSubStruct{}
+	if _, err := decoded.Decode(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	want := TestSubStruct{Str: "test_string", Uint8: 7}
+	if diff := cmp.Diff(want, decoded); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestTranscodeErrors(t *testing.T) {
+	schema, err := LookupSchema("TestStructs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, js := range []string{
+		`[{"Str":1}]`,
+		`[{"Int":"1"}]`,
+		`[{"Int":1.5}]`,
+		`{"Str":"test_string"}`,
+	} {
+		err := TranscodeJSONToBinary(io.Discard, strings.NewReader(js), schema)
+		if !errors.Is(err, ErrTranscode) {
+			t.Errorf("TranscodeJSONToBinary(%s) error = %v, want %v", js, err, ErrTranscode)
+		}
+	}
+
+	bs, err := createTestStructs(1).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(bs); i++ {
+		err := TranscodeBinaryToJSON(io.Discard, bytes.NewReader(bs[:i]), schema)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("TranscodeBinaryToJSON(bs[:%d]) error = %v, want %v", i, err, io.ErrUnexpectedEOF)
+		}
+	}
+}